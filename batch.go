@@ -0,0 +1,67 @@
+package sysvipc
+
+import "syscall"
+
+// SendBatch places several messages onto the queue. Only the first send
+// blocks (unless flags.DontWait is set); the rest are sent without waiting.
+// It returns how many messages were sent and the error that stopped it,
+// which is syscall.EAGAIN if the queue filled up partway through.
+func (mq MessageQueue) SendBatch(msgs []Message, flags *MQSendFlags) (int, error) {
+	nowait := &MQSendFlags{DontWait: true}
+
+	for i, msg := range msgs {
+		f := nowait
+		if i == 0 {
+			f = flags
+		}
+		if err := mq.Send(msg.Type, msg.Body, f); err != nil {
+			return i, err
+		}
+	}
+	return len(msgs), nil
+}
+
+// ReceiveBatch retrieves up to max messages from the queue. Only the first
+// receive blocks (unless flags.DontWait is set); it then takes whatever else
+// is already waiting. msgtyp, maxlen and flags.Truncate work as in Receive.
+// Running out of messages after the first isn't an error, but any other
+// failure is returned along with the messages received before it.
+func (mq MessageQueue) ReceiveBatch(max int, maxlen uint, msgtyp int64, flags *MQRecvFlags) ([]Message, error) {
+	var msgs []Message
+	nowait := &MQRecvFlags{DontWait: true}
+	if flags != nil {
+		nowait.Truncate = flags.Truncate
+	}
+
+	for len(msgs) < max {
+		f := nowait
+		if len(msgs) == 0 {
+			f = flags
+		}
+
+		body, mtyp, err := mq.Receive(maxlen, msgtyp, f)
+		if err != nil {
+			if len(msgs) > 0 && (err == syscall.ENOMSG || err == syscall.EAGAIN) {
+				break
+			}
+			return msgs, err
+		}
+		msgs = append(msgs, Message{mtyp, body})
+	}
+	return msgs, nil
+}
+
+// Drain discards every message on the queue selected by msgtyp (0 for all
+// of them) without blocking, and returns how many there were.
+func (mq MessageQueue) Drain(msgtyp int64) (int, error) {
+	flags := &MQRecvFlags{DontWait: true, Truncate: true}
+
+	for n := 0; ; n++ {
+		if _, _, err := mq.Receive(0, msgtyp, flags); err != nil {
+			if err == syscall.ENOMSG || err == syscall.EAGAIN {
+				return n, nil
+			}
+			return n, err
+		}
+	}
+}
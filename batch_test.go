@@ -0,0 +1,171 @@
+package sysvipc
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+func TestSendBatch(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	msgs := []Message{{1, []byte("one")}, {2, []byte("two")}, {3, []byte("three")}}
+	n, err := q.SendBatch(msgs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Error("wrong count", n)
+	}
+
+	info, err := q.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.MsgCount != 3 {
+		t.Error("messages missing from the queue", info.MsgCount)
+	}
+
+	// only room for one more 8-byte message after what's already there
+	info.MaxBytes = info.CurrentBytes + 8
+	if err := q.Set(info); err != nil {
+		t.Fatal(err)
+	}
+	full := []Message{{4, []byte("12345678")}, {5, []byte("12345678")}}
+	n, err = q.SendBatch(full, nil)
+	if n != 1 || err != syscall.EAGAIN {
+		t.Error("second send should have hit a full queue", n, err)
+	}
+}
+
+func TestReceiveBatch(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	for i := 1; i <= 5; i++ {
+		if err := q.Send(int64(i), []byte(fmt.Sprint(i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msgs, err := q.ReceiveBatch(3, 64, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 || msgs[0].Type != 1 || msgs[2].Type != 3 {
+		t.Errorf("got %v", msgs)
+	}
+
+	msgs, err = q.ReceiveBatch(10, 64, 0, nil)
+	if err != nil {
+		t.Fatal("running out of messages shouldn't be an error", err)
+	}
+	if len(msgs) != 2 || string(msgs[1].Body) != "5" {
+		t.Errorf("got %v", msgs)
+	}
+
+	_, err = q.ReceiveBatch(10, 64, 0, &MQRecvFlags{DontWait: true})
+	if err != syscall.ENOMSG && err != syscall.EAGAIN {
+		t.Error("empty non-blocking batch should fail", err)
+	}
+
+	q.Send(1, []byte("short"), nil)
+	q.Send(1, []byte("much too long"), nil)
+	msgs, err = q.ReceiveBatch(10, 8, 0, nil)
+	if err != syscall.E2BIG {
+		t.Error("too-long message should fail the batch", err)
+	}
+	if len(msgs) != 1 {
+		t.Error("should still get the messages before the failure", msgs)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	for i := 1; i <= 6; i++ {
+		if err := q.Send(int64(i%2+1), []byte("a message body"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := q.Drain(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Error("should have drained the three type-2 messages", n)
+	}
+
+	n, err = q.Drain(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Error("should have drained the rest", n)
+	}
+
+	info, err := q.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.MsgCount != 0 {
+		t.Error("queue not empty", info.MsgCount)
+	}
+}
+
+func BenchmarkSendReceiveSingle(b *testing.B) {
+	benchQueue(b, func(msgs []Message) {
+		for _, msg := range msgs {
+			if err := q.Send(msg.Type, msg.Body, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for range msgs {
+			if _, _, err := q.Receive(64, 0, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSendReceiveBatch(b *testing.B) {
+	benchQueue(b, func(msgs []Message) {
+		if _, err := q.SendBatch(msgs, nil); err != nil {
+			b.Fatal(err)
+		}
+		for n := 0; n < len(msgs); {
+			got, err := q.ReceiveBatch(len(msgs), 64, 0, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			n += len(got)
+		}
+	})
+}
+
+func benchQueue(b *testing.B, round func([]Message)) {
+	mq, err := GetMsgQueue(0xDA7ABA5E, &MQFlags{
+		Create:    true,
+		Exclusive: true,
+		Perms:     0600,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer mq.Remove()
+	q = mq
+
+	msgs := make([]Message, 64)
+	for i := range msgs {
+		msgs[i] = Message{1, []byte("a small log line")}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		round(msgs)
+	}
+	b.SetBytes(int64(len(msgs) * 16))
+}
@@ -0,0 +1,35 @@
+//go:build !386
+
+package sysvipc
+
+import (
+	"syscall"
+	"testing"
+)
+
+// semGetval is GETVAL from <linux/sem.h>, since test files can't use cgo.
+const semGetval = 12
+
+// BenchmarkCgoOverhead compares the same semctl(GETVAL) made through cgo,
+// as the package does, and as a raw system call. The difference is the
+// per-call cost of cgo. (linux/386 has no semctl system call of its own,
+// hence the build constraint.)
+func BenchmarkCgoOverhead(b *testing.B) {
+	ss := benchSemSet(b, Kernel, 1).(*SemaphoreSet)
+
+	b.Run("call=cgo", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := ss.Getval(0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("call=raw", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _, errno := syscall.Syscall6(syscall.SYS_SEMCTL, uintptr(ss.id), 0, semGetval, 0, 0, 0)
+			if errno != 0 {
+				b.Fatal(errno)
+			}
+		}
+	})
+}
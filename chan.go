@@ -0,0 +1,208 @@
+package sysvipc
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Message is a single message taken from or bound for a MessageQueue.
+type Message struct {
+	Type int64
+	Body []byte
+}
+
+// ChanFlags holds the options for MessageQueue.Subscribe and Publisher.
+type ChanFlags struct {
+	// Buffer is the capacity of the channel, so up to this many messages can
+	// be pulled off (or waiting to go onto) the queue ahead of the consumer.
+	Buffer int
+
+	// MaxLen is the largest message body Subscribe will receive. It
+	// defaults to DefaultMsgMax.
+	MaxLen uint
+
+	// Truncate allows Subscribe to shorten messages longer than MaxLen
+	// instead of failing with syscall.E2BIG.
+	Truncate bool
+
+	// OnError is called with the error that stopped the adapter, if it
+	// wasn't ctx being done. This is syscall.EIDRM if the queue was removed.
+	OnError func(error)
+}
+
+func (cf *ChanFlags) buffer() int {
+	if cf == nil {
+		return 0
+	}
+	return cf.Buffer
+}
+
+func (cf *ChanFlags) maxlen() uint {
+	if cf == nil || cf.MaxLen == 0 {
+		return DefaultMsgMax
+	}
+	return cf.MaxLen
+}
+
+func (cf *ChanFlags) recvFlags() *MQRecvFlags {
+	return &MQRecvFlags{Truncate: cf != nil && cf.Truncate}
+}
+
+func (cf *ChanFlags) report(err error) {
+	if cf != nil && cf.OnError != nil {
+		cf.OnError(err)
+	}
+}
+
+// Subscribe starts a goroutine receiving messages (selected by msgtyp as in
+// Receive) onto the returned channel. It stops and closes the channel when
+// ctx is done or receiving fails, interrupting a blocked msgrcv if need be.
+// A message taken off the queue just as ctx finishes is lost.
+func (mq MessageQueue) Subscribe(ctx context.Context, msgtyp int64, flags *ChanFlags) <-chan Message {
+	ch := make(chan Message, flags.buffer())
+
+	go func() {
+		defer close(ch)
+
+		intr := startInterrupter(ctx)
+		defer intr.stop()
+
+		for {
+			body, mtyp, err := mq.Receive(flags.maxlen(), msgtyp, flags.recvFlags())
+			if ctx.Err() != nil {
+				return
+			}
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				flags.report(err)
+				return
+			}
+
+			select {
+			case ch <- Message{mtyp, body}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+// Publisher starts a goroutine sending every Message placed on the returned
+// channel to the queue. It stops when ctx is done or the channel is closed,
+// interrupting a blocked msgsnd if need be; messages still buffered then are
+// dropped. If sending fails, later messages are discarded until then.
+func (mq MessageQueue) Publisher(ctx context.Context, flags *ChanFlags) chan<- Message {
+	ch := make(chan Message, flags.buffer())
+
+	go func() {
+		intr := startInterrupter(ctx)
+		defer intr.stop()
+
+		for {
+			var msg Message
+			var ok bool
+			select {
+			case msg, ok = <-ch:
+				if !ok {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+
+			err := mq.Send(msg.Type, msg.Body, nil)
+			for err == syscall.EINTR && ctx.Err() == nil {
+				err = mq.Send(msg.Type, msg.Body, nil)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				flags.report(err)
+				intr.stop()
+				discard(ctx, ch)
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+func discard(ctx context.Context, ch <-chan Message) {
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// interrupter pins the calling goroutine to its OS thread and, once ctx is
+// done, signals that thread until stopped. msgrcv, msgsnd and semtimedop
+// are never restarted after a signal, so a blocked call returns EINTR.
+type interrupter struct {
+	mu      sync.Mutex
+	stopped bool
+	done    chan struct{}
+}
+
+func startInterrupter(ctx context.Context) *interrupter {
+	runtime.LockOSThread()
+	pid, tid := os.Getpid(), syscall.Gettid()
+	intr := &interrupter{done: make(chan struct{})}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-intr.done:
+			return
+		}
+
+		// keep at it in case the signal lands just before the syscall starts
+		for {
+			intr.mu.Lock()
+			if intr.stopped {
+				intr.mu.Unlock()
+				return
+			}
+			// SIGURG is what the runtime uses for preemption, so it's
+			// already handled and otherwise harmless
+			syscall.Tgkill(pid, tid, syscall.SIGURG)
+			intr.mu.Unlock()
+
+			select {
+			case <-intr.done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+
+	return intr
+}
+
+// stop must be called from the goroutine that started the interrupter. It
+// guarantees no more signals are sent before releasing the OS thread.
+func (intr *interrupter) stop() {
+	intr.mu.Lock()
+	defer intr.mu.Unlock()
+	if intr.stopped {
+		return
+	}
+	intr.stopped = true
+	close(intr.done)
+	runtime.UnlockOSThread()
+}
@@ -0,0 +1,163 @@
+package sysvipc
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := q.Subscribe(ctx, 4, &ChanFlags{Buffer: 2})
+
+	for _, s := range []string{"one", "two", "three"} {
+		if err := q.Send(4, []byte(s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, s := range []string{"one", "two", "three"} {
+		select {
+		case msg := <-ch:
+			if msg.Type != 4 || string(msg.Body) != s {
+				t.Errorf("got %d %q, wanted %q", msg.Type, msg.Body, s)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for", s)
+		}
+	}
+}
+
+func TestSubscribeCancel(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	ch := q.Subscribe(ctx, 0, &ChanFlags{OnError: func(err error) { errs <- err }})
+
+	// give it time to block in msgrcv
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Error("shouldn't have received anything")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked receive wasn't interrupted")
+	}
+
+	select {
+	case err := <-errs:
+		t.Error("cancellation shouldn't be reported as an error", err)
+	default:
+	}
+}
+
+func TestSubscribeRemoved(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	errs := make(chan error, 1)
+	ch := q.Subscribe(context.Background(), 0, &ChanFlags{OnError: func(err error) { errs <- err }})
+
+	time.Sleep(20 * time.Millisecond)
+	if err := q.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errs:
+		if err != syscall.EIDRM {
+			t.Error("expected EIDRM", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queue removal wasn't reported")
+	}
+	if _, ok := <-ch; ok {
+		t.Error("channel should be closed")
+	}
+
+	// so the msgTeardown doesn't fail
+	msgSetup(t)
+}
+
+func TestPublisher(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := q.Publisher(ctx, &ChanFlags{Buffer: 4})
+	ch <- Message{Type: 2, Body: []byte("first")}
+	ch <- Message{Type: 3, Body: []byte("second")}
+
+	for _, s := range []string{"first", "second"} {
+		body, _, err := q.Receive(64, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != s {
+			t.Errorf("got %q, wanted %q", body, s)
+		}
+	}
+}
+
+func TestPublisherCancel(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	info, err := q.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.MaxBytes = 8
+	if err := q.Set(info); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	ch := q.Publisher(ctx, &ChanFlags{OnError: func(err error) { errs <- err }})
+
+	// the second message can't fit, so msgsnd blocks
+	ch <- Message{Type: 1, Body: []byte("12345678")}
+	ch <- Message{Type: 1, Body: []byte("12345678")}
+	time.Sleep(20 * time.Millisecond)
+
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		// once the publisher has stopped nothing will take this
+		select {
+		case ch <- Message{Type: 1}:
+		case <-time.After(100 * time.Millisecond):
+		}
+		close(done)
+	}()
+	<-done
+
+	info, err = q.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.MsgCount != 1 {
+		t.Error("blocked send should have been abandoned", info.MsgCount)
+	}
+
+	select {
+	case err := <-errs:
+		t.Error("cancellation shouldn't be reported as an error", err)
+	default:
+	}
+}
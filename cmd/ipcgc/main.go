@@ -0,0 +1,75 @@
+// Command ipcgc removes orphaned SysV IPC objects left behind by crashed
+// processes.
+//
+// Usage:
+//
+//	ipcgc [-n] [-tag 0xNN] [-dead-creator] [-idle 24h] [-kinds msg,sem,shm]
+//
+// At least one of -dead-creator and -idle must be given. Each object
+// removed (or, with -n, that would be) is printed on its own line.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/teepark/go-sysvipc"
+)
+
+func main() {
+	var policy sysvipc.GCPolicy
+	var tag, kinds string
+
+	flag.BoolVar(&policy.DryRun, "n", false, "dry run: report orphans without removing them")
+	flag.StringVar(&tag, "tag", "", "only touch objects whose key's top byte is this owner tag")
+	flag.BoolVar(&policy.DeadCreator, "dead-creator", false, "collect unattached segments whose creator has exited")
+	flag.DurationVar(&policy.IdleTTL, "idle", 0, "collect objects with no activity for this long")
+	flag.StringVar(&kinds, "kinds", "msg,sem,shm", "comma-separated kinds of object to consider")
+	flag.Parse()
+
+	if flag.NArg() > 0 || (!policy.DeadCreator && policy.IdleTTL <= 0) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if tag != "" {
+		t, err := strconv.ParseUint(tag, 0, 8)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ipcgc: bad -tag:", err)
+			os.Exit(2)
+		}
+		ot := sysvipc.OwnerTag(t)
+		policy.Tag = &ot
+	}
+
+	for _, kind := range strings.Split(kinds, ",") {
+		switch k := sysvipc.HandleKind(kind); k {
+		case sysvipc.HandleMsgQueue, sysvipc.HandleSemSet, sysvipc.HandleSharedMem:
+			policy.Kinds = append(policy.Kinds, k)
+		default:
+			fmt.Fprintf(os.Stderr, "ipcgc: unknown kind %q\n", kind)
+			os.Exit(2)
+		}
+	}
+
+	orphans, err := sysvipc.GC(&policy)
+	status := 0
+	for _, o := range orphans {
+		verb := "removed"
+		if policy.DryRun {
+			verb = "would remove"
+		} else if o.Err != nil {
+			verb = "failed to remove"
+			status = 1
+		}
+		fmt.Println(verb, o)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ipcgc:", err)
+		status = 1
+	}
+	os.Exit(status)
+}
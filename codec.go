@@ -0,0 +1,164 @@
+package sysvipc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Codec converts values to and from message bodies.
+type Codec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte, v interface{}) error
+}
+
+// GobCodec encodes messages with encoding/gob. Each message carries its own
+// type information, so it is larger than with a long-lived gob stream but
+// can be decoded on its own.
+type GobCodec struct{}
+
+func (GobCodec) Encode(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Decode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// JSONCodec encodes messages with encoding/json.
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// BinaryCodec encodes fixed-size values with encoding/binary, so that a
+// TypedQueue's messages have the same layout as a C program's
+//
+//	struct { long mtype; T body; }
+//
+// encoding/binary doesn't insert alignment padding, so to match a C struct
+// with padding the Go type needs explicit blank fields (e.g. _ [4]byte).
+// ByteOrder defaults to the machine's native order.
+type BinaryCodec struct {
+	ByteOrder binary.ByteOrder
+}
+
+func (bc BinaryCodec) order() binary.ByteOrder {
+	if bc.ByteOrder == nil {
+		return binary.NativeEndian
+	}
+	return bc.ByteOrder
+}
+
+func (bc BinaryCodec) Encode(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := binary.Write(buf, bc.order(), v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (bc BinaryCodec) Decode(data []byte, v interface{}) error {
+	if size := binary.Size(v); size != len(data) {
+		return fmt.Errorf("sysvipc: message is %d bytes, expected %d", len(data), size)
+	}
+	return binary.Read(bytes.NewReader(data), bc.order(), v)
+}
+
+// EncodeError is returned by TypedQueue.Send when the codec can't encode
+// the value. Nothing was sent.
+type EncodeError struct {
+	Err error
+}
+
+func (e *EncodeError) Error() string {
+	return "sysvipc: encoding message: " + e.Err.Error()
+}
+
+func (e *EncodeError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeError is returned by TypedQueue.Receive when a message was taken
+// off the queue but the codec couldn't decode it. The raw message is kept
+// so it isn't lost.
+type DecodeError struct {
+	Type int64
+	Body []byte
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("sysvipc: decoding message of type %d: %v", e.Type, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// TypedQueue sends and receives values of type T through a MessageQueue,
+// converting them with a Codec. Errors from the codec are reported as
+// *EncodeError or *DecodeError, while errors from the queue itself are
+// returned as-is.
+type TypedQueue[T any] struct {
+	mq     MessageQueue
+	codec  Codec
+	maxlen uint
+}
+
+// NewTypedQueue creates a TypedQueue. maxlen is the largest encoded message
+// Receive will accept; 0 means the encoded size of T for a BinaryCodec, and
+// DefaultMsgMax otherwise.
+func NewTypedQueue[T any](mq MessageQueue, codec Codec, maxlen uint) *TypedQueue[T] {
+	if maxlen == 0 {
+		maxlen = DefaultMsgMax
+		switch codec.(type) {
+		case BinaryCodec, *BinaryCodec:
+			var zero T
+			if size := binary.Size(&zero); size > 0 {
+				maxlen = uint(size)
+			}
+		}
+	}
+	return &TypedQueue[T]{mq, codec, maxlen}
+}
+
+// Queue returns the underlying MessageQueue.
+func (tq *TypedQueue[T]) Queue() MessageQueue {
+	return tq.mq
+}
+
+// Send encodes v and places it on the queue.
+func (tq *TypedQueue[T]) Send(mtyp int64, v T, flags *MQSendFlags) error {
+	body, err := tq.codec.Encode(&v)
+	if err != nil {
+		return &EncodeError{err}
+	}
+	return tq.mq.Send(mtyp, body, flags)
+}
+
+// Receive retrieves a message from the queue and decodes it.
+func (tq *TypedQueue[T]) Receive(msgtyp int64, flags *MQRecvFlags) (T, int64, error) {
+	var v T
+
+	body, mtyp, err := tq.mq.Receive(tq.maxlen, msgtyp, flags)
+	if err != nil {
+		return v, 0, err
+	}
+
+	if err := tq.codec.Decode(body, &v); err != nil {
+		return v, mtyp, &DecodeError{mtyp, body, err}
+	}
+	return v, mtyp, nil
+}
@@ -0,0 +1,134 @@
+package sysvipc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"syscall"
+	"testing"
+)
+
+type codecRecord struct {
+	Name  string
+	Count int
+	Tags  []string
+}
+
+func TestTypedQueueRoundTrip(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	for _, codec := range []Codec{GobCodec{}, JSONCodec{}} {
+		tq := NewTypedQueue[codecRecord](q, codec, 0)
+
+		sent := codecRecord{"widget", 3, []string{"a", "b"}}
+		if err := tq.Send(5, sent, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		got, mtyp, err := tq.Receive(5, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mtyp != 5 || got.Name != sent.Name || got.Count != sent.Count || len(got.Tags) != 2 {
+			t.Errorf("%T: sent %+v, got %d %+v", codec, sent, mtyp, got)
+		}
+	}
+}
+
+// laid out like struct { int32_t id; /* 4 bytes padding */ int64_t value; char name[8]; }
+type cRecord struct {
+	ID    int32
+	_     [4]byte
+	Value int64
+	Name  [8]byte
+}
+
+func TestBinaryCodecMaxlen(t *testing.T) {
+	for _, codec := range []Codec{BinaryCodec{}, &BinaryCodec{}} {
+		if tq := NewTypedQueue[cRecord](q, codec, 0); tq.maxlen != 24 {
+			t.Errorf("%T: maxlen %d, want the record size", codec, tq.maxlen)
+		}
+	}
+	if tq := NewTypedQueue[cRecord](q, JSONCodec{}, 0); tq.maxlen != DefaultMsgMax {
+		t.Errorf("JSONCodec: maxlen %d", tq.maxlen)
+	}
+}
+
+func TestBinaryCodecCLayout(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	tq := NewTypedQueue[cRecord](q, BinaryCodec{}, 0)
+
+	rec := cRecord{ID: 7, Value: -2}
+	copy(rec.Name[:], "gopher")
+	if err := tq.Send(1, rec, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _, err := q.Receive(64, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make([]byte, 24)
+	binary.NativeEndian.PutUint32(want[0:], 7)
+	binary.NativeEndian.PutUint64(want[8:], uint64(0xFFFFFFFFFFFFFFFE))
+	copy(want[16:], "gopher")
+	if !bytes.Equal(raw, want) {
+		t.Fatalf("got layout %v, wanted %v", raw, want)
+	}
+
+	// and the other direction, as a C sender would produce it
+	if err := q.Send(2, want, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, mtyp, err := tq.Receive(2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtyp != 2 || got.ID != 7 || got.Value != -2 || string(got.Name[:6]) != "gopher" {
+		t.Errorf("got %d %+v", mtyp, got)
+	}
+}
+
+func TestTypedQueueErrors(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	tq := NewTypedQueue[codecRecord](q, JSONCodec{}, 0)
+
+	if err := q.Send(3, []byte("{not json"), nil); err != nil {
+		t.Fatal(err)
+	}
+	_, mtyp, err := tq.Receive(3, nil)
+	derr, ok := err.(*DecodeError)
+	if !ok {
+		t.Fatal("bad message should give a DecodeError", err)
+	}
+	if mtyp != 3 || derr.Type != 3 || string(derr.Body) != "{not json" {
+		t.Errorf("DecodeError lost the message: %d %+v", mtyp, derr)
+	}
+
+	_, _, err = tq.Receive(3, &MQRecvFlags{DontWait: true})
+	if err != syscall.ENOMSG && err != syscall.EAGAIN {
+		t.Error("syscall errors should come through unwrapped", err)
+	}
+
+	bq := NewTypedQueue[cRecord](q, BinaryCodec{}, 64)
+	if err := q.Send(4, []byte("short"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := bq.Receive(4, nil); err == nil {
+		t.Error("wrong-sized message should fail")
+	} else if _, ok := err.(*DecodeError); !ok {
+		t.Error("wrong-sized message should give a DecodeError", err)
+	}
+
+	fq := NewTypedQueue[func()](q, JSONCodec{}, 0)
+	if err := fq.Send(1, func() {}, nil); err == nil {
+		t.Error("unencodable value should fail")
+	} else if _, ok := err.(*EncodeError); !ok {
+		t.Error("unencodable value should give an EncodeError", err)
+	}
+}
@@ -11,6 +11,7 @@ key_t ftok(const char *pathname, int proj_id);
 import "C"
 import (
 	"errors"
+	"time"
 	"unsafe"
 )
 
@@ -21,6 +22,44 @@ type IpcPerms struct {
 	CreatorUID int
 	CreatorGID int
 	Mode       uint16
+
+	// Key is the IPC key the object was created with, as passed to the Get
+	// function. It is 0 for IPC_PRIVATE objects, and for shared memory
+	// segments that have been marked for removal.
+	Key int64
+
+	// Seq is the slot usage sequence number the kernel folds into the id.
+	Seq uint16
+}
+
+func ipcPerms(perm *C.struct_ipc_perm) IpcPerms {
+	return IpcPerms{
+		OwnerUID:   int(perm.uid),
+		OwnerGID:   int(perm.gid),
+		CreatorUID: int(perm.cuid),
+		CreatorGID: int(perm.cgid),
+		Mode:       uint16(perm.mode),
+		Key:        int64(uint32(perm.__key)),
+		Seq:        uint16(perm.__seq),
+	}
+}
+
+func chown(perms *IpcPerms, uid, gid int) {
+	if uid != -1 {
+		perms.OwnerUID = uid
+	}
+	if gid != -1 {
+		perms.OwnerGID = gid
+	}
+}
+
+// ipcTime converts a kernel timestamp, which only has second resolution,
+// leaving "never" (0) as the zero time.Time rather than the Unix epoch.
+func ipcTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
 }
 
 // Ftok creates a System V IPC key suitable for msgget, semget, or shmget.
@@ -0,0 +1,465 @@
+package sysvipc
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The conformance tests run against both the kernel and a Fake, to check
+// the Fake behaves the same.
+
+func conform(t *testing.T, test func(*testing.T, Namespace)) {
+	t.Run("kernel", func(t *testing.T) { test(t, Kernel) })
+	t.Run("fake", func(t *testing.T) { test(t, NewFake()) })
+}
+
+// backends runs a benchmark against both the kernel and a Fake. The
+// sub-benchmarks are named backend=kernel and backend=fake, so results can
+// be compared with benchstat.
+func backends(b *testing.B, bench func(*testing.B, Namespace)) {
+	b.Run("backend=kernel", func(b *testing.B) { bench(b, Kernel) })
+	b.Run("backend=fake", func(b *testing.B) { bench(b, NewFake()) })
+}
+
+// eventually polls cond until it holds, or fails the test after a second.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func conformQueue(t *testing.T, ns Namespace) Queue {
+	q, err := ns.GetMsgQueue(0xDA7ABA5E, &MQFlags{Create: true, Exclusive: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestConformQueueGet(t *testing.T) {
+	conform(t, func(t *testing.T, ns Namespace) {
+		if _, err := ns.GetMsgQueue(0xDA7ABA5E, nil); err != syscall.ENOENT {
+			t.Error("opening a missing key should fail with ENOENT", err)
+		}
+
+		q := conformQueue(t, ns)
+		defer q.Remove()
+
+		if _, err := ns.GetMsgQueue(0xDA7ABA5E, &MQFlags{Create: true, Exclusive: true}); err != syscall.EEXIST {
+			t.Error("exclusive create of an existing key should fail with EEXIST", err)
+		}
+
+		again, err := ns.GetMsgQueue(0xDA7ABA5E, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Send(1, []byte("x"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := again.Stat(); err != nil || info.MsgCount != 1 {
+			t.Error("reopened a different queue", err)
+		}
+
+		priv, err := ns.GetMsgQueue(0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer priv.Remove()
+		if info, err := priv.Stat(); err != nil || info.MsgCount != 0 || info.Perms.Key != 0 {
+			t.Error("IPC_PRIVATE should give a new queue", err)
+		}
+	})
+}
+
+func TestConformQueueSelection(t *testing.T) {
+	conform(t, func(t *testing.T, ns Namespace) {
+		q := conformQueue(t, ns)
+		defer q.Remove()
+
+		for _, m := range []Message{{5, []byte("a")}, {3, []byte("b")}, {7, []byte("c")}, {3, []byte("d")}} {
+			if err := q.Send(m.Type, m.Body, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		nowait := &MQRecvFlags{DontWait: true}
+		for _, c := range []struct {
+			msgtyp int64
+			mtyp   int64
+			body   string
+		}{
+			{7, 7, "c"},  // first of that type
+			{-6, 3, "b"}, // lowest type <= 6, oldest first
+			{0, 5, "a"},  // oldest of any type
+			{-99, 3, "d"},
+		} {
+			body, mtyp, err := q.Receive(8, c.msgtyp, nowait)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mtyp != c.mtyp || string(body) != c.body {
+				t.Errorf("msgtyp %d got %d %q, expected %d %q", c.msgtyp, mtyp, body, c.mtyp, c.body)
+			}
+		}
+
+		if _, _, err := q.Receive(8, 0, nowait); err != syscall.ENOMSG {
+			t.Error("empty queue should give ENOMSG", err)
+		}
+		if err := q.Send(0, []byte("x"), nil); err != syscall.EINVAL {
+			t.Error("mtype 0 should be rejected", err)
+		}
+	})
+}
+
+func TestConformQueueSizes(t *testing.T) {
+	conform(t, func(t *testing.T, ns Namespace) {
+		q := conformQueue(t, ns)
+		defer q.Remove()
+
+		if err := q.Send(1, []byte("0123456789"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := q.Receive(4, 0, nil); err != syscall.E2BIG {
+			t.Error("too-small maxlen should give E2BIG", err)
+		}
+		body, _, err := q.Receive(4, 0, &MQRecvFlags{Truncate: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "0123" {
+			t.Errorf("wrong truncated body %q", body)
+		}
+
+		if err := q.SetMaxBytes(8); err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Send(1, []byte("12345"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Send(1, []byte("12345"), &MQSendFlags{DontWait: true}); err != syscall.EAGAIN {
+			t.Error("full queue should give EAGAIN", err)
+		}
+
+		info, err := q.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.MsgCount != 1 || info.CurrentBytes != 5 || info.MaxBytes != 8 {
+			t.Error("wrong stats", info.MsgCount, info.CurrentBytes, info.MaxBytes)
+		}
+		if info.LastSend.IsZero() || info.LastRcv.IsZero() {
+			t.Error("missing send/receive times")
+		}
+	})
+}
+
+func TestConformQueueBlocking(t *testing.T) {
+	conform(t, func(t *testing.T, ns Namespace) {
+		q := conformQueue(t, ns)
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			q.Send(2, []byte("late"), nil)
+		}()
+		body, _, err := q.Receive(8, 2, nil)
+		if err != nil || string(body) != "late" {
+			t.Fatal("blocked receive should get the message", err)
+		}
+
+		errs := make(chan error)
+		go func() {
+			_, _, err := q.Receive(8, 0, nil)
+			errs <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+		if err := q.Remove(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != syscall.EIDRM {
+			t.Error("blocked receive should get EIDRM", err)
+		}
+
+		if err := q.Send(1, []byte("x"), nil); err != syscall.EINVAL {
+			t.Error("sending to a removed queue should give EINVAL", err)
+		}
+		if _, err := q.Stat(); err != syscall.EINVAL {
+			t.Error("stat of a removed queue should give EINVAL", err)
+		}
+	})
+}
+
+func conformSemSet(t *testing.T, ns Namespace) SemSet {
+	ss, err := ns.GetSemSet(0xDA7ABA5E, 3, &SemSetFlags{Create: true, Exclusive: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ss
+}
+
+func TestConformSemGet(t *testing.T) {
+	conform(t, func(t *testing.T, ns Namespace) {
+		if _, err := ns.GetSemSet(0xDA7ABA5E, 3, nil); err != syscall.ENOENT {
+			t.Error("opening a missing key should fail with ENOENT", err)
+		}
+
+		ss := conformSemSet(t, ns)
+		defer ss.Remove()
+
+		if _, err := ns.GetSemSet(0xDA7ABA5E, 4, nil); err != syscall.EINVAL {
+			t.Error("asking for more semaphores than the set has should fail", err)
+		}
+		if _, err := ns.GetSemSet(0xDA7ABA5E, 0, nil); err != nil {
+			t.Error("opening with a count of 0 should work", err)
+		}
+
+		info, err := ss.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Count != 3 || info.Perms.Mode&0777 != 0600 || !info.LastOp.IsZero() {
+			t.Error("wrong stats", info.Count, info.Perms.Mode, info.LastOp)
+		}
+	})
+}
+
+func TestConformSemValues(t *testing.T) {
+	conform(t, func(t *testing.T, ns Namespace) {
+		ss := conformSemSet(t, ns)
+		defer ss.Remove()
+
+		if err := ss.Setall([]uint16{1, 2, 3}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ss.Setval(1, 5); err != nil {
+			t.Fatal(err)
+		}
+		vals, err := ss.Getall()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vals[0] != 1 || vals[1] != 5 || vals[2] != 3 {
+			t.Error("wrong values", vals)
+		}
+
+		if err := ss.Setval(0, 40000); err != syscall.ERANGE {
+			t.Error("value over semvmx should give ERANGE", err)
+		}
+		if _, err := ss.Getval(3); err != syscall.EINVAL {
+			t.Error("out-of-range num should give EINVAL", err)
+		}
+
+		ops := NewSemOps()
+		ops.Increment(2, 32767, nil)
+		if err := ss.Run(ops, -1); err != syscall.ERANGE {
+			t.Error("going over semvmx should give ERANGE", err)
+		}
+		ops = NewSemOps()
+		ops.Increment(3, 1, nil)
+		if err := ss.Run(ops, -1); err != syscall.EFBIG {
+			t.Error("out-of-range num should give EFBIG", err)
+		}
+	})
+}
+
+func TestConformSemAtomic(t *testing.T) {
+	conform(t, func(t *testing.T, ns Namespace) {
+		ss := conformSemSet(t, ns)
+		defer ss.Remove()
+
+		// the increment must not happen, since the decrement can't
+		ops := NewSemOps()
+		ops.Increment(0, 1, nil)
+		ops.Decrement(1, 1, &SemOpFlags{DontWait: true})
+		if err := ss.Run(ops, -1); err != syscall.EAGAIN {
+			t.Error("expected EAGAIN", err)
+		}
+		if v, _ := ss.Getval(0); v != 0 {
+			t.Error("partial application of an op group", v)
+		}
+
+		start := time.Now()
+		ops = NewSemOps()
+		ops.Decrement(1, 1, nil)
+		if err := ss.Run(ops, 20*time.Millisecond); err != syscall.EAGAIN {
+			t.Error("timed out op should give EAGAIN", err)
+		}
+		if time.Since(start) < 20*time.Millisecond {
+			t.Error("returned before the timeout")
+		}
+
+		ops = NewSemOps()
+		ops.Increment(0, 2, nil)
+		ops.Increment(1, 1, nil)
+		if err := ss.Run(ops, 0); err != nil {
+			t.Fatal(err)
+		}
+		if vals, _ := ss.Getall(); vals[0] != 2 || vals[1] != 1 {
+			t.Error("wrong values", vals)
+		}
+		if info, _ := ss.Stat(); info.LastOp.IsZero() {
+			t.Error("semop time not set")
+		}
+	})
+}
+
+func TestConformSemBlocking(t *testing.T) {
+	conform(t, func(t *testing.T, ns Namespace) {
+		ss := conformSemSet(t, ns)
+
+		errs := make(chan error, 2)
+		go func() {
+			ops := NewSemOps()
+			ops.Decrement(0, 2, nil)
+			errs <- ss.Run(ops, -1)
+		}()
+		go func() {
+			if err := ss.Setval(1, 1); err != nil {
+				errs <- err
+				return
+			}
+			ops := NewSemOps()
+			ops.WaitZero(1, nil)
+			errs <- ss.Run(ops, -1)
+		}()
+
+		eventually(t, "waiters", func() bool {
+			n, _ := ss.GetNCnt(0)
+			z, _ := ss.GetZCnt(1)
+			return n == 1 && z == 1
+		})
+
+		ops := NewSemOps()
+		ops.Increment(0, 2, nil)
+		if err := ss.Run(ops, -1); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Error("blocked decrement should succeed", err)
+		}
+		if n, _ := ss.GetNCnt(0); n != 0 {
+			t.Error("waiter still counted", n)
+		}
+
+		if err := ss.Remove(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != syscall.EIDRM {
+			t.Error("blocked wait-for-zero should get EIDRM", err)
+		}
+		if _, err := ss.Getval(0); err != syscall.EINVAL {
+			t.Error("removed set should give EINVAL", err)
+		}
+	})
+}
+
+func conformSegment(t *testing.T, ns Namespace) Segment {
+	seg, err := ns.GetSharedMem(0xDA7ABA5E, 4096, &SHMFlags{Create: true, Exclusive: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seg
+}
+
+func TestConformSegment(t *testing.T) {
+	conform(t, func(t *testing.T, ns Namespace) {
+		seg := conformSegment(t, ns)
+
+		if _, err := ns.GetSharedMem(0xDA7ABA5E, 8192, nil); err != syscall.EINVAL {
+			t.Error("asking for more than the segment's size should fail", err)
+		}
+
+		m1, err := seg.Attach(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m2, err := seg.Attach(&SHMAttachFlags{ReadOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := m1.Write([]byte("shared")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 6)
+		if _, err := m2.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, []byte("shared")) {
+			t.Errorf("second attachment read %q", buf)
+		}
+		if _, err := m2.Write(buf); err != ErrReadOnlyShm {
+			t.Error("read-only attachment shouldn't write", err)
+		}
+
+		info, err := seg.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.CurrentAttaches != 2 || info.SegmentSize != 4096 || info.Destroying {
+			t.Error("wrong stats", info.CurrentAttaches, info.SegmentSize, info.Destroying)
+		}
+
+		if err := seg.Remove(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ns.GetSharedMem(0xDA7ABA5E, 0, nil); err != syscall.ENOENT {
+			t.Error("removed segment's key should be gone", err)
+		}
+		if info, err = seg.Stat(); err != nil {
+			t.Fatal("segment should live until detached", err)
+		}
+		if !info.Destroying || info.Perms.Key != 0 {
+			t.Error("wrong stats after removal", info.Destroying, info.Perms.Key)
+		}
+
+		if err := m2.Close(); err != nil {
+			t.Fatal(err)
+		}
+		m1.Seek(0, 0)
+		if _, err := m1.Read(buf); err != nil || string(buf) != "shared" {
+			t.Error("remaining attachment lost the contents", err)
+		}
+		if err := m1.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := seg.Stat(); err != syscall.EINVAL {
+			t.Error("segment should be gone after the last detach", err)
+		}
+	})
+}
+
+// Fake segments attach as ordinary mounts, so the shared memory primitives
+// work on them.
+func TestFakeSegmentMutex(t *testing.T) {
+	seg, err := NewFake().GetSharedMem(0, 4096, &SHMFlags{Create: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Remove()
+	mnt, err := seg.Attach(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.Close()
+
+	mu, err := NewMutex(mnt, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mu.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := mu.TryLock(); ok {
+		t.Error("locked twice")
+	}
+	if err := mu.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,701 @@
+package sysvipc_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/teepark/go-sysvipc"
+	"github.com/teepark/go-sysvipc/ipctest"
+)
+
+// These tests check behaviour that only shows up between processes: pids
+// recorded by the kernel, SEM_UNDO, and what happens when a process dies
+// holding something. Each runs its other side as an ipctest worker.
+
+func TestMain(m *testing.M) {
+	ipctest.Main(m)
+}
+
+func init() {
+	ipctest.RegisterRole("sem-op", semOpRole)
+	ipctest.RegisterRole("msg-send", msgSendRole)
+	ipctest.RegisterRole("msg-recv", msgRecvRole)
+	ipctest.RegisterRole("shm-write", shmWriteRole)
+	ipctest.RegisterRole("mutex-lock", mutexLockRole)
+	ipctest.RegisterRole("sem-pong", semPongRole)
+	ipctest.RegisterRole("msg-echo", msgEchoRole)
+	ipctest.RegisterRole("metrics-count", metricsCountRole)
+	ipctest.RegisterRole("header-claim", headerClaimRole)
+}
+
+// holding is the last argument of a role that should block until it's
+// killed once it's done its work.
+const holding = "hold"
+
+func hold(w *ipctest.Worker) {
+	if args := w.Args(); args[len(args)-1] == holding {
+		select {}
+	}
+}
+
+// semOpRole runs one operation on semaphore 0: args are the set's handle,
+// the amount (negative to decrement, 0 to wait for zero), and optionally
+// "undo".
+func semOpRole(w *ipctest.Worker) error {
+	h, err := w.Handle(0)
+	if err != nil {
+		return err
+	}
+	ss, err := h.SemSet()
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(w.Args()[1])
+	if err != nil {
+		return err
+	}
+	flags := &sysvipc.SemOpFlags{Undo: len(w.Args()) > 2 && w.Args()[2] == "undo"}
+
+	ops := sysvipc.NewSemOps()
+	switch {
+	case n > 0:
+		err = ops.Increment(0, int16(n), flags)
+	case n < 0:
+		err = ops.Decrement(0, int16(-n), flags)
+	default:
+		err = ops.WaitZero(0, flags)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.Signal("ready")
+	w.SetErr("err", ss.Run(ops, -1))
+	w.Signal("done")
+	hold(w)
+	return nil
+}
+
+// msgSendRole sends args[2] with type args[1] to the queue args[0].
+func msgSendRole(w *ipctest.Worker) error {
+	h, err := w.Handle(0)
+	if err != nil {
+		return err
+	}
+	q, err := h.MsgQueue()
+	if err != nil {
+		return err
+	}
+	mtyp, err := strconv.ParseInt(w.Args()[1], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	w.Signal("ready")
+	w.SetErr("err", q.Send(mtyp, []byte(w.Args()[2]), nil))
+	w.Signal("done")
+	return nil
+}
+
+// msgRecvRole receives a message of type args[1] from the queue args[0].
+func msgRecvRole(w *ipctest.Worker) error {
+	h, err := w.Handle(0)
+	if err != nil {
+		return err
+	}
+	q, err := h.MsgQueue()
+	if err != nil {
+		return err
+	}
+	mtyp, err := strconv.ParseInt(w.Args()[1], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	w.Signal("ready")
+	body, mtyp, err := q.Receive(1024, mtyp, nil)
+	w.SetErr("err", err)
+	w.Set("body", string(body))
+	w.Set("mtyp", mtyp)
+	w.Signal("done")
+	return nil
+}
+
+// shmWriteRole attaches segment args[0] and writes args[1] at the start.
+func shmWriteRole(w *ipctest.Worker) error {
+	h, err := w.Handle(0)
+	if err != nil {
+		return err
+	}
+	shm, err := h.SharedMem()
+	if err != nil {
+		return err
+	}
+	mnt, err := shm.Attach(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := mnt.Write([]byte(w.Args()[1])); err != nil {
+		return err
+	}
+	w.Signal("attached")
+	hold(w)
+	return mnt.Close()
+}
+
+// mutexLockRole locks the robust mutex at the start of segment args[0].
+func mutexLockRole(w *ipctest.Worker) error {
+	h, err := w.Handle(0)
+	if err != nil {
+		return err
+	}
+	shm, err := h.SharedMem()
+	if err != nil {
+		return err
+	}
+	mnt, err := shm.Attach(nil)
+	if err != nil {
+		return err
+	}
+	m, err := sysvipc.NewRobustMutex(mnt, 0)
+	if err != nil {
+		return err
+	}
+	if err := m.Lock(); err != nil {
+		return err
+	}
+	w.Signal("locked")
+	hold(w)
+	return m.Unlock()
+}
+
+// metricsCountRole adds 10 to a counter and sets a gauge to 1 in the
+// metrics table in segment args[0].
+func metricsCountRole(w *ipctest.Worker) error {
+	h, err := w.Handle(0)
+	if err != nil {
+		return err
+	}
+	shm, err := h.SharedMem()
+	if err != nil {
+		return err
+	}
+	mnt, err := shm.Attach(nil)
+	if err != nil {
+		return err
+	}
+	m, err := sysvipc.NewMetrics(mnt, nil)
+	if err != nil {
+		return err
+	}
+	c, err := m.Counter("work_total", "")
+	if err != nil {
+		return err
+	}
+	g, err := m.Gauge("workers", "")
+	if err != nil {
+		return err
+	}
+	c.Add(10)
+	g.Set(1)
+
+	w.Signal("counted")
+	hold(w)
+	return m.Close()
+}
+
+// waitFor polls cond until it holds, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCrossSemGetpid(t *testing.T) {
+	ipctest.CheckLeaks(t)
+	ss := ipctest.SemSet(t, 1, nil)
+
+	w := ipctest.NewHarness(t).Spawn("sem-op", ss.Handle().String(), "2")
+	if err := w.Wait().Errno("err"); err != nil {
+		t.Fatal(err)
+	}
+
+	if pid, err := ss.Getpid(0); err != nil || pid != w.PID() {
+		t.Errorf("Getpid: %d, %v (worker %d)", pid, err, w.PID())
+	}
+	if val, _ := ss.Getval(0); val != 2 {
+		t.Errorf("value %d after the worker's increment", val)
+	}
+}
+
+func TestCrossSemBlocking(t *testing.T) {
+	ipctest.CheckLeaks(t)
+	ss := ipctest.SemSet(t, 1, nil)
+	h := ipctest.NewHarness(t)
+	ss.Setval(0, 1)
+
+	zero := h.Spawn("sem-op", ss.Handle().String(), "0")
+	waitFor(t, "the zero wait to block", func() bool {
+		n, _ := ss.GetZCnt(0)
+		return n == 1
+	})
+	dec := h.Spawn("sem-op", ss.Handle().String(), "-2")
+	waitFor(t, "the decrement to block", func() bool {
+		n, _ := ss.GetNCnt(0)
+		return n == 1
+	})
+
+	// lets the decrement through, which then lets the zero wait through
+	ops := sysvipc.NewSemOps()
+	ops.Increment(0, 1, nil)
+	if err := ss.Run(ops, -1); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []*ipctest.Proc{dec, zero} {
+		if err := w.Wait().Errno("err"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if pid, _ := ss.Getpid(0); pid != zero.PID() {
+		t.Errorf("Getpid %d, want the last worker %d", pid, zero.PID())
+	}
+	if val, _ := ss.Getval(0); val != 0 {
+		t.Errorf("value %d", val)
+	}
+}
+
+func TestCrossSemUndo(t *testing.T) {
+	ipctest.CheckLeaks(t)
+	h := ipctest.NewHarness(t)
+
+	for _, undo := range []bool{true, false} {
+		ss := ipctest.SemSet(t, 1, nil)
+		ss.Setval(0, 1)
+
+		args := []string{ss.Handle().String(), "-1", "", holding}
+		if undo {
+			args[2] = "undo"
+		}
+		w := h.Spawn("sem-op", args...)
+		w.Await("done")
+		if val, _ := ss.Getval(0); val != 0 {
+			t.Fatalf("value %d while the worker holds the semaphore", val)
+		}
+
+		if res := w.Kill(); res.Signaled() != syscall.SIGKILL {
+			t.Fatal("worker wasn't killed:", res.Output)
+		}
+
+		want := 0
+		if undo {
+			want = 1
+		}
+		if val, _ := ss.Getval(0); val != want {
+			t.Errorf("undo=%v: value %d after the worker died, want %d", undo, val, want)
+		}
+	}
+}
+
+func TestCrossSemRemoved(t *testing.T) {
+	ss := ipctest.SemSet(t, 1, nil)
+	w := ipctest.NewHarness(t).Spawn("sem-op", ss.Handle().String(), "-1")
+	waitFor(t, "the decrement to block", func() bool {
+		n, _ := ss.GetNCnt(0)
+		return n == 1
+	})
+
+	if err := ss.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Wait().Errno("err"); err != syscall.EIDRM {
+		t.Errorf("blocked worker got %v, want EIDRM", err)
+	}
+}
+
+func TestCrossQueueRoundTrip(t *testing.T) {
+	ipctest.CheckLeaks(t)
+	q := ipctest.MsgQueue(t, nil)
+	h := ipctest.NewHarness(t)
+
+	recv := h.Spawn("msg-recv", q.Handle().String(), "1")
+	recv.Await("ready")
+	if err := q.Send(1, []byte("ping"), nil); err != nil {
+		t.Fatal(err)
+	}
+	res := recv.Wait()
+	var body string
+	res.Get("body", &body)
+	if err := res.Errno("err"); err != nil || body != "ping" {
+		t.Fatalf("worker received %q, %v", body, err)
+	}
+
+	send := h.Spawn("msg-send", q.Handle().String(), "2", "pong")
+	if err := send.Wait().Errno("err"); err != nil {
+		t.Fatal(err)
+	}
+	reply, mtyp, err := q.Receive(64, 0, &sysvipc.MQRecvFlags{DontWait: true})
+	if err != nil || mtyp != 2 || string(reply) != "pong" {
+		t.Fatalf("received %q (type %d), %v", reply, mtyp, err)
+	}
+
+	info, err := q.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LastSender != send.PID() {
+		t.Errorf("LastSender %d, want worker %d", info.LastSender, send.PID())
+	}
+	if info.LastRcver != os.Getpid() {
+		t.Errorf("LastRcver %d, want %d", info.LastRcver, os.Getpid())
+	}
+}
+
+func TestCrossQueueBlockedSend(t *testing.T) {
+	ipctest.CheckLeaks(t)
+	q := ipctest.MsgQueue(t, nil)
+	if err := q.SetMaxBytes(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Send(1, []byte("full"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	w := ipctest.NewHarness(t).Spawn("msg-send", q.Handle().String(), "2", "more")
+	w.Await("ready")
+	time.Sleep(20 * time.Millisecond)
+	if info, _ := q.Stat(); info.MsgCount != 1 {
+		t.Fatalf("%d messages in a full queue", info.MsgCount)
+	}
+
+	if _, _, err := q.Receive(4, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Wait().Errno("err"); err != nil {
+		t.Fatal(err)
+	}
+	if body, _, err := q.Receive(4, 2, &sysvipc.MQRecvFlags{DontWait: true}); err != nil || string(body) != "more" {
+		t.Errorf("received %q, %v", body, err)
+	}
+}
+
+func TestCrossQueueRemoved(t *testing.T) {
+	q := ipctest.MsgQueue(t, nil)
+	w := ipctest.NewHarness(t).Spawn("msg-recv", q.Handle().String(), "0")
+	w.Await("ready")
+	// there's no count of blocked receivers to wait on
+	time.Sleep(50 * time.Millisecond)
+
+	if err := q.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Wait().Errno("err"); err != syscall.EIDRM {
+		t.Errorf("blocked worker got %v, want EIDRM", err)
+	}
+}
+
+func TestCrossSegment(t *testing.T) {
+	ipctest.CheckLeaks(t)
+	shm := ipctest.SharedMem(t, 4096, nil)
+	mnt := ipctest.Attach(t, shm, nil)
+
+	w := ipctest.NewHarness(t).Spawn("shm-write", shm.Handle().String(), "written elsewhere")
+	w.Wait()
+
+	buf := make([]byte, len("written elsewhere"))
+	if _, err := mnt.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "written elsewhere" {
+		t.Errorf("read %q", buf)
+	}
+
+	info, err := shm.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LastUserPID != w.PID() || info.CurrentAttaches != 1 {
+		t.Errorf("last user %d (worker %d), %d attaches", info.LastUserPID, w.PID(), info.CurrentAttaches)
+	}
+}
+
+func TestCrossSegmentDeath(t *testing.T) {
+	ipctest.CheckLeaks(t)
+	shm := ipctest.SharedMem(t, 4096, nil)
+
+	w := ipctest.NewHarness(t).Spawn("shm-write", shm.Handle().String(), "orphaned", holding)
+	w.Await("attached")
+	if err := shm.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := shm.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Destroying || info.CurrentAttaches != 1 {
+		t.Fatalf("removed segment: destroying %v, %d attaches", info.Destroying, info.CurrentAttaches)
+	}
+
+	w.Kill()
+	// the dead worker's attachment was the last, so the segment is gone
+	if _, err := shm.Stat(); err != syscall.EINVAL && err != syscall.EIDRM {
+		t.Errorf("Stat after the last attachment died: %v", err)
+	}
+}
+
+func TestCrossMutexOwnerDead(t *testing.T) {
+	ipctest.CheckLeaks(t)
+	shm := ipctest.SharedMem(t, 4096, nil)
+	mnt := ipctest.Attach(t, shm, nil)
+	m, err := sysvipc.NewRobustMutex(mnt, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := ipctest.NewHarness(t).Spawn("mutex-lock", shm.Handle().String(), holding)
+	w.Await("locked")
+	if ok, err := m.TryLock(); ok || err != nil {
+		t.Fatalf("TryLock on a held mutex: %v, %v", ok, err)
+	}
+	if m.Owner() != w.PID() {
+		t.Errorf("owner %d, want worker %d", m.Owner(), w.PID())
+	}
+
+	w.Kill()
+	if err := m.Lock(); !errors.Is(err, sysvipc.ErrOwnerDead) {
+		t.Fatalf("Lock after the owner died: %v", err)
+	}
+	if err := m.Unlock(); err != nil {
+		t.Error(err)
+	}
+}
+
+// semPongRole answers pings on the set args[0] until it's removed: it waits
+// on semaphore 0 and posts 1.
+func semPongRole(w *ipctest.Worker) error {
+	h, err := w.Handle(0)
+	if err != nil {
+		return err
+	}
+	ss, err := h.SemSet()
+	if err != nil {
+		return err
+	}
+	pong := sysvipc.NewSemOps()
+	pong.Decrement(0, 1, nil)
+	pong.Increment(1, 1, nil)
+
+	w.Signal("ready")
+	for {
+		if err := ss.Run(pong, -1); err != nil {
+			return ignoreRemoved(err)
+		}
+	}
+}
+
+// msgEchoRole sends every message of type 1 on queue args[0] back as type
+// 2, until the queue is removed.
+func msgEchoRole(w *ipctest.Worker) error {
+	h, err := w.Handle(0)
+	if err != nil {
+		return err
+	}
+	q, err := h.MsgQueue()
+	if err != nil {
+		return err
+	}
+
+	w.Signal("ready")
+	for {
+		body, _, err := q.Receive(8192, 1, nil)
+		if err != nil {
+			return ignoreRemoved(err)
+		}
+		if err := q.Send(2, body, nil); err != nil {
+			return ignoreRemoved(err)
+		}
+	}
+}
+
+func ignoreRemoved(err error) error {
+	if err == syscall.EIDRM || err == syscall.EINVAL {
+		return nil
+	}
+	return err
+}
+
+// BenchmarkCrossSemPingPong measures a round trip to another process and
+// back through a pair of semaphores.
+func BenchmarkCrossSemPingPong(b *testing.B) {
+	ss, err := sysvipc.GetSemSet(0, 2, &sysvipc.SemSetFlags{Create: true, Perms: 0600})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ss.Remove()
+	ipctest.NewHarness(b).Spawn("sem-pong", ss.Handle().String()).Await("ready")
+
+	post, wait := sysvipc.NewSemOps(), sysvipc.NewSemOps()
+	post.Increment(0, 1, nil)
+	wait.Decrement(1, 1, nil)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := ss.Run(post, -1); err != nil {
+			b.Fatal(err)
+		}
+		if err := ss.Run(wait, -1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCrossMsgPingPong measures a message's round trip to another
+// process and back.
+func BenchmarkCrossMsgPingPong(b *testing.B) {
+	for _, size := range []int{16, 256, 2048, 8192} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			q, err := sysvipc.GetMsgQueue(0, &sysvipc.MQFlags{Create: true, Perms: 0600})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer q.Remove()
+			ipctest.NewHarness(b).Spawn("msg-echo", q.Handle().String()).Await("ready")
+
+			body := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := q.Send(1, body, nil); err != nil {
+					b.Fatal(err)
+				}
+				if _, _, err := q.Receive(uint(size), 2, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// headerClaimRole does the first step of setting up a shared table's header,
+// claiming it by storing a nonzero config word at the offset given after the
+// segment's handle, and then stops there.
+func headerClaimRole(w *ipctest.Worker) error {
+	h, err := w.Handle(0)
+	if err != nil {
+		return err
+	}
+	shm, err := h.SharedMem()
+	if err != nil {
+		return err
+	}
+	mnt, err := shm.Attach(nil)
+	if err != nil {
+		return err
+	}
+	offset, err := strconv.ParseInt(w.Args()[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	if _, err := mnt.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := mnt.Write([]byte{1, 0, 0, 0}); err != nil {
+		return err
+	}
+	w.Signal("claimed")
+	hold(w)
+	return mnt.Close()
+}
+
+func TestCrossTableSetupDeath(t *testing.T) {
+	ipctest.CheckLeaks(t)
+	mq := ipctest.MsgQueue(t, nil)
+
+	for _, tc := range []struct {
+		name   string
+		offset string // of the word setupHeader claims
+		open   func(*sysvipc.SharedMemMount) error
+	}{
+		{"workqueue", "4", func(mnt *sysvipc.SharedMemMount) error {
+			_, err := sysvipc.NewWorkQueue(mq, mnt, nil)
+			return err
+		}},
+		{"metrics", "8", func(mnt *sysvipc.SharedMemMount) error {
+			_, err := sysvipc.NewMetrics(mnt, nil)
+			return err
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			size := max(sysvipc.WorkQueueTableSize(nil), sysvipc.MetricsTableSize(nil))
+			shm := ipctest.SharedMem(t, uint64(size), nil)
+			w := ipctest.NewHarness(t).Spawn("header-claim", shm.Handle().String(), tc.offset, holding)
+			w.Await("claimed")
+			w.Kill()
+
+			mnt := ipctest.Attach(t, shm, nil)
+			done := make(chan error, 1)
+			go func() { done <- tc.open(mnt) }()
+			select {
+			case err := <-done:
+				if err != sysvipc.ErrTableSetup {
+					t.Error("opening a half set up table should fail", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("opening a half set up table hung")
+			}
+		})
+	}
+}
+
+func TestCrossMetrics(t *testing.T) {
+	ipctest.CheckLeaks(t)
+	shm := ipctest.SharedMem(t, uint64(sysvipc.MetricsTableSize(nil)), nil)
+	mnt := ipctest.Attach(t, shm, nil)
+	m, err := sysvipc.NewMetrics(mnt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	totals := func() map[string]float64 {
+		values, err := m.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		totals := make(map[string]float64)
+		for _, v := range values {
+			totals[v.Name] = v.Value
+		}
+		return totals
+	}
+
+	h := ipctest.NewHarness(t)
+	a := h.Spawn("metrics-count", shm.Handle().String(), holding)
+	b := h.Spawn("metrics-count", shm.Handle().String(), holding)
+	a.Await("counted")
+	b.Await("counted")
+	if got := totals(); got["work_total"] != 20 || got["workers"] != 2 {
+		t.Errorf("with both workers running: %v", got)
+	}
+
+	a.Kill()
+	if got := totals(); got["work_total"] != 20 || got["workers"] != 1 {
+		t.Errorf("after one was killed: %v", got)
+	}
+
+	// a new worker takes over the dead one's slot
+	c := h.Spawn("metrics-count", shm.Handle().String())
+	c.Wait()
+	if got := totals(); got["work_total"] != 30 || got["workers"] != 1 {
+		t.Errorf("after another came and went: %v", got)
+	}
+}
@@ -0,0 +1,811 @@
+package sysvipc
+
+import (
+	"errors"
+	"math"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// kernel defaults the Fake copies
+const (
+	fakeMsgMax = DefaultMsgMax
+	fakeMsgMnb = 16384 // msgmnb
+	fakeSemMsl = 32000 // semmsl
+	fakeSemVmx = 32767 // semvmx
+)
+
+// Fake is an in-process Namespace that behaves like the kernel's, for unit
+// testing code written against Queue, SemSet and Segment without real IPC
+// objects.
+//
+// It follows the kernel's rules for keys (IPC_PRIVATE, Create, Exclusive),
+// message selection by msgtyp, atomic semaphore operation groups, timeouts
+// and blocking, and it fails with the same errors: EAGAIN, ENOMSG, E2BIG,
+// EIDRM for an object removed while blocked on, EINVAL for one already
+// removed, and so on. It doesn't check permissions, and its objects are
+// only visible within the process (so SemOpFlags.Undo has no effect).
+type Fake struct {
+	mu     sync.Mutex
+	queues map[int64]*fakeQueue
+	sems   map[int64]*fakeSemSet
+	segs   map[int64]*fakeSegment
+}
+
+// NewFake creates an empty Fake.
+func NewFake() *Fake {
+	return &Fake{
+		queues: make(map[int64]*fakeQueue),
+		sems:   make(map[int64]*fakeSemSet),
+		segs:   make(map[int64]*fakeSegment),
+	}
+}
+
+// wait releases the lock until ch is closed (returning true) or timer fires.
+func (f *Fake) wait(ch <-chan struct{}, timer <-chan time.Time) bool {
+	f.mu.Unlock()
+	defer f.mu.Lock()
+	select {
+	case <-ch:
+		return true
+	case <-timer:
+		return false
+	}
+}
+
+// fakeLookup applies the kernel's rules for finding an object by key. It
+// returns nil and no error if a new object should be created.
+func fakeLookup[T any](objs map[int64]*T, key int64, create, excl bool) (*T, error) {
+	if key == 0 {
+		// IPC_PRIVATE always makes a new one
+		return nil, nil
+	}
+	if obj, ok := objs[key]; ok {
+		if create && excl {
+			return nil, syscall.EEXIST
+		}
+		return obj, nil
+	}
+	if !create {
+		return nil, syscall.ENOENT
+	}
+	return nil, nil
+}
+
+// fakeNow returns the time with the second resolution the kernel keeps.
+func fakeNow() time.Time {
+	return time.Unix(time.Now().Unix(), 0)
+}
+
+// fakeBase is what every fake object has in common.
+type fakeBase struct {
+	ns      *Fake
+	key     int64
+	perms   IpcPerms
+	ctime   time.Time
+	removed bool
+
+	// closed and replaced whenever something a waiter might want changes
+	changed chan struct{}
+}
+
+func (f *Fake) newBase(key int64, perms int) fakeBase {
+	uid, gid := os.Geteuid(), os.Getegid()
+	return fakeBase{
+		ns:  f,
+		key: key,
+		perms: IpcPerms{
+			OwnerUID:   uid,
+			OwnerGID:   gid,
+			CreatorUID: uid,
+			CreatorGID: gid,
+			Mode:       uint16(perms & 0777),
+			Key:        key,
+		},
+		ctime:   fakeNow(),
+		changed: make(chan struct{}),
+	}
+}
+
+func (b *fakeBase) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *fakeBase) setPerms(p IpcPerms) {
+	b.perms.OwnerUID = p.OwnerUID
+	b.perms.OwnerGID = p.OwnerGID
+	b.perms.Mode = p.Mode & 0777
+	b.ctime = fakeNow()
+}
+
+// gone is the error for an object removed either before the call (EINVAL,
+// as its id no longer exists) or while the call was blocked on it (EIDRM).
+func gone(waited bool) error {
+	if waited {
+		return syscall.EIDRM
+	}
+	return syscall.EINVAL
+}
+
+// GetMsgQueue creates or retrieves a fake message queue, as the
+// package-level GetMsgQueue does.
+func (f *Fake) GetMsgQueue(key int64, flags *MQFlags) (Queue, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var create, excl bool
+	var perms int
+	if flags != nil {
+		create, excl, perms = flags.Create, flags.Exclusive, flags.Perms
+	}
+	q, err := fakeLookup(f.queues, key, create, excl)
+	if err != nil {
+		return nil, err
+	}
+	if q != nil {
+		return q, nil
+	}
+
+	q = &fakeQueue{fakeBase: f.newBase(key, perms), qbytes: fakeMsgMnb}
+	if key != 0 {
+		f.queues[key] = q
+	}
+	return q, nil
+}
+
+type fakeQueue struct {
+	fakeBase
+	msgs         []Message
+	cbytes       uint
+	qbytes       uint
+	stime, rtime time.Time
+	lspid, lrpid int
+}
+
+func (q *fakeQueue) Send(mtyp int64, body []byte, flags *MQSendFlags) error {
+	if mtyp < 1 || len(body) > fakeMsgMax {
+		return syscall.EINVAL
+	}
+
+	q.ns.mu.Lock()
+	defer q.ns.mu.Unlock()
+
+	size := uint(len(body))
+	for waited := false; ; waited = true {
+		if q.removed {
+			return gone(waited)
+		}
+		if q.cbytes+size <= q.qbytes && uint(len(q.msgs))+1 <= q.qbytes {
+			break
+		}
+		if flags != nil && flags.DontWait {
+			return syscall.EAGAIN
+		}
+		q.ns.wait(q.changed, nil)
+	}
+
+	q.msgs = append(q.msgs, Message{mtyp, append([]byte{}, body...)})
+	q.cbytes += size
+	q.stime, q.lspid = fakeNow(), os.Getpid()
+	q.notify()
+	return nil
+}
+
+func (q *fakeQueue) Receive(maxlen uint, msgtyp int64, flags *MQRecvFlags) ([]byte, int64, error) {
+	if maxlen > math.MaxInt32 {
+		return nil, 0, syscall.EINVAL
+	}
+
+	q.ns.mu.Lock()
+	defer q.ns.mu.Unlock()
+
+	for waited := false; ; waited = true {
+		if q.removed {
+			return nil, 0, gone(waited)
+		}
+
+		if i := q.find(msgtyp); i >= 0 {
+			msg := q.msgs[i]
+			body := msg.Body
+			if uint(len(body)) > maxlen {
+				if flags == nil || !flags.Truncate {
+					return nil, 0, syscall.E2BIG
+				}
+				body = body[:maxlen]
+			}
+
+			q.msgs = append(q.msgs[:i], q.msgs[i+1:]...)
+			q.cbytes -= uint(len(msg.Body))
+			q.rtime, q.lrpid = fakeNow(), os.Getpid()
+			q.notify()
+			return body, msg.Type, nil
+		}
+
+		if flags != nil && flags.DontWait {
+			return nil, 0, syscall.ENOMSG
+		}
+		q.ns.wait(q.changed, nil)
+	}
+}
+
+// find picks a message as msgrcv does: the first one for msgtyp 0, the
+// first of type msgtyp if it's positive, and otherwise the first of the
+// lowest type no greater than -msgtyp.
+func (q *fakeQueue) find(msgtyp int64) int {
+	limit := -msgtyp
+	if msgtyp == math.MinInt64 {
+		// as in the kernel, which can't negate it either
+		limit = math.MaxInt64
+	}
+
+	found := -1
+	for i, msg := range q.msgs {
+		switch {
+		case msgtyp == 0:
+			return i
+		case msgtyp > 0:
+			if msg.Type == msgtyp {
+				return i
+			}
+		default:
+			if msg.Type <= limit && (found < 0 || msg.Type < q.msgs[found].Type) {
+				found = i
+			}
+		}
+	}
+	return found
+}
+
+func (q *fakeQueue) Stat() (*MQInfo, error) {
+	q.ns.mu.Lock()
+	defer q.ns.mu.Unlock()
+
+	if q.removed {
+		return nil, syscall.EINVAL
+	}
+	return &MQInfo{
+		Perms:        q.perms,
+		LastSend:     q.stime,
+		LastRcv:      q.rtime,
+		LastChange:   q.ctime,
+		MsgCount:     uint(len(q.msgs)),
+		MaxBytes:     q.qbytes,
+		CurrentBytes: q.cbytes,
+		LastSender:   q.lspid,
+		LastRcver:    q.lrpid,
+	}, nil
+}
+
+func (q *fakeQueue) Set(mqi *MQInfo) error {
+	q.ns.mu.Lock()
+	defer q.ns.mu.Unlock()
+
+	if q.removed {
+		return syscall.EINVAL
+	}
+	q.setPerms(mqi.Perms)
+	q.qbytes = mqi.MaxBytes
+	q.notify()
+	return nil
+}
+
+func (q *fakeQueue) Update(fn func(*MQInfo)) error {
+	mqi, err := q.Stat()
+	if err != nil {
+		return err
+	}
+	fn(mqi)
+	return q.Set(mqi)
+}
+
+func (q *fakeQueue) Chmod(perms int) error {
+	return q.Update(func(mqi *MQInfo) { mqi.Perms.Mode = uint16(perms) })
+}
+
+func (q *fakeQueue) Chown(uid, gid int) error {
+	return q.Update(func(mqi *MQInfo) { chown(&mqi.Perms, uid, gid) })
+}
+
+func (q *fakeQueue) SetMaxBytes(n uint) error {
+	return q.Update(func(mqi *MQInfo) { mqi.MaxBytes = n })
+}
+
+func (q *fakeQueue) Remove() error {
+	q.ns.mu.Lock()
+	defer q.ns.mu.Unlock()
+
+	if q.removed {
+		return syscall.EINVAL
+	}
+	q.removed = true
+	if q.key != 0 {
+		delete(q.ns.queues, q.key)
+	}
+	q.notify()
+	return nil
+}
+
+// GetSemSet creates or retrieves a fake semaphore set, as the package-level
+// GetSemSet does.
+func (f *Fake) GetSemSet(key, count int64, flags *SemSetFlags) (SemSet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if count < 0 || count > fakeSemMsl {
+		return nil, syscall.EINVAL
+	}
+
+	var create, excl bool
+	var perms int
+	if flags != nil {
+		create, excl, perms = flags.Create, flags.Exclusive, flags.Perms
+	}
+	ss, err := fakeLookup(f.sems, key, create, excl)
+	if err != nil {
+		return nil, err
+	}
+	if ss != nil {
+		if count > int64(len(ss.vals)) {
+			return nil, syscall.EINVAL
+		}
+		return ss, nil
+	}
+	if count == 0 {
+		return nil, syscall.EINVAL
+	}
+
+	ss = &fakeSemSet{
+		fakeBase: f.newBase(key, perms),
+		vals:     make([]int, count),
+		pids:     make([]int, count),
+		ncnt:     make([]int, count),
+		zcnt:     make([]int, count),
+	}
+	if key != 0 {
+		f.sems[key] = ss
+	}
+	return ss, nil
+}
+
+type fakeSemSet struct {
+	fakeBase
+	vals       []int
+	pids       []int
+	ncnt, zcnt []int
+	otime      time.Time
+}
+
+func (ss *fakeSemSet) Run(ops *SemOps, timeout time.Duration) error {
+	list := ops.list()
+	if len(list) == 0 {
+		return syscall.EINVAL
+	}
+
+	ss.ns.mu.Lock()
+	defer ss.ns.mu.Unlock()
+
+	if ss.removed {
+		return syscall.EINVAL
+	}
+	for _, op := range list {
+		if int(op.num) >= len(ss.vals) {
+			return syscall.EFBIG
+		}
+	}
+
+	var timer <-chan time.Time
+	if timeout >= 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	for {
+		blocked, err := ss.try(list)
+		if err != nil || blocked < 0 {
+			return err
+		}
+
+		op := list[blocked]
+		if op.dontWait {
+			return syscall.EAGAIN
+		}
+		count := &ss.ncnt[op.num]
+		if op.op == 0 {
+			count = &ss.zcnt[op.num]
+		}
+
+		*count++
+		woken := ss.ns.wait(ss.changed, timer)
+		*count--
+
+		if ss.removed {
+			return syscall.EIDRM
+		}
+		if !woken {
+			return syscall.EAGAIN
+		}
+	}
+}
+
+// try applies all of ops if it can, or returns the index of the first one
+// that would block.
+func (ss *fakeSemSet) try(ops []semOp) (int, error) {
+	vals := append([]int(nil), ss.vals...)
+	for i, op := range ops {
+		v := vals[op.num]
+		switch {
+		case op.op > 0:
+			if v += int(op.op); v > fakeSemVmx {
+				return -1, syscall.ERANGE
+			}
+		case op.op == 0:
+			if v != 0 {
+				return i, nil
+			}
+		default:
+			if v < -int(op.op) {
+				return i, nil
+			}
+			v += int(op.op)
+		}
+		vals[op.num] = v
+	}
+
+	copy(ss.vals, vals)
+	pid := os.Getpid()
+	for _, op := range ops {
+		ss.pids[op.num] = pid
+	}
+	ss.otime = fakeNow()
+	ss.notify()
+	return -1, nil
+}
+
+// semctl runs fn under the lock, after the checks every per-semaphore call
+// makes.
+func (ss *fakeSemSet) semctl(num uint16, fn func() (int, error)) (int, error) {
+	ss.ns.mu.Lock()
+	defer ss.ns.mu.Unlock()
+
+	if ss.removed || int(num) >= len(ss.vals) {
+		return 0, syscall.EINVAL
+	}
+	return fn()
+}
+
+func (ss *fakeSemSet) Getval(num uint16) (int, error) {
+	return ss.semctl(num, func() (int, error) { return ss.vals[num], nil })
+}
+
+func (ss *fakeSemSet) Setval(num uint16, value int) error {
+	_, err := ss.semctl(num, func() (int, error) {
+		if value < 0 || value > fakeSemVmx {
+			return 0, syscall.ERANGE
+		}
+		ss.vals[num] = value
+		ss.pids[num] = os.Getpid()
+		ss.ctime = fakeNow()
+		ss.notify()
+		return 0, nil
+	})
+	return err
+}
+
+func (ss *fakeSemSet) Getpid(num uint16) (int, error) {
+	return ss.semctl(num, func() (int, error) { return ss.pids[num], nil })
+}
+
+func (ss *fakeSemSet) GetNCnt(num uint16) (int, error) {
+	return ss.semctl(num, func() (int, error) { return ss.ncnt[num], nil })
+}
+
+func (ss *fakeSemSet) GetZCnt(num uint16) (int, error) {
+	return ss.semctl(num, func() (int, error) { return ss.zcnt[num], nil })
+}
+
+func (ss *fakeSemSet) Getall() ([]uint16, error) {
+	ss.ns.mu.Lock()
+	defer ss.ns.mu.Unlock()
+
+	if ss.removed {
+		return nil, syscall.EINVAL
+	}
+	vals := make([]uint16, len(ss.vals))
+	for i, v := range ss.vals {
+		vals[i] = uint16(v)
+	}
+	return vals, nil
+}
+
+func (ss *fakeSemSet) Setall(values []uint16) error {
+	ss.ns.mu.Lock()
+	defer ss.ns.mu.Unlock()
+
+	if len(values) != len(ss.vals) {
+		return errors.New("sysvipc: wrong number of values for Setall")
+	}
+	if ss.removed {
+		return syscall.EINVAL
+	}
+	for _, v := range values {
+		if v > fakeSemVmx {
+			return syscall.ERANGE
+		}
+	}
+
+	pid := os.Getpid()
+	for i, v := range values {
+		ss.vals[i] = int(v)
+		ss.pids[i] = pid
+	}
+	ss.ctime = fakeNow()
+	ss.notify()
+	return nil
+}
+
+func (ss *fakeSemSet) Stat() (*SemSetInfo, error) {
+	ss.ns.mu.Lock()
+	defer ss.ns.mu.Unlock()
+
+	if ss.removed {
+		return nil, syscall.EINVAL
+	}
+	return &SemSetInfo{
+		Perms:      ss.perms,
+		LastOp:     ss.otime,
+		LastChange: ss.ctime,
+		Count:      uint(len(ss.vals)),
+	}, nil
+}
+
+func (ss *fakeSemSet) Set(ssi *SemSetInfo) error {
+	ss.ns.mu.Lock()
+	defer ss.ns.mu.Unlock()
+
+	if ss.removed {
+		return syscall.EINVAL
+	}
+	ss.setPerms(ssi.Perms)
+	return nil
+}
+
+func (ss *fakeSemSet) Update(fn func(*SemSetInfo)) error {
+	ssi, err := ss.Stat()
+	if err != nil {
+		return err
+	}
+	fn(ssi)
+	return ss.Set(ssi)
+}
+
+func (ss *fakeSemSet) Chmod(perms int) error {
+	return ss.Update(func(ssi *SemSetInfo) { ssi.Perms.Mode = uint16(perms) })
+}
+
+func (ss *fakeSemSet) Chown(uid, gid int) error {
+	return ss.Update(func(ssi *SemSetInfo) { chown(&ssi.Perms, uid, gid) })
+}
+
+func (ss *fakeSemSet) Remove() error {
+	ss.ns.mu.Lock()
+	defer ss.ns.mu.Unlock()
+
+	if ss.removed {
+		return syscall.EINVAL
+	}
+	ss.removed = true
+	if ss.key != 0 {
+		delete(ss.ns.sems, ss.key)
+	}
+	ss.notify()
+	return nil
+}
+
+// GetSharedMem creates or retrieves a fake shared memory segment, as the
+// package-level GetSharedMem does. The Fake has no huge pages, so HugeTLB
+// fails with ENOMEM unless HugeTLBFallback is set.
+func (f *Fake) GetSharedMem(key int64, size uint64, flags *SHMFlags) (Segment, error) {
+	if err := flags.validate(); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var create, excl bool
+	var perms int
+	if flags != nil {
+		create, excl, perms = flags.Create, flags.Exclusive, flags.Perms
+	}
+	seg, err := fakeLookup(f.segs, key, create, excl)
+	if err != nil {
+		return nil, err
+	}
+	if seg != nil {
+		if size > uint64(seg.size) {
+			return nil, syscall.EINVAL
+		}
+		return seg, nil
+	}
+	if size == 0 {
+		return nil, syscall.EINVAL
+	}
+	if flags != nil && flags.HugeTLB && !flags.fallback() {
+		return nil, syscall.ENOMEM
+	}
+
+	// anonymous shared memory stays put and is never touched by the
+	// garbage collector, like a real attachment
+	page := uint64(os.Getpagesize())
+	mem, err := syscall.Mmap(-1, 0, int((size+page-1)/page*page),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_ANON)
+	if err != nil {
+		return nil, err
+	}
+
+	seg = &fakeSegment{
+		fakeBase: f.newBase(key, perms),
+		mem:      mem,
+		size:     uint(size),
+		cpid:     os.Getpid(),
+	}
+	if key != 0 {
+		f.segs[key] = seg
+	}
+	return seg, nil
+}
+
+type fakeSegment struct {
+	fakeBase
+	mem          []byte
+	size         uint
+	atime, dtime time.Time
+	cpid, lpid   int
+	nattch       uint
+	locked       bool
+
+	// removed (in fakeBase) is only set once the memory is freed, after the
+	// last detach; until then a segment marked for removal is destroying
+	destroying bool
+}
+
+func (seg *fakeSegment) Attach(flags *SHMAttachFlags) (*SharedMemMount, error) {
+	if err := flags.validate(); err != nil {
+		return nil, err
+	}
+
+	seg.ns.mu.Lock()
+	defer seg.ns.mu.Unlock()
+
+	if seg.removed {
+		return nil, syscall.EINVAL
+	}
+	ptr := unsafe.Pointer(&seg.mem[0])
+	if addr := flags.addr(); addr != 0 && addr != uintptr(ptr) {
+		// there's only the one mapping
+		return nil, syscall.EINVAL
+	}
+
+	seg.nattch++
+	seg.atime, seg.lpid = fakeNow(), os.Getpid()
+	return &SharedMemMount{
+		ptr:      ptr,
+		length:   seg.size,
+		readonly: flags.ro(),
+		fake:     seg,
+	}, nil
+}
+
+func (seg *fakeSegment) detach() error {
+	seg.ns.mu.Lock()
+	defer seg.ns.mu.Unlock()
+
+	if seg.nattch == 0 {
+		return syscall.EINVAL
+	}
+	seg.nattch--
+	seg.dtime, seg.lpid = fakeNow(), os.Getpid()
+	if seg.nattch == 0 && seg.destroying {
+		return seg.free()
+	}
+	return nil
+}
+
+func (seg *fakeSegment) free() error {
+	seg.removed = true
+	return syscall.Munmap(seg.mem)
+}
+
+func (seg *fakeSegment) Stat() (*SHMInfo, error) {
+	seg.ns.mu.Lock()
+	defer seg.ns.mu.Unlock()
+
+	if seg.removed {
+		return nil, syscall.EINVAL
+	}
+	return &SHMInfo{
+		Perms:           seg.perms,
+		SegmentSize:     seg.size,
+		LastAttach:      seg.atime,
+		LastDetach:      seg.dtime,
+		LastChange:      seg.ctime,
+		CreatorPID:      seg.cpid,
+		LastUserPID:     seg.lpid,
+		CurrentAttaches: seg.nattch,
+		Locked:          seg.locked,
+		Destroying:      seg.destroying,
+	}, nil
+}
+
+func (seg *fakeSegment) Set(info *SHMInfo) error {
+	seg.ns.mu.Lock()
+	defer seg.ns.mu.Unlock()
+
+	if seg.removed {
+		return syscall.EINVAL
+	}
+	seg.setPerms(info.Perms)
+	return nil
+}
+
+func (seg *fakeSegment) Update(fn func(*SHMInfo)) error {
+	info, err := seg.Stat()
+	if err != nil {
+		return err
+	}
+	fn(info)
+	return seg.Set(info)
+}
+
+func (seg *fakeSegment) Chmod(perms int) error {
+	return seg.Update(func(info *SHMInfo) { info.Perms.Mode = uint16(perms) })
+}
+
+func (seg *fakeSegment) Chown(uid, gid int) error {
+	return seg.Update(func(info *SHMInfo) { chown(&info.Perms, uid, gid) })
+}
+
+func (seg *fakeSegment) Lock() error {
+	return seg.setLocked(true)
+}
+
+func (seg *fakeSegment) Unlock() error {
+	return seg.setLocked(false)
+}
+
+func (seg *fakeSegment) setLocked(locked bool) error {
+	seg.ns.mu.Lock()
+	defer seg.ns.mu.Unlock()
+
+	if seg.removed {
+		return syscall.EINVAL
+	}
+	seg.locked = locked
+	return nil
+}
+
+// Remove marks the segment for removal, which (as with the kernel) takes
+// its key away at once but frees it only after the last detach.
+func (seg *fakeSegment) Remove() error {
+	seg.ns.mu.Lock()
+	defer seg.ns.mu.Unlock()
+
+	if seg.removed {
+		return syscall.EINVAL
+	}
+	if !seg.destroying && seg.key != 0 {
+		delete(seg.ns.segs, seg.key)
+	}
+	seg.destroying = true
+	seg.perms.Key = 0
+	seg.ctime = fakeNow()
+	if seg.nattch == 0 {
+		return seg.free()
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package sysvipc
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// FragmentHeaderSize is the number of bytes of each fragment taken up
+	// by the header (message id, index, total, sizes, checksum).
+	FragmentHeaderSize = 28
+
+	// DefaultFragmentSize is the fragment size used when none is given.
+	DefaultFragmentSize = DefaultMsgMax
+
+	// DefaultMaxMessageSize is the largest message a Reassembler will put
+	// back together unless changed with SetMaxMessageSize.
+	DefaultMaxMessageSize = 64 << 20
+)
+
+var (
+	// ErrNotFragment is returned by Reassembler.Receive for a message that
+	// wasn't sent by a FragmentWriter.
+	ErrNotFragment = errors.New("sysvipc: message is not a fragment")
+
+	// ErrFragmentTooLarge is returned by Reassembler.Receive for a fragment
+	// of a message bigger than its maximum message size. Nothing is
+	// allocated for it.
+	ErrFragmentTooLarge = errors.New("sysvipc: fragmented message exceeds the maximum size")
+
+	// ErrBadChecksum is returned by Reassembler.Receive when a reassembled
+	// message doesn't match its checksum. The message is discarded.
+	ErrBadChecksum = errors.New("sysvipc: reassembled message failed checksum")
+)
+
+// fragment header layout, little-endian
+type fragHeader struct {
+	id    uint64 // sender PID << 32 | per-process counter
+	index uint32
+	total uint32
+	size  uint32 // of the whole message
+	chunk uint32 // body length of every fragment but the last
+	crc   uint32 // crc32 (IEEE) of the whole message
+}
+
+func (h *fragHeader) put(b []byte) {
+	binary.LittleEndian.PutUint64(b[0:], h.id)
+	binary.LittleEndian.PutUint32(b[8:], h.index)
+	binary.LittleEndian.PutUint32(b[12:], h.total)
+	binary.LittleEndian.PutUint32(b[16:], h.size)
+	binary.LittleEndian.PutUint32(b[20:], h.chunk)
+	binary.LittleEndian.PutUint32(b[24:], h.crc)
+}
+
+func (h *fragHeader) get(b []byte) {
+	h.id = binary.LittleEndian.Uint64(b[0:])
+	h.index = binary.LittleEndian.Uint32(b[8:])
+	h.total = binary.LittleEndian.Uint32(b[12:])
+	h.size = binary.LittleEndian.Uint32(b[16:])
+	h.chunk = binary.LittleEndian.Uint32(b[20:])
+	h.crc = binary.LittleEndian.Uint32(b[24:])
+}
+
+// FragmentWriter sends messages of any size by splitting them into
+// sequenced fragments, to be put back together by a Reassembler.
+type FragmentWriter struct {
+	mq       MessageQueue
+	fragSize uint
+	pid      uint64
+}
+
+// fragmentIDs numbers the messages of every FragmentWriter in the process,
+// so that writers sharing a queue never reuse each other's ids.
+var fragmentIDs atomic.Uint32
+
+// NewFragmentWriter creates a FragmentWriter for a queue. fragSize is the
+// largest message (header included) to put on the queue, and must not exceed
+// the system's msgmax. 0 means DefaultFragmentSize.
+func NewFragmentWriter(mq MessageQueue, fragSize uint) (*FragmentWriter, error) {
+	if fragSize == 0 {
+		fragSize = DefaultFragmentSize
+	}
+	if fragSize <= FragmentHeaderSize {
+		return nil, errors.New("sysvipc: fragment size too small for header")
+	}
+	return &FragmentWriter{mq: mq, fragSize: fragSize, pid: uint64(os.Getpid())}, nil
+}
+
+// Send places body onto the queue as one or more fragments of type mtyp.
+// If sending a fragment fails partway through, the fragments already sent
+// are left for the receiver to time out.
+func (fw *FragmentWriter) Send(mtyp int64, body []byte, flags *MQSendFlags) error {
+	if uint64(len(body)) > 0xFFFFFFFF {
+		return errors.New("sysvipc: message too large to fragment")
+	}
+
+	chunk := int(fw.fragSize - FragmentHeaderSize)
+	total := (len(body) + chunk - 1) / chunk
+	if total == 0 {
+		total = 1
+	}
+
+	h := fragHeader{
+		id:    fw.pid<<32 | uint64(fragmentIDs.Add(1)),
+		total: uint32(total),
+		size:  uint32(len(body)),
+		chunk: uint32(chunk),
+		crc:   crc32.ChecksumIEEE(body),
+	}
+
+	frag := make([]byte, fw.fragSize)
+	for i := 0; i < total; i++ {
+		start := i * chunk
+		end := start + chunk
+		if end > len(body) {
+			end = len(body)
+		}
+
+		h.index = uint32(i)
+		h.put(frag)
+		n := copy(frag[FragmentHeaderSize:], body[start:end])
+
+		if err := fw.mq.Send(mtyp, frag[:FragmentHeaderSize+n], flags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reassembler receives fragments from a queue and puts the messages back
+// together. Fragments of different messages, from any number of senders,
+// may arrive interleaved.
+//
+// All fragments of a message have to reach the same Reassembler, so there
+// should only be one receiving any given message type. It is safe for
+// concurrent use by multiple goroutines.
+type Reassembler struct {
+	mq       MessageQueue
+	fragSize uint
+	timeout  time.Duration
+	maxSize  uint64
+
+	mu      sync.Mutex
+	partial map[partialKey]*partialMsg
+	dropped uint64
+}
+
+type partialKey struct {
+	mtyp int64
+	id   uint64
+}
+
+type partialMsg struct {
+	hdr      fragHeader
+	body     []byte
+	have     []bool
+	received uint32
+	started  time.Time
+}
+
+// NewReassembler creates a Reassembler for a queue. fragSize must be at
+// least the senders' fragment size (0 means DefaultFragmentSize). A message
+// that is still incomplete once timeout has passed since its first fragment
+// arrived is discarded; a timeout of 0 keeps them forever. Expiry is only
+// checked when Receive is called or a fragment arrives, so partial messages
+// can outlive the timeout while Receive is blocked or not being called.
+func NewReassembler(mq MessageQueue, fragSize uint, timeout time.Duration) *Reassembler {
+	if fragSize == 0 {
+		fragSize = DefaultFragmentSize
+	}
+	return &Reassembler{
+		mq:       mq,
+		fragSize: fragSize,
+		timeout:  timeout,
+		maxSize:  DefaultMaxMessageSize,
+		partial:  make(map[partialKey]*partialMsg),
+	}
+}
+
+// SetMaxMessageSize changes the largest message the Reassembler will accept
+// fragments of. The buffer for a message is sized from its first fragment's
+// header, so this bounds what one bad sender can make it allocate.
+func (r *Reassembler) SetMaxMessageSize(n uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxSize = n
+}
+
+// Receive retrieves fragments from the queue until a whole message is
+// available, and returns it with its type. msgtyp and flags work as in
+// MessageQueue.Receive, with DontWait applying to each fragment (so it can
+// fail with a message partially received, to be finished by a later call).
+func (r *Reassembler) Receive(msgtyp int64, flags *MQRecvFlags) ([]byte, int64, error) {
+	r.mu.Lock()
+	r.expire(time.Now())
+	r.mu.Unlock()
+
+	for {
+		frag, mtyp, err := r.mq.Receive(r.fragSize, msgtyp, flags)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		body, done, err := r.add(mtyp, frag, time.Now())
+		if err != nil {
+			return nil, mtyp, err
+		}
+		if done {
+			return body, mtyp, nil
+		}
+	}
+}
+
+// Pending returns the number of messages with some but not all of their
+// fragments received.
+func (r *Reassembler) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.partial)
+}
+
+// Dropped returns the number of incomplete messages discarded after timing
+// out.
+func (r *Reassembler) Dropped() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.dropped
+}
+
+func (r *Reassembler) add(mtyp int64, frag []byte, now time.Time) ([]byte, bool, error) {
+	if len(frag) < FragmentHeaderSize {
+		return nil, false, ErrNotFragment
+	}
+	var h fragHeader
+	h.get(frag)
+	chunk := frag[FragmentHeaderSize:]
+
+	// every fragment but the last carries exactly h.chunk bytes, and the
+	// last carries the rest
+	offset := uint64(h.index) * uint64(h.chunk)
+	want := uint64(h.chunk)
+	if h.index == h.total-1 {
+		want = uint64(h.size) - offset
+	}
+	if h.total == 0 || h.index >= h.total || offset > uint64(h.size) ||
+		uint64(len(chunk)) != want {
+		return nil, false, ErrNotFragment
+	}
+	if h.total > 1 && (h.chunk == 0 ||
+		(uint64(h.size)+uint64(h.chunk)-1)/uint64(h.chunk) != uint64(h.total)) {
+		return nil, false, ErrNotFragment
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(now)
+
+	// the common unfragmented case skips the bookkeeping
+	if h.total == 1 {
+		return checked(chunk, h.crc)
+	}
+
+	key := partialKey{mtyp, h.id}
+	pm, ok := r.partial[key]
+	if !ok {
+		if uint64(h.size) > r.maxSize {
+			return nil, false, ErrFragmentTooLarge
+		}
+		pm = &partialMsg{
+			hdr:     h,
+			body:    make([]byte, h.size),
+			have:    make([]bool, h.total),
+			started: now,
+		}
+		r.partial[key] = pm
+	}
+	if pm.hdr.total != h.total || pm.hdr.size != h.size ||
+		pm.hdr.chunk != h.chunk || pm.hdr.crc != h.crc {
+		delete(r.partial, key)
+		return nil, false, ErrNotFragment
+	}
+
+	if !pm.have[h.index] {
+		copy(pm.body[offset:], chunk)
+		pm.have[h.index] = true
+		pm.received++
+	}
+
+	if pm.received < pm.hdr.total {
+		return nil, false, nil
+	}
+	delete(r.partial, key)
+	return checked(pm.body, pm.hdr.crc)
+}
+
+func checked(body []byte, crc uint32) ([]byte, bool, error) {
+	if crc32.ChecksumIEEE(body) != crc {
+		return nil, false, ErrBadChecksum
+	}
+	out := make([]byte, len(body))
+	copy(out, body)
+	return out, true, nil
+}
+
+func (r *Reassembler) expire(now time.Time) {
+	if r.timeout <= 0 {
+		return
+	}
+	for key, pm := range r.partial {
+		if now.Sub(pm.started) > r.timeout {
+			delete(r.partial, key)
+			r.dropped++
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package sysvipc
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFragmentRoundTrip(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	fw, err := NewFragmentWriter(q, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReassembler(q, 0, time.Second)
+
+	for _, size := range []int{0, 1, DefaultFragmentSize - FragmentHeaderSize, DefaultFragmentSize, 300 * 1024} {
+		body := make([]byte, size)
+		rand.Read(body)
+
+		// the queue only holds 16K by default, so send in the background
+		errc := make(chan error, 1)
+		go func() {
+			errc <- fw.Send(7, body, nil)
+		}()
+
+		got, mtyp, err := r.Receive(7, nil)
+		if err != nil {
+			t.Fatal(size, err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(size, err)
+		}
+		if mtyp != 7 {
+			t.Error("wrong type", mtyp)
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("%d byte message came back as %d bytes", size, len(got))
+		}
+	}
+
+	if r.Pending() != 0 {
+		t.Error("leftover partial messages", r.Pending())
+	}
+}
+
+func TestFragmentInterleaved(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	const senders, perSender = 4, 5
+
+	r := NewReassembler(q, 256, time.Second)
+
+	wg := &sync.WaitGroup{}
+	for s := 0; s < senders; s++ {
+		fw, err := NewFragmentWriter(q, 256)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for i := 0; i < perSender; i++ {
+				body := bytes.Repeat([]byte{byte(s), byte(i)}, 1000)
+				if err := fw.Send(int64(s+1), body, nil); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(s)
+	}
+
+	seen := make(map[[2]byte]bool)
+	for n := 0; n < senders*perSender; n++ {
+		body, mtyp, err := r.Receive(0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(body) != 2000 {
+			t.Fatal("wrong length", len(body))
+		}
+		if !bytes.Equal(body, bytes.Repeat(body[:2], 1000)) {
+			t.Fatal("message mixed up with another")
+		}
+		if int64(body[0])+1 != mtyp {
+			t.Error("wrong type for sender", body[0], mtyp)
+		}
+		seen[[2]byte{body[0], body[1]}] = true
+	}
+	wg.Wait()
+
+	if len(seen) != senders*perSender {
+		t.Error("missing or duplicated messages", len(seen))
+	}
+}
+
+func TestFragmentSameProcessWriters(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	// each writer fragments onto its own queue, and the fragments are then
+	// shuffled together onto q under one type
+	var frags [2][][]byte
+	for w := range frags {
+		wq, err := GetMsgQueue(0, &MQFlags{Create: true, Perms: 0600})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wq.Remove()
+		fw, err := NewFragmentWriter(wq, 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fw.Send(1, bytes.Repeat([]byte{byte(w)}, 400), nil); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			frag, _, err := wq.Receive(128, 0, &MQRecvFlags{DontWait: true})
+			if err != nil {
+				break
+			}
+			frags[w] = append(frags[w], frag)
+		}
+	}
+	for i := range frags[0] {
+		for w := range frags {
+			if err := q.Send(1, frags[w][i], nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	r := NewReassembler(q, 128, time.Second)
+	for range frags {
+		body, _, err := r.Receive(0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(body) != 400 || !bytes.Equal(body, bytes.Repeat(body[:1], 400)) {
+			t.Fatal("messages from the two writers were mixed up")
+		}
+	}
+	if n := r.Pending(); n != 0 {
+		t.Error("partial messages left over:", n)
+	}
+}
+
+func TestFragmentTimeout(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	fw, err := NewFragmentWriter(q, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReassembler(q, 128, 10*time.Millisecond)
+
+	// put only the first fragment of a message on the queue
+	if err := fw.Send(1, make([]byte, 500), nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, _, err := q.Receive(128, -1, &MQRecvFlags{Truncate: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := r.Receive(1, &MQRecvFlags{DontWait: true}); err == nil {
+		t.Fatal("incomplete message shouldn't be returned")
+	}
+	if r.Pending() != 1 {
+		t.Fatal("expected one partial message", r.Pending())
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// a Receive with nothing to read still drops it
+	if _, _, err := r.Receive(1, &MQRecvFlags{DontWait: true}); err != syscall.ENOMSG {
+		t.Fatal("expected ENOMSG", err)
+	}
+	if r.Pending() != 0 || r.Dropped() != 1 {
+		t.Fatal("stale partial message wasn't dropped by Receive", r.Pending(), r.Dropped())
+	}
+
+	if err := fw.Send(1, []byte("complete"), nil); err != nil {
+		t.Fatal(err)
+	}
+	body, _, err := r.Receive(1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "complete" {
+		t.Errorf("got %q", body)
+	}
+	if r.Pending() != 0 || r.Dropped() != 1 {
+		t.Error("stale partial message wasn't dropped", r.Pending(), r.Dropped())
+	}
+}
+
+func TestFragmentMaxMessageSize(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	fw, err := NewFragmentWriter(q, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReassembler(q, 128, 0)
+	r.SetMaxMessageSize(400)
+
+	if err := fw.Send(1, make([]byte, 500), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.Receive(1, nil); err != ErrFragmentTooLarge {
+		t.Fatal("oversized message should be rejected", err)
+	}
+	if r.Pending() != 0 {
+		t.Error("oversized message shouldn't be kept", r.Pending())
+	}
+
+	// a forged header claiming 4GB
+	frag := make([]byte, FragmentHeaderSize+100)
+	h := fragHeader{id: 1, total: 1 << 26, size: 1<<32 - 1, chunk: 64}
+	h.put(frag)
+	frag = frag[:FragmentHeaderSize+64]
+	if _, _, err := r.add(2, frag, time.Now()); err != ErrFragmentTooLarge {
+		t.Error("forged size should be rejected", err)
+	}
+
+	body := make([]byte, 400)
+	if err := fw.Send(2, body, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, err := r.Receive(2, nil); err != nil || len(got) != 400 {
+		t.Error("message at the limit should be accepted", len(got), err)
+	}
+}
+
+func TestFragmentErrors(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	if _, err := NewFragmentWriter(q, FragmentHeaderSize); err == nil {
+		t.Error("fragment size with no room for a body should fail")
+	}
+
+	r := NewReassembler(q, 0, 0)
+
+	if err := q.Send(1, []byte("not a fragment"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.Receive(1, nil); err != ErrNotFragment {
+		t.Error("plain message should be rejected", err)
+	}
+
+	fw, err := NewFragmentWriter(q, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Send(1, []byte("corrupt me"), nil); err != nil {
+		t.Fatal(err)
+	}
+	frag, _, err := q.Receive(DefaultFragmentSize, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frag[len(frag)-1] ^= 0xFF
+	if err := q.Send(1, frag, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.Receive(1, nil); err != ErrBadChecksum {
+		t.Error("corrupted message should fail its checksum", err)
+	}
+}
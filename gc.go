@@ -0,0 +1,225 @@
+package sysvipc
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// OwnerTag marks the IPC keys a team creates, so that tools like GC can tell
+// them apart from everyone else's objects on the machine. By convention the
+// tag is the top byte of the key.
+type OwnerTag uint8
+
+// Key returns key with its top byte replaced by the tag.
+func (tag OwnerTag) Key(key int64) int64 {
+	return int64(tag)<<24 | key&0xFFFFFF
+}
+
+// Owns reports whether key carries the tag. IPC_PRIVATE (0) is never owned.
+func (tag OwnerTag) Owns(key int64) bool {
+	return key != 0 && key>>24&0xFF == int64(tag)
+}
+
+// GCPolicy selects the orphaned objects GC removes. An object is collected
+// if it passes every filter that is set and matches at least one of
+// DeadCreator and IdleTTL.
+type GCPolicy struct {
+	// Kinds limits collection to some kinds of object. Empty means all.
+	Kinds []HandleKind
+
+	// Tag, if not nil, limits collection to objects whose key it owns.
+	Tag *OwnerTag
+
+	// Filter, if not nil, is called for each candidate and must return true
+	// for it to be collected.
+	Filter func(Orphan) bool
+
+	// DeadCreator matches shared memory segments with nothing attached
+	// whose creating process has exited. Queues and semaphore sets don't
+	// record their creator, so it doesn't apply to them.
+	DeadCreator bool
+
+	// IdleTTL, if positive, matches objects with no activity for at least
+	// that long: no send, receive or change for queues, no semop or change
+	// for semaphore sets, and nothing attached and no attach, detach or
+	// change for segments.
+	IdleTTL time.Duration
+
+	// DryRun reports what would be collected without removing anything.
+	DryRun bool
+}
+
+// Orphan is an object GC collected, or would have in a dry run.
+type Orphan struct {
+	Handle   Handle
+	Key      int64
+	OwnerUID int
+	Reason   string
+
+	// Err is set if removing the object failed.
+	Err error
+}
+
+func (o Orphan) String() string {
+	s := fmt.Sprintf("%s key=0x%08x uid=%d: %s", o.Handle, o.Key, o.OwnerUID, o.Reason)
+	if o.Err != nil {
+		s += " (" + o.Err.Error() + ")"
+	}
+	return s
+}
+
+// GC finds the IPC objects on the system that the policy matches and removes
+// them (unless it's a dry run), returning what it found. Objects the caller
+// isn't allowed to stat are skipped. Failing to remove an object doesn't
+// stop the collection; it's recorded in that Orphan's Err.
+func GC(policy *GCPolicy) ([]Orphan, error) {
+	if policy == nil {
+		policy = &GCPolicy{}
+	}
+	handles, err := ListHandles(policy.Kinds...)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []Orphan
+	now := time.Now()
+	for _, h := range handles {
+		o, ok := policy.check(h, now)
+		if !ok {
+			continue
+		}
+		if !policy.DryRun {
+			o.Err = ignoreGone(h.Remove())
+		}
+		orphans = append(orphans, o)
+	}
+	return orphans, nil
+}
+
+// check stats an object and decides whether it is an orphan.
+func (p *GCPolicy) check(h Handle, now time.Time) (Orphan, bool) {
+	o := Orphan{Handle: h}
+	var idle bool
+	var dead bool
+
+	switch h.Kind {
+	case HandleMsgQueue:
+		info, err := MessageQueue(h.ID).Stat()
+		if err != nil {
+			return o, false
+		}
+		o.Key, o.OwnerUID = info.Perms.Key, info.Perms.OwnerUID
+		idle = p.idle(now, info.LastSend, info.LastRcv, info.LastChange)
+
+	case HandleSemSet:
+		info, err := (&SemaphoreSet{id: h.ID}).Stat()
+		if err != nil {
+			return o, false
+		}
+		o.Key, o.OwnerUID = info.Perms.Key, info.Perms.OwnerUID
+		idle = p.idle(now, info.LastOp, info.LastChange)
+
+	case HandleSharedMem:
+		info, err := (&SharedMem{id: h.ID}).Stat()
+		if err != nil {
+			return o, false
+		}
+		o.Key, o.OwnerUID = info.Perms.Key, info.Perms.OwnerUID
+		if info.CurrentAttaches == 0 {
+			dead = p.DeadCreator && !processAlive(info.CreatorPID)
+			idle = p.idle(now, info.LastAttach, info.LastDetach, info.LastChange)
+		}
+		if dead {
+			o.Reason = fmt.Sprintf("unattached, creator pid %d exited", info.CreatorPID)
+		}
+
+	default:
+		return o, false
+	}
+
+	if !dead && !idle {
+		return o, false
+	}
+	if idle && o.Reason == "" {
+		o.Reason = "idle longer than " + p.IdleTTL.String()
+	}
+	if p.Tag != nil && !p.Tag.Owns(o.Key) {
+		return o, false
+	}
+	if p.Filter != nil && !p.Filter(o) {
+		return o, false
+	}
+	return o, true
+}
+
+func (p *GCPolicy) idle(now time.Time, times ...time.Time) bool {
+	if p.IdleTTL <= 0 {
+		return false
+	}
+	var last time.Time
+	for _, t := range times {
+		if t.After(last) {
+			last = t
+		}
+	}
+	return now.Sub(last) >= p.IdleTTL
+}
+
+// ListHandles returns a Handle for every IPC object of the given kinds (or
+// of every kind, if none are given) on the system, whether or not the
+// caller can access them.
+func ListHandles(kinds ...HandleKind) ([]Handle, error) {
+	if len(kinds) == 0 {
+		kinds = []HandleKind{HandleMsgQueue, HandleSemSet, HandleSharedMem}
+	}
+
+	var handles []Handle
+	for _, kind := range kinds {
+		ids, err := listIDs(kind)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			handles = append(handles, Handle{kind, id})
+		}
+	}
+	return handles, nil
+}
+
+// listIDs reads the ids of every object of a kind from /proc/sysvipc.
+func listIDs(kind HandleKind) ([]int64, error) {
+	f, err := os.Open("/proc/sysvipc/" + string(kind))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ids []int64
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		id, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("sysvipc: bad /proc/sysvipc/%s line %q", kind, scanner.Text())
+		}
+		ids = append(ids, id)
+	}
+	return ids, scanner.Err()
+}
+
+// objects already gone by the time they're removed weren't a failure
+func ignoreGone(err error) error {
+	if err == syscall.EINVAL || err == syscall.EIDRM {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+package sysvipc
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOwnerTag(t *testing.T) {
+	tag := OwnerTag(0xA5)
+
+	key := tag.Key(0xDA7ABA5E)
+	if key != 0xA57ABA5E {
+		t.Errorf("wrong tagged key %x", key)
+	}
+	if !tag.Owns(key) {
+		t.Error("tag should own its own key")
+	}
+	if tag.Owns(0xDA7ABA5E) || OwnerTag(0).Owns(0) {
+		t.Error("tag owns a key it didn't mark")
+	}
+}
+
+// TestGCHelperProcess isn't a real test; TestGCDeadCreator runs it in a
+// child process to create a segment and exit.
+func TestGCHelperProcess(t *testing.T) {
+	if os.Getenv("SYSVIPC_GC_HELPER") != "1" {
+		t.Skip("only run as a helper process")
+	}
+	mem, err := GetSharedMem(0, 4096, &SHMFlags{Create: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println(mem.ID())
+}
+
+func TestGCDeadCreator(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestGCHelperProcess$")
+	cmd.Env = append(os.Environ(), "SYSVIPC_GC_HELPER=1")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := strconv.ParseInt(strings.SplitN(string(out), "\n", 2)[0], 10, 64)
+	if err != nil {
+		t.Fatalf("bad helper output %q", out)
+	}
+	orphan, err := OpenSharedMemByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orphan.Remove()
+
+	// one of our own, which shouldn't count as orphaned
+	mine, err := GetSharedMem(0, 4096, &SHMFlags{Create: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mine.Remove()
+
+	policy := &GCPolicy{
+		Kinds:       []HandleKind{HandleSharedMem},
+		DeadCreator: true,
+		DryRun:      true,
+		Filter: func(o Orphan) bool {
+			return o.Handle.ID == orphan.ID() || o.Handle.ID == mine.ID()
+		},
+	}
+
+	found, err := GC(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Handle != orphan.Handle() {
+		t.Fatal("wrong orphans", found)
+	}
+	if _, err := OpenSharedMemByID(id); err != nil {
+		t.Fatal("dry run removed the segment", err)
+	}
+
+	policy.DryRun = false
+	if found, err = GC(policy); err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Err != nil {
+		t.Fatal("wrong orphans", found)
+	}
+	if _, err := OpenSharedMemByID(id); err == nil {
+		t.Error("orphaned segment wasn't removed")
+	}
+}
+
+func TestGCIdle(t *testing.T) {
+	mq, err := GetMsgQueue(0, &MQFlags{Create: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.Remove()
+
+	only := func(o Orphan) bool { return o.Handle == mq.Handle() }
+
+	found, err := GC(&GCPolicy{IdleTTL: time.Hour, Filter: only})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Error("fresh queue collected", found)
+	}
+
+	// IPC_PRIVATE keys never carry a tag
+	tag := OwnerTag(0xA5)
+	found, err = GC(&GCPolicy{IdleTTL: time.Nanosecond, Tag: &tag, Filter: only})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Error("untagged queue collected", found)
+	}
+
+	found, err = GC(&GCPolicy{IdleTTL: time.Nanosecond, Filter: only})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Err != nil {
+		t.Fatal("idle queue not collected", found)
+	}
+	if _, err := OpenMsgQueueByID(int64(mq)); err == nil {
+		t.Error("idle queue wasn't removed")
+	}
+}
@@ -0,0 +1,162 @@
+package sysvipc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// HandleKind identifies which sort of IPC object a Handle refers to.
+type HandleKind string
+
+const (
+	HandleMsgQueue  HandleKind = "msg"
+	HandleSemSet    HandleKind = "sem"
+	HandleSharedMem HandleKind = "shm"
+)
+
+// ErrHandleKind is returned when opening a Handle as the wrong sort of
+// object.
+var ErrHandleKind = errors.New("sysvipc: handle refers to a different kind of IPC object")
+
+// Handle is a serializable reference to an existing IPC object, for handing
+// to another process (typically a child) that didn't create it and may not
+// know its key. Its text form is "<kind>:<id>", e.g. "shm:32769".
+//
+// Kernel ids embed a sequence number, so a stale handle to a removed object
+// is unlikely to open some unrelated object that reused its slot.
+type Handle struct {
+	Kind HandleKind
+	ID   int64
+}
+
+// Handle returns a Handle to the queue.
+func (mq MessageQueue) Handle() Handle {
+	return Handle{HandleMsgQueue, int64(mq)}
+}
+
+// Handle returns a Handle to the semaphore set.
+func (ss *SemaphoreSet) Handle() Handle {
+	return Handle{HandleSemSet, ss.id}
+}
+
+// Handle returns a Handle to the segment.
+func (shm *SharedMem) Handle() Handle {
+	return Handle{HandleSharedMem, shm.id}
+}
+
+// MsgQueue opens the message queue the handle refers to.
+func (h Handle) MsgQueue() (MessageQueue, error) {
+	if h.Kind != HandleMsgQueue {
+		return -1, ErrHandleKind
+	}
+	return OpenMsgQueueByID(h.ID)
+}
+
+// SemSet opens the semaphore set the handle refers to.
+func (h Handle) SemSet() (*SemaphoreSet, error) {
+	if h.Kind != HandleSemSet {
+		return nil, ErrHandleKind
+	}
+	return OpenSemSetByID(h.ID)
+}
+
+// SharedMem opens the shared memory segment the handle refers to.
+func (h Handle) SharedMem() (*SharedMem, error) {
+	if h.Kind != HandleSharedMem {
+		return nil, ErrHandleKind
+	}
+	return OpenSharedMemByID(h.ID)
+}
+
+// Remove deletes the object the handle refers to.
+func (h Handle) Remove() error {
+	switch h.Kind {
+	case HandleMsgQueue:
+		return MessageQueue(h.ID).Remove()
+	case HandleSemSet:
+		return (&SemaphoreSet{id: h.ID}).Remove()
+	case HandleSharedMem:
+		return (&SharedMem{id: h.ID}).Remove()
+	}
+	return ErrHandleKind
+}
+
+func (h Handle) String() string {
+	return string(h.Kind) + ":" + strconv.FormatInt(h.ID, 10)
+}
+
+// ParseHandle parses the text form of a Handle.
+func ParseHandle(s string) (Handle, error) {
+	kind, id, ok := strings.Cut(s, ":")
+	if !ok {
+		return Handle{}, fmt.Errorf("sysvipc: malformed handle %q", s)
+	}
+
+	h := Handle{Kind: HandleKind(kind)}
+	switch h.Kind {
+	case HandleMsgQueue, HandleSemSet, HandleSharedMem:
+	default:
+		return Handle{}, fmt.Errorf("sysvipc: unknown handle kind %q", kind)
+	}
+
+	var err error
+	if h.ID, err = strconv.ParseInt(id, 10, 32); err != nil || h.ID < 0 {
+		return Handle{}, fmt.Errorf("sysvipc: malformed handle %q", s)
+	}
+	return h, nil
+}
+
+func (h Handle) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+func (h *Handle) UnmarshalText(text []byte) error {
+	parsed, err := ParseHandle(string(text))
+	if err != nil {
+		return err
+	}
+	*h = parsed
+	return nil
+}
+
+// Setenv stores the handle in an environment variable, to be inherited by
+// child processes and read back with HandleFromEnv.
+func (h Handle) Setenv(name string) error {
+	return os.Setenv(name, h.String())
+}
+
+// HandleFromEnv reads a handle stored in an environment variable.
+func HandleFromEnv(name string) (Handle, error) {
+	s, ok := os.LookupEnv(name)
+	if !ok {
+		return Handle{}, fmt.Errorf("sysvipc: %s not set", name)
+	}
+	return ParseHandle(s)
+}
+
+// WriteTo writes the handle as a single line, so that several can be sent
+// down one pipe or file (such as an inherited os/exec ExtraFiles entry) and
+// read back with ReadHandle.
+func (h Handle) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.WriteString(w, h.String()+"\n")
+	return int64(n), err
+}
+
+// ReadHandle reads a handle written by Handle.WriteTo. r should be a
+// *bufio.Reader if more than one handle is to be read from it.
+func ReadHandle(r io.Reader) (Handle, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	line, err := br.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return Handle{}, err
+	}
+	return ParseHandle(strings.TrimSuffix(line, "\n"))
+}
@@ -0,0 +1,148 @@
+package sysvipc
+
+import (
+	"bufio"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestOpenByID(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+	semSetup(t)
+	defer semTeardown(t)
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	mq, err := OpenMsgQueueByID(q.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mq != q {
+		t.Error("opened the wrong queue", mq, q)
+	}
+
+	s, err := OpenSemSetByID(ss.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ID() != ss.ID() || s.count != 4 {
+		t.Error("wrong semaphore set", s.ID(), s.count)
+	}
+
+	m, err := OpenSharedMemByID(shm.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID() != shm.ID() || m.length != 4096 {
+		t.Error("wrong segment", m.ID(), m.length)
+	}
+
+	// one made up id that won't exist
+	if _, err := OpenSemSetByID(5); err != syscall.EINVAL && err != syscall.EIDRM {
+		t.Error("opening a made up id should fail", err)
+	}
+}
+
+func TestHandleText(t *testing.T) {
+	for _, h := range []Handle{
+		{HandleMsgQueue, 0},
+		{HandleSemSet, 12},
+		{HandleSharedMem, 32769},
+	} {
+		text, err := h.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var back Handle
+		if err := back.UnmarshalText(text); err != nil {
+			t.Fatal(err)
+		}
+		if back != h {
+			t.Errorf("%v came back as %v", h, back)
+		}
+	}
+
+	for _, bad := range []string{"", "shm", "shm:", "shm:x", "shm:-1", "pipe:3", "msg:99999999999"} {
+		if _, err := ParseHandle(bad); err == nil {
+			t.Errorf("%q should not parse", bad)
+		}
+	}
+}
+
+func TestHandleOpen(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	if err := q.Handle().Setenv("SYSVIPC_TEST_HANDLE"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("SYSVIPC_TEST_HANDLE")
+
+	h, err := HandleFromEnv("SYSVIPC_TEST_HANDLE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mq, err := h.MsgQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mq != q {
+		t.Error("opened the wrong queue")
+	}
+	if _, err := h.SharedMem(); err != ErrHandleKind {
+		t.Error("opening a queue handle as shared memory should fail", err)
+	}
+
+	if _, err := HandleFromEnv("SYSVIPC_TEST_HANDLE_UNSET"); err == nil {
+		t.Error("reading an unset variable should fail")
+	}
+}
+
+func TestHandlePipe(t *testing.T) {
+	semSetup(t)
+	defer semTeardown(t)
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, err := ss.Handle().WriteTo(w); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := shm.Handle().WriteTo(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	br := bufio.NewReader(r)
+	h, err := ReadHandle(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := h.SemSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ID() != ss.ID() {
+		t.Error("opened the wrong semaphore set")
+	}
+
+	if h, err = ReadHandle(br); err != nil {
+		t.Fatal(err)
+	}
+	m, err := h.SharedMem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID() != shm.ID() {
+		t.Error("opened the wrong segment")
+	}
+}
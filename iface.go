@@ -0,0 +1,111 @@
+package sysvipc
+
+import (
+	"io"
+	"time"
+)
+
+// Queue is the method set of MessageQueue, for code that should also work
+// with a Fake. Helpers such as Subscribe and SendBatch are only on
+// MessageQueue.
+type Queue interface {
+	Send(mtyp int64, body []byte, flags *MQSendFlags) error
+	Receive(maxlen uint, msgtyp int64, flags *MQRecvFlags) ([]byte, int64, error)
+	Stat() (*MQInfo, error)
+	Set(mqi *MQInfo) error
+	Update(fn func(*MQInfo)) error
+	Chmod(perms int) error
+	Chown(uid, gid int) error
+	SetMaxBytes(n uint) error
+	Remove() error
+}
+
+// SemSet is the method set of *SemaphoreSet, for code that should also work
+// with a Fake.
+type SemSet interface {
+	Run(ops *SemOps, timeout time.Duration) error
+	Getval(num uint16) (int, error)
+	Setval(num uint16, value int) error
+	Getall() ([]uint16, error)
+	Setall(values []uint16) error
+	Getpid(num uint16) (int, error)
+	GetNCnt(num uint16) (int, error)
+	GetZCnt(num uint16) (int, error)
+	Stat() (*SemSetInfo, error)
+	Set(ssi *SemSetInfo) error
+	Update(fn func(*SemSetInfo)) error
+	Chmod(perms int) error
+	Chown(uid, gid int) error
+	Remove() error
+}
+
+// Segment is the method set of *SharedMem, for code that should also work
+// with a Fake. A Fake's segments are attached as ordinary *SharedMemMounts,
+// so Mutex, Seqlock and the rest work on them too.
+type Segment interface {
+	Attach(flags *SHMAttachFlags) (*SharedMemMount, error)
+	Stat() (*SHMInfo, error)
+	Set(info *SHMInfo) error
+	Update(fn func(*SHMInfo)) error
+	Chmod(perms int) error
+	Chown(uid, gid int) error
+	Lock() error
+	Unlock() error
+	Remove() error
+}
+
+// Mount is the method set of *SharedMemMount.
+type Mount interface {
+	io.ReadWriteSeeker
+	io.ByteScanner
+	io.ByteWriter
+	io.Closer
+	AtomicWriteUint32(v uint32) error
+	AtomicReadUint32() (uint32, error)
+	Addr() uintptr
+}
+
+var (
+	_ Queue   = MessageQueue(0)
+	_ SemSet  = (*SemaphoreSet)(nil)
+	_ Segment = (*SharedMem)(nil)
+	_ Mount   = (*SharedMemMount)(nil)
+)
+
+// Namespace creates and opens IPC objects by key. Kernel is the real one,
+// and a Fake can stand in for it in tests.
+type Namespace interface {
+	GetMsgQueue(key int64, flags *MQFlags) (Queue, error)
+	GetSemSet(key, count int64, flags *SemSetFlags) (SemSet, error)
+	GetSharedMem(key int64, size uint64, flags *SHMFlags) (Segment, error)
+}
+
+// Kernel is the Namespace of the kernel's IPC objects, using the
+// package-level Get functions.
+var Kernel Namespace = kernel{}
+
+type kernel struct{}
+
+func (kernel) GetMsgQueue(key int64, flags *MQFlags) (Queue, error) {
+	mq, err := GetMsgQueue(key, flags)
+	if err != nil {
+		return nil, err
+	}
+	return mq, nil
+}
+
+func (kernel) GetSemSet(key, count int64, flags *SemSetFlags) (SemSet, error) {
+	ss, err := GetSemSet(key, count, flags)
+	if err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+func (kernel) GetSharedMem(key int64, size uint64, flags *SHMFlags) (Segment, error) {
+	shm, err := GetSharedMem(key, size, flags)
+	if err != nil {
+		return nil, err
+	}
+	return shm, nil
+}
@@ -0,0 +1,400 @@
+package ipctest
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/teepark/go-sysvipc"
+)
+
+// environment variables telling a re-executed test binary to be a worker
+const (
+	roleEnv = "IPCTEST_ROLE"
+	argsEnv = "IPCTEST_ARGS"
+)
+
+// AwaitTimeout is how long Worker.Await waits for an event.
+var AwaitTimeout = 10 * time.Second
+
+var roles = make(map[string]func(*Worker) error)
+
+// RegisterRole makes a role available to Harness.Spawn. It should be called
+// from an init function, so the role is registered in the worker processes
+// too.
+func RegisterRole(name string, fn func(w *Worker) error) {
+	if _, ok := roles[name]; ok {
+		panic("ipctest: role " + name + " registered twice")
+	}
+	roles[name] = fn
+}
+
+// Main runs the tests, or, in a worker process started by a Harness, the
+// worker's role. A package using Harness must call it from TestMain:
+//
+//	func TestMain(m *testing.M) { ipctest.Main(m) }
+func Main(m *testing.M) {
+	if role := os.Getenv(roleEnv); role != "" {
+		os.Exit(runRole(role))
+	}
+	os.Exit(m.Run())
+}
+
+// control is the worker's end of the pipe back to the Harness.
+const controlFD = 3
+
+func runRole(name string) (status int) {
+	ctrl := os.NewFile(controlFD, "ipctest-control")
+	w := &Worker{ctrl: ctrl, values: make(map[string]json.RawMessage)}
+
+	var res workerResult
+	defer func() {
+		if r := recover(); r != nil {
+			res.Err = fmt.Sprintf("panic: %v", r)
+			status = 2
+		}
+		w.send("result", res)
+	}()
+
+	fn, ok := roles[name]
+	if !ok {
+		res.Err = "unknown role " + name
+		return 2
+	}
+	if err := json.Unmarshal([]byte(os.Getenv(argsEnv)), &w.args); err != nil {
+		res.Err = "bad arguments: " + err.Error()
+		return 2
+	}
+
+	err := fn(w)
+	res.Values = w.values
+	if err != nil {
+		res.Err = err.Error()
+		return 1
+	}
+	return 0
+}
+
+// Worker is a role's view of its process.
+type Worker struct {
+	args   []string
+	ctrl   *os.File
+	mu     sync.Mutex
+	values map[string]json.RawMessage
+}
+
+// Args returns the arguments the role was spawned with.
+func (w *Worker) Args() []string {
+	return w.args
+}
+
+// Handle parses the i-th argument as a sysvipc.Handle.
+func (w *Worker) Handle(i int) (sysvipc.Handle, error) {
+	if i >= len(w.args) {
+		return sysvipc.Handle{}, fmt.Errorf("ipctest: no argument %d", i)
+	}
+	return sysvipc.ParseHandle(w.args[i])
+}
+
+// Set records a value, which must encode as JSON, for the Harness to read
+// from the Result.
+func (w *Worker) Set(key string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		panic(err)
+	}
+	w.mu.Lock()
+	w.values[key] = data
+	w.mu.Unlock()
+}
+
+// SetErr records an error under key, as its errno if it's a syscall.Errno
+// so the Harness can compare it with Result.Errno.
+func (w *Worker) SetErr(key string, err error) {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		w.Set(key, int(errno))
+	} else if err != nil {
+		w.Set(key, err.Error())
+	} else {
+		w.Set(key, 0)
+	}
+}
+
+// Signal tells the Harness that the worker has reached a point in its
+// role, for Proc.Await.
+func (w *Worker) Signal(event string) {
+	w.send("event", event)
+}
+
+func (w *Worker) send(kind string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fmt.Fprintf(w.ctrl, "%s %s\n", kind, data)
+}
+
+type workerResult struct {
+	Err    string                     `json:"err,omitempty"`
+	Values map[string]json.RawMessage `json:"values,omitempty"`
+}
+
+// Harness spawns worker processes for a test, each re-executing the test
+// binary (as Start does) to play a registered role rather than run a test.
+// Workers still running when the test finishes are killed.
+type Harness struct {
+	t     testing.TB
+	mu    sync.Mutex
+	procs []*Proc
+}
+
+// NewHarness creates a Harness for a test or benchmark.
+func NewHarness(t testing.TB) *Harness {
+	h := &Harness{t: t}
+	t.Cleanup(func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for _, p := range h.procs {
+			p.kill()
+			p.wait()
+		}
+	})
+	return h
+}
+
+// Spawn starts a worker process playing a role.
+func (h *Harness) Spawn(role string, args ...string) *Proc {
+	h.t.Helper()
+
+	if args == nil {
+		args = []string{}
+	}
+	encoded, err := json.Marshal(args)
+	if err != nil {
+		h.t.Fatal("ipctest:", err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		h.t.Fatal("ipctest:", err)
+	}
+	defer w.Close()
+
+	c, err := startChild(
+		[]string{"-test.run=^$"},
+		[]string{roleEnv + "=" + role, argsEnv + "=" + string(encoded)},
+		[]*os.File{w}, // becomes controlFD
+	)
+	if err != nil {
+		r.Close()
+		h.t.Fatal("ipctest:", err)
+	}
+	p := &Proc{
+		child:  c,
+		h:      h,
+		role:   role,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go p.read(r)
+
+	h.mu.Lock()
+	h.procs = append(h.procs, p)
+	h.mu.Unlock()
+	return p
+}
+
+// Proc is a running worker process.
+type Proc struct {
+	*child
+	h      *Harness
+	role   string
+	done   chan struct{}
+	result workerResult
+
+	// events are kept until Await gets to them, however many the worker
+	// sends; notify is poked after each one arrives
+	mu     sync.Mutex
+	events []string
+	notify chan struct{}
+
+	waitOnce sync.Once
+	waitErr  error
+}
+
+func (p *Proc) read(r *os.File) {
+	defer r.Close()
+	defer close(p.done)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		kind, data, _ := strings.Cut(scanner.Text(), " ")
+		switch kind {
+		case "event":
+			var ev string
+			json.Unmarshal([]byte(data), &ev)
+			p.mu.Lock()
+			p.events = append(p.events, ev)
+			p.mu.Unlock()
+			select {
+			case p.notify <- struct{}{}:
+			default:
+			}
+		case "result":
+			json.Unmarshal([]byte(data), &p.result)
+		}
+	}
+}
+
+// PID returns the worker's process id.
+func (p *Proc) PID() int {
+	return p.cmd.Process.Pid
+}
+
+// Await waits for the worker to Signal an event, skipping any others, and
+// fails the test if it exits or AwaitTimeout passes first.
+func (p *Proc) Await(event string) {
+	p.h.t.Helper()
+	timer := time.NewTimer(AwaitTimeout)
+	defer timer.Stop()
+
+	for {
+		if p.next(event) {
+			return
+		}
+		select {
+		case <-p.notify:
+		case <-p.done:
+			if p.next(event) {
+				return
+			}
+			p.wait()
+			p.h.t.Fatalf("ipctest: %s worker exited before %q:\n%s", p.role, event, p.out.String())
+		case <-timer.C:
+			p.h.t.Fatalf("ipctest: timed out waiting for %s worker to %q:\n%s", p.role, event, p.out.String())
+		}
+	}
+}
+
+// next consumes events up to and including the first match, reporting
+// whether there was one.
+func (p *Proc) next(event string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, ev := range p.events {
+		if ev == event {
+			p.events = p.events[i+1:]
+			return true
+		}
+	}
+	p.events = p.events[:0]
+	return false
+}
+
+// Signal sends the worker a signal.
+func (p *Proc) Signal(sig os.Signal) {
+	p.cmd.Process.Signal(sig)
+}
+
+// Wait waits for the worker to finish, failing the test if its role
+// returned an error or the process died some other way.
+func (p *Proc) Wait() *Result {
+	p.h.t.Helper()
+	res := p.wait()
+	if res.Err != "" || !res.Exited() || res.ExitCode() != 0 {
+		p.h.t.Errorf("ipctest: %s worker failed: %s (%v)\n%s", p.role, res.Err, p.waitErr, res.Output)
+	}
+	return res
+}
+
+// Kill kills the worker with SIGKILL, as if it crashed, and waits for it.
+func (p *Proc) Kill() *Result {
+	p.kill()
+	return p.wait()
+}
+
+func (p *Proc) wait() *Result {
+	p.waitOnce.Do(func() {
+		p.waitErr = p.cmd.Wait()
+		<-p.done
+	})
+	return &Result{
+		Err:    p.result.Err,
+		Output: p.out.String(),
+		values: p.result.Values,
+		state:  p.cmd.ProcessState,
+	}
+}
+
+// Result is what a worker left behind.
+type Result struct {
+	// Err is the error the role returned, if any.
+	Err string
+
+	// Output is everything the worker wrote to stdout and stderr.
+	Output string
+
+	values map[string]json.RawMessage
+	state  *os.ProcessState
+}
+
+// Get decodes a value the worker Set.
+func (r *Result) Get(key string, v interface{}) error {
+	data, ok := r.values[key]
+	if !ok {
+		return fmt.Errorf("ipctest: worker didn't set %q", key)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Errno returns an error the worker recorded with SetErr, or nil.
+func (r *Result) Errno(key string) error {
+	var errno int
+	if err := r.Get(key, &errno); err != nil {
+		var msg string
+		if r.Get(key, &msg) == nil {
+			return errors.New(msg)
+		}
+		return err
+	}
+	if errno == 0 {
+		return nil
+	}
+	return syscall.Errno(errno)
+}
+
+// Exited reports whether the worker exited normally (and not from a
+// signal).
+func (r *Result) Exited() bool {
+	return r.state != nil && r.state.Exited()
+}
+
+// ExitCode returns the worker's exit status, or -1 if it was killed.
+func (r *Result) ExitCode() int {
+	if r.state == nil {
+		return -1
+	}
+	return r.state.ExitCode()
+}
+
+// Signaled returns the signal that killed the worker, or 0.
+func (r *Result) Signaled() syscall.Signal {
+	if r.state == nil {
+		return 0
+	}
+	if status, ok := r.state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return status.Signal()
+	}
+	return 0
+}
@@ -0,0 +1,194 @@
+/*
+Package ipctest provides helpers for tests that use System V IPC objects.
+
+Objects are created under fresh keys for each test, so concurrent test runs
+don't collide, and are removed when the test finishes. CheckLeaks fails a
+test that leaves anything else behind.
+
+	func TestWorker(t *testing.T) {
+		ipctest.CheckLeaks(t)
+		q := ipctest.MsgQueue(t, nil)
+		...
+	}
+
+Keys carry Tag (see sysvipc.OwnerTag), so anything left over by a crashed
+test run can be swept up with "ipcgc -tag 0x7e -idle 1h".
+*/
+package ipctest
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/teepark/go-sysvipc"
+)
+
+// Tag marks the keys of every object created by this package.
+const Tag sysvipc.OwnerTag = 0x7E
+
+// keyProbes is how many keys are tried before giving up on creating an
+// object.
+const keyProbes = 64
+
+var keyCounter uint32
+
+// Key returns a key, marked with Tag, that no other call in this process
+// has returned and that is unlikely to be in use. The creation helpers still
+// check, by creating exclusively and trying another key on EEXIST.
+func Key(t testing.TB) int64 {
+	n := atomic.AddUint32(&keyCounter, 1)
+	name := fmt.Sprintf("%s\x00%d\x00%d", t.Name(), os.Getpid(), n)
+	return Tag.Key(sysvipc.NameKey(name, 0))
+}
+
+// create calls get with fresh keys until one isn't already taken.
+func create(t testing.TB, get func(key int64) error) {
+	t.Helper()
+	for i := 0; i < keyProbes; i++ {
+		err := get(Key(t))
+		if err == syscall.EEXIST {
+			continue
+		}
+		if err != nil {
+			t.Fatal("ipctest:", err)
+		}
+		return
+	}
+	t.Fatal("ipctest: no free key")
+}
+
+func perms(p int) int {
+	if p == 0 {
+		return 0600
+	}
+	return p
+}
+
+// MsgQueue creates a message queue that is removed when the test finishes.
+// Only flags.Perms is used, and it defaults to 0600.
+func MsgQueue(t testing.TB, flags *sysvipc.MQFlags) sysvipc.MessageQueue {
+	t.Helper()
+	f := sysvipc.MQFlags{Create: true, Exclusive: true}
+	if flags != nil {
+		f.Perms = flags.Perms
+	}
+	f.Perms = perms(f.Perms)
+
+	var mq sysvipc.MessageQueue
+	create(t, func(key int64) (err error) {
+		mq, err = sysvipc.GetMsgQueue(key, &f)
+		return
+	})
+	removeOnCleanup(t, mq.Handle())
+	return mq
+}
+
+// SemSet creates a semaphore set of count semaphores that is removed when
+// the test finishes. Only flags.Perms is used, and it defaults to 0600.
+func SemSet(t testing.TB, count int64, flags *sysvipc.SemSetFlags) *sysvipc.SemaphoreSet {
+	t.Helper()
+	f := sysvipc.SemSetFlags{Create: true, Exclusive: true}
+	if flags != nil {
+		f.Perms = flags.Perms
+	}
+	f.Perms = perms(f.Perms)
+
+	var ss *sysvipc.SemaphoreSet
+	create(t, func(key int64) (err error) {
+		ss, err = sysvipc.GetSemSet(key, count, &f)
+		return
+	})
+	removeOnCleanup(t, ss.Handle())
+	return ss
+}
+
+// SharedMem creates a shared memory segment that is removed when the test
+// finishes. Create and Exclusive in flags are ignored, and Perms defaults
+// to 0600.
+func SharedMem(t testing.TB, size uint64, flags *sysvipc.SHMFlags) *sysvipc.SharedMem {
+	t.Helper()
+	var f sysvipc.SHMFlags
+	if flags != nil {
+		f = *flags
+	}
+	f.Create, f.Exclusive = true, true
+	f.Perms = perms(f.Perms)
+
+	var shm *sysvipc.SharedMem
+	create(t, func(key int64) (err error) {
+		shm, err = sysvipc.GetSharedMem(key, size, &f)
+		return
+	})
+	removeOnCleanup(t, shm.Handle())
+	return shm
+}
+
+// Attach attaches a segment, and detaches it when the test finishes.
+func Attach(t testing.TB, shm *sysvipc.SharedMem, flags *sysvipc.SHMAttachFlags) *sysvipc.SharedMemMount {
+	t.Helper()
+	mnt, err := shm.Attach(flags)
+	if err != nil {
+		t.Fatal("ipctest:", err)
+	}
+	t.Cleanup(func() { mnt.Close() })
+	return mnt
+}
+
+func removeOnCleanup(t testing.TB, h sysvipc.Handle) {
+	t.Cleanup(func() {
+		err := h.Remove()
+		if err != nil && err != syscall.EINVAL && err != syscall.EIDRM {
+			t.Errorf("ipctest: removing %s: %v", h, err)
+		}
+	})
+}
+
+// CheckLeaks fails the test if, once it and its other cleanups have
+// finished, any IPC object exists on the system that didn't when CheckLeaks
+// was called. Leaked objects are then removed.
+//
+// It should be called first thing in the test, so that its check runs after
+// every other cleanup. Since it sees objects created by anyone, it shouldn't
+// be used in tests that run in parallel with others that create objects.
+// It does nothing in a child process run by Start, leaving the check to the
+// parent.
+func CheckLeaks(t testing.TB) {
+	t.Helper()
+	if os.Getenv(subprocessEnv) != "" {
+		return
+	}
+	before, err := snapshot()
+	if err != nil {
+		t.Fatal("ipctest:", err)
+	}
+
+	t.Cleanup(func() {
+		after, err := snapshot()
+		if err != nil {
+			t.Error("ipctest:", err)
+			return
+		}
+		for h := range after {
+			if before[h] {
+				continue
+			}
+			t.Errorf("ipctest: %s left behind", h)
+			h.Remove()
+		}
+	})
+}
+
+func snapshot() (map[sysvipc.Handle]bool, error) {
+	handles, err := sysvipc.ListHandles()
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[sysvipc.Handle]bool, len(handles))
+	for _, h := range handles {
+		set[h] = true
+	}
+	return set, nil
+}
@@ -0,0 +1,210 @@
+package ipctest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/teepark/go-sysvipc"
+)
+
+func TestKey(t *testing.T) {
+	seen := make(map[int64]bool)
+	for i := 0; i < 100; i++ {
+		key := Key(t)
+		if !Tag.Owns(key) {
+			t.Errorf("key %x isn't tagged", key)
+		}
+		if seen[key] {
+			t.Errorf("key %x handed out twice", key)
+		}
+		seen[key] = true
+	}
+}
+
+func TestObjects(t *testing.T) {
+	CheckLeaks(t)
+
+	q := MsgQueue(t, nil)
+	if err := q.Send(1, []byte("hello"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ss := SemSet(t, 2, nil)
+	if err := ss.Setval(1, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	shm := SharedMem(t, 4096, &sysvipc.SHMFlags{Perms: 0640})
+	info, err := shm.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Perms.Mode&0777 != 0640 || !Tag.Owns(info.Perms.Key) {
+		t.Errorf("wrong segment: mode %o key %x", info.Perms.Mode, info.Perms.Key)
+	}
+
+	mnt := Attach(t, shm, nil)
+	if _, err := mnt.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeT collects the cleanups and errors of a test without running it.
+type fakeT struct {
+	testing.TB
+	name     string
+	cleanups []func()
+	errors   []string
+}
+
+func (ft *fakeT) Name() string      { return ft.name }
+func (ft *fakeT) Helper()           {}
+func (ft *fakeT) Cleanup(fn func()) { ft.cleanups = append(ft.cleanups, fn) }
+func (ft *fakeT) Error(args ...any) { ft.errors = append(ft.errors, fmt.Sprint(args...)) }
+func (ft *fakeT) Fatal(args ...any) { panic(fmt.Sprint(args...)) }
+func (ft *fakeT) Errorf(f string, args ...any) {
+	ft.errors = append(ft.errors, fmt.Sprintf(f, args...))
+}
+
+func (ft *fakeT) finish() {
+	for i := len(ft.cleanups) - 1; i >= 0; i-- {
+		ft.cleanups[i]()
+	}
+}
+
+func TestCheckLeaks(t *testing.T) {
+	ft := &fakeT{name: t.Name()}
+	CheckLeaks(ft)
+	MsgQueue(ft, nil)
+
+	leaked, err := sysvipc.GetSemSet(Key(t), 1, &sysvipc.SemSetFlags{
+		Create:    true,
+		Exclusive: true,
+		Perms:     0600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ft.finish()
+	if len(ft.errors) != 1 {
+		t.Fatal("expected just the semaphore set to leak:", ft.errors)
+	}
+	if _, err := sysvipc.OpenSemSetByID(leaked.ID()); err != syscall.EINVAL && err != syscall.EIDRM {
+		t.Error("leaked semaphore set wasn't removed", err)
+		leaked.Remove()
+	}
+}
+
+func TestRun(t *testing.T) {
+	CheckLeaks(t)
+	q := MsgQueue(t, nil)
+
+	Run(t, func(t *testing.T) {
+		h, err := sysvipc.HandleFromEnv("IPCTEST_QUEUE")
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err := h.MsgQueue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := fmt.Sprintf("from %d", os.Getpid())
+		if err := q.Send(7, []byte(msg), nil); err != nil {
+			t.Fatal(err)
+		}
+	}, "IPCTEST_QUEUE="+q.Handle().String())
+
+	body, mtyp, err := q.Receive(64, 0, &sysvipc.MQRecvFlags{DontWait: true})
+	if err != nil {
+		t.Fatal("nothing from the child:", err)
+	}
+	if mtyp != 7 || string(body) == fmt.Sprintf("from %d", os.Getpid()) {
+		t.Errorf("wrong message %d %q", mtyp, body)
+	}
+}
+
+func TestStartTwice(t *testing.T) {
+	q := MsgQueue(t, nil)
+	env := "IPCTEST_QUEUE=" + q.Handle().String()
+
+	send := func(mtyp int64) func(t *testing.T) {
+		return func(t *testing.T) {
+			h, _ := sysvipc.HandleFromEnv("IPCTEST_QUEUE")
+			q, err := h.MsgQueue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := q.Send(mtyp, []byte("x"), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	a := Start(t, send(1), env)
+	b := Start(t, send(2), env)
+	a.Wait()
+	b.Wait()
+
+	for _, want := range []int64{1, 2} {
+		if _, _, err := q.Receive(8, want, &sysvipc.MQRecvFlags{DontWait: true}); err != nil {
+			t.Errorf("no message of type %d: %v", want, err)
+		}
+	}
+}
+
+func TestMain(m *testing.M) {
+	Main(m)
+}
+
+func init() {
+	RegisterRole("echo", func(w *Worker) error {
+		w.Set("args", w.Args())
+		w.Signal("started")
+		if len(w.Args()) > 0 && w.Args()[0] == "fail" {
+			return errors.New("failed as asked")
+		}
+		w.SetErr("err", syscall.EAGAIN)
+		return nil
+	})
+	RegisterRole("chatty", func(w *Worker) error {
+		for i := 0; i < 1000; i++ {
+			w.Signal(strconv.Itoa(i))
+		}
+		return nil
+	})
+}
+
+func TestHarness(t *testing.T) {
+	h := NewHarness(t)
+
+	w := h.Spawn("echo", "a", "b")
+	w.Await("started")
+	res := w.Wait()
+	var args []string
+	if err := res.Get("args", &args); err != nil || len(args) != 2 || args[1] != "b" {
+		t.Errorf("args %q, %v", args, err)
+	}
+	if err := res.Errno("err"); err != syscall.EAGAIN {
+		t.Errorf("errno %v", err)
+	}
+
+	res = h.Spawn("echo", "fail").wait()
+	if res.Err != "failed as asked" || res.ExitCode() != 1 {
+		t.Errorf("failing role: %q, exit %d", res.Err, res.ExitCode())
+	}
+}
+
+func TestHarnessManyEvents(t *testing.T) {
+	h := NewHarness(t)
+
+	// nothing reads the events until the worker has exited
+	w := h.Spawn("chatty")
+	w.Wait()
+	w.Await("500")
+	w.Await("999")
+}
@@ -0,0 +1,150 @@
+package ipctest
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// child is a re-executed copy of the test binary, as used by both Start and
+// Harness.Spawn.
+type child struct {
+	cmd *exec.Cmd
+	out syncBuffer
+}
+
+// startChild re-executes the test binary with args, adding env to its
+// environment and passing files from fd 3 on.
+func startChild(args, env []string, files []*os.File) (*child, error) {
+	c := &child{cmd: exec.Command(os.Args[0], args...)}
+	c.cmd.Env = append(os.Environ(), env...)
+	c.cmd.Stdout = &c.out
+	c.cmd.Stderr = &c.out
+	c.cmd.ExtraFiles = files
+	if err := c.cmd.Start(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *child) kill() {
+	c.cmd.Process.Kill()
+}
+
+// syncBuffer is a bytes.Buffer safe to read while the process writes it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.String()
+}
+
+// subprocessEnv names the environment variable that tells a re-executed
+// test binary which Start call's body it is there to run.
+const subprocessEnv = "IPCTEST_SUBPROCESS"
+
+var (
+	startMu sync.Mutex
+	// per test rather than per name, since -test.count repeats names
+	startCalls = make(map[*testing.T]int)
+)
+
+// Subprocess is a test body running in a child process.
+type Subprocess struct {
+	t *testing.T
+	c *child
+}
+
+// Start runs body in a child process, which re-executes the test binary to
+// run just the current test. The child gets as far as the matching Start
+// call, runs body in place of starting anything, and stops there.
+//
+// So everything the test does before Start also happens in the child, and
+// objects created then are the child's own, not the parent's. The parent's
+// objects are handed over through env, which is added to the child's
+// environment (see sysvipc.Handle.Setenv and HandleFromEnv).
+//
+// The body can use t as normal, and its failures and output are reported
+// by Wait.
+func Start(t *testing.T, body func(t *testing.T), env ...string) *Subprocess {
+	t.Helper()
+
+	startMu.Lock()
+	startCalls[t]++
+	id := t.Name() + "#" + strconv.Itoa(startCalls[t])
+	startMu.Unlock()
+
+	switch os.Getenv(subprocessEnv) {
+	case id:
+		body(t)
+		if t.Failed() {
+			t.FailNow()
+		}
+		// stop the rest of the test running in the child
+		t.SkipNow()
+	case "":
+	default:
+		// the child of some other Start call
+		return &Subprocess{t: t}
+	}
+
+	c, err := startChild(
+		[]string{"-test.run=" + runPattern(t.Name()), "-test.v", "-test.count=1"},
+		append([]string{subprocessEnv + "=" + id}, env...),
+		nil,
+	)
+	if err != nil {
+		t.Fatal("ipctest:", err)
+	}
+	return &Subprocess{t: t, c: c}
+}
+
+// Wait waits for the child to exit, and fails the test with the child's
+// output if it failed.
+func (sp *Subprocess) Wait() {
+	sp.t.Helper()
+	if sp.c == nil {
+		return
+	}
+	if err := sp.c.cmd.Wait(); err != nil {
+		sp.t.Errorf("ipctest: subprocess failed (%v):\n%s", err, sp.c.out.String())
+	}
+}
+
+// Kill kills the child, for tests of what happens when a process dies.
+func (sp *Subprocess) Kill() {
+	if sp.c != nil {
+		sp.c.kill()
+		sp.c.cmd.Wait()
+	}
+}
+
+// Run runs body in a child process as Start does, and waits for it.
+func Run(t *testing.T, body func(t *testing.T), env ...string) {
+	t.Helper()
+	Start(t, body, env...).Wait()
+}
+
+// runPattern builds a -test.run pattern matching exactly one (sub)test.
+func runPattern(name string) string {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		parts[i] = "^" + regexp.QuoteMeta(part) + "$"
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,552 @@
+package sysvipc
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// ErrMetricsFull is returned when a Metrics table has no room for another
+// metric, or no free slot for another process.
+var ErrMetricsFull = errors.New("sysvipc: metrics table is full")
+
+// MetricKind says how a metric's per-process values combine.
+type MetricKind uint32
+
+const (
+	// CounterMetric only goes up. Its total includes the counts of
+	// processes that have exited.
+	CounterMetric MetricKind = 1
+
+	// GaugeMetric is summed over the processes that are still running.
+	GaugeMetric MetricKind = 2
+)
+
+func (k MetricKind) String() string {
+	switch k {
+	case CounterMetric:
+		return "counter"
+	case GaugeMetric:
+		return "gauge"
+	}
+	return "untyped"
+}
+
+// MetricsConfig holds the options for NewMetrics. Every process using the
+// same table must use the same configuration.
+type MetricsConfig struct {
+	// Processes is the number of processes that can record metrics at once
+	// (default 64).
+	Processes int
+
+	// MaxMetrics is the number of metrics that can be registered
+	// (default 128).
+	MaxMetrics int
+}
+
+func (c *MetricsConfig) withDefaults() MetricsConfig {
+	var cfg MetricsConfig
+	if c != nil {
+		cfg = *c
+	}
+	if cfg.Processes == 0 {
+		cfg.Processes = 64
+	}
+	if cfg.MaxMetrics == 0 {
+		cfg.MaxMetrics = 128
+	}
+	return cfg
+}
+
+/*
+The table is a header, the metric descriptors, then one slot of values per
+process:
+
+header:     magic uint32 | lock uint32 | processes uint32 |
+            maxMetrics uint32 | registered uint32 | unused [3]uint32
+
+descriptor: kind uint32 | name length uint32 | help length uint32 |
+            unused uint32 | name [96]byte | help [160]byte
+
+slot:       pid uint32 | unused uint32 | values [maxMetrics]uint64
+
+Slot 0 isn't a process's: it holds the counts of exited processes, folded
+in when their slots are reused. Counter values are uint64s and gauges are
+float64 bits. Registering metrics and claiming or releasing slots happen
+under the lock; values are only written by their slot's process.
+*/
+
+const (
+	metricsMagic      = 0x4d455452
+	metricsHeaderSize = 32
+	metricDescSize    = 272
+
+	// MetricNameMax and MetricHelpMax are the longest metric name (with
+	// any labels) and help text a Metrics table can hold.
+	MetricNameMax = 96
+	MetricHelpMax = 160
+)
+
+// MetricsTableSize returns the number of bytes of shared memory a Metrics
+// table needs for a configuration.
+func MetricsTableSize(cfg *MetricsConfig) uint {
+	c := cfg.withDefaults()
+	return metricsHeaderSize + uint(c.MaxMetrics)*metricDescSize +
+		uint(c.Processes+1)*metricsSlotSize(c.MaxMetrics)
+}
+
+func metricsSlotSize(maxMetrics int) uint {
+	return 8 + 8*uint(maxMetrics)
+}
+
+// Metrics is a registry of counters and gauges in shared memory, for
+// cooperating processes (such as a pre-forked server's workers) to record
+// into and any of them to export the totals of. Each process that records
+// gets its own slot of values, so updates are uncontended atomic adds with
+// no locking; reading sums the slots.
+//
+// Metrics implements http.Handler, serving the totals in the Prometheus
+// text exposition format.
+type Metrics struct {
+	table *SharedMemMount
+	cfg   MetricsConfig
+	lock  *Mutex
+
+	mu   sync.Mutex
+	slot int
+}
+
+// NewMetrics creates a Metrics over table, which must be at least
+// MetricsTableSize bytes and zero-filled (as a new segment is) or already set
+// up by another process.
+func NewMetrics(table *SharedMemMount, cfg *MetricsConfig) (*Metrics, error) {
+	c := cfg.withDefaults()
+	if c.Processes < 1 || c.MaxMetrics < 1 {
+		return nil, errors.New("sysvipc: metrics table needs room for processes and metrics")
+	}
+	if table.readonly {
+		return nil, ErrReadOnlyShm
+	}
+	if table.length < MetricsTableSize(&c) {
+		return nil, errors.New("sysvipc: shared memory too small for metrics table")
+	}
+
+	lock, err := NewRobustMutex(table, 4)
+	if err != nil {
+		return nil, err
+	}
+	m := &Metrics{table: table, cfg: c, lock: lock}
+
+	hdr := m.header()
+	ok, err := setupHeader(&hdr[0], metricsMagic,
+		headerField{&hdr[2], uint32(c.Processes)},
+		headerField{&hdr[3], uint32(c.MaxMetrics)},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("sysvipc: metrics table was set up with a different configuration")
+	}
+
+	return m, nil
+}
+
+// Counter registers a counter, or finds the one already registered under
+// name, and returns this process's handle on it.
+//
+// The name may end in a Prometheus label set, as in
+// `requests_total{code="200"}`, to record one series of a labelled metric.
+// Series of the same metric share the help text of the first registered,
+// and must all be of the same kind.
+func (m *Metrics) Counter(name, help string) (*Counter, error) {
+	v, err := m.register(name, help, CounterMetric)
+	if err != nil {
+		return nil, err
+	}
+	return &Counter{v}, nil
+}
+
+// Gauge registers a gauge, or finds the one already registered under name,
+// and returns this process's handle on it. The exported value is the sum
+// over running processes, so each sets only its own share. Names are as for
+// Counter.
+func (m *Metrics) Gauge(name, help string) (*Gauge, error) {
+	v, err := m.register(name, help, GaugeMetric)
+	if err != nil {
+		return nil, err
+	}
+	return &Gauge{v}, nil
+}
+
+// Counter is one process's share of a counter metric.
+type Counter struct {
+	v *uint64
+}
+
+// Inc adds 1 to the counter.
+func (c *Counter) Inc() {
+	atomic.AddUint64(c.v, 1)
+}
+
+// Add adds n to the counter.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(c.v, n)
+}
+
+// Gauge is one process's share of a gauge metric.
+type Gauge struct {
+	v *uint64
+}
+
+// Set sets this process's share of the gauge.
+func (g *Gauge) Set(f float64) {
+	atomic.StoreUint64(g.v, math.Float64bits(f))
+}
+
+// Add adds delta (which may be negative) to this process's share.
+func (g *Gauge) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(g.v)
+		if atomic.CompareAndSwapUint64(g.v, old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+// Inc adds 1 to this process's share of the gauge.
+func (g *Gauge) Inc() { g.Add(1) }
+
+// Dec subtracts 1 from this process's share of the gauge.
+func (g *Gauge) Dec() { g.Add(-1) }
+
+// MetricValue is a metric's total across processes.
+type MetricValue struct {
+	Name  string
+	Help  string
+	Kind  MetricKind
+	Value float64
+}
+
+// Snapshot returns the totals of every registered metric, sorted by name.
+func (m *Metrics) Snapshot() ([]MetricValue, error) {
+	if err := m.acquire(); err != nil {
+		return nil, err
+	}
+	defer m.lock.Unlock()
+
+	n := int(atomic.LoadUint32(&m.header()[4]))
+	values := make([]MetricValue, n)
+	helps := make(map[string]string)
+	for i := range values {
+		name, help, kind := m.desc(i)
+		values[i] = MetricValue{Name: name, Kind: kind}
+		if help != "" {
+			helps[metricBase(name)] = help
+		}
+	}
+	for i := range values {
+		values[i].Help = helps[metricBase(values[i].Name)]
+	}
+
+	for s := 0; s <= m.cfg.Processes; s++ {
+		pid := int(atomic.LoadUint32(m.slotPID(s)))
+		if s > 0 && pid == 0 {
+			continue
+		}
+		// dead processes' counts stand until their slot is reused, but
+		// their gauges go with them
+		live := s > 0 && processAlive(pid)
+		for i := range values {
+			raw := atomic.LoadUint64(m.value(s, i))
+			switch values[i].Kind {
+			case CounterMetric:
+				values[i].Value += float64(raw)
+			case GaugeMetric:
+				if live {
+					values[i].Value += math.Float64frombits(raw)
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		bi, bj := metricBase(values[i].Name), metricBase(values[j].Name)
+		if bi != bj {
+			return bi < bj
+		}
+		return values[i].Name < values[j].Name
+	})
+	return values, nil
+}
+
+// WritePrometheus writes the totals in the Prometheus text exposition
+// format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	values, err := m.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	last := ""
+	for _, v := range values {
+		if base := metricBase(v.Name); base != last {
+			if v.Help != "" {
+				bw.WriteString("# HELP " + base + " " + escapeHelp(v.Help) + "\n")
+			}
+			bw.WriteString("# TYPE " + base + " " + v.Kind.String() + "\n")
+			last = base
+		}
+		bw.WriteString(v.Name + " " + strconv.FormatFloat(v.Value, 'g', -1, 64) + "\n")
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves the totals for a Prometheus scrape.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := m.WritePrometheus(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Close gives up this process's slot, adding its counts to those of exited
+// processes and dropping its gauges. Its Counters and Gauges must not be
+// used afterwards.
+func (m *Metrics) Close() error {
+	if err := m.acquire(); err != nil {
+		return err
+	}
+	defer m.lock.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.slot == 0 {
+		return nil
+	}
+	m.retire(m.slot)
+	m.slot = 0
+	return nil
+}
+
+func (m *Metrics) register(name, help string, kind MetricKind) (*uint64, error) {
+	if !validMetricName(name) {
+		return nil, errors.New("sysvipc: invalid metric name " + strconv.Quote(name))
+	}
+	if len(help) > MetricHelpMax {
+		return nil, errors.New("sysvipc: metric help text too long")
+	}
+
+	if err := m.acquire(); err != nil {
+		return nil, err
+	}
+	defer m.lock.Unlock()
+
+	slot, err := m.ownSlot()
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := m.header()
+	n := int(hdr[4])
+	base := metricBase(name)
+	for i := 0; i < n; i++ {
+		got, _, k := m.desc(i)
+		if metricBase(got) != base {
+			continue
+		}
+		if k != kind {
+			return nil, errors.New("sysvipc: metric " + base + " already registered as a " + k.String())
+		}
+		if got == name {
+			return m.value(slot, i), nil
+		}
+		// the help text belongs to the series registered first
+		help = ""
+	}
+	if n == m.cfg.MaxMetrics {
+		return nil, ErrMetricsFull
+	}
+
+	d := m.descPtr(n)
+	words := (*[4]uint32)(d)
+	words[0] = uint32(kind)
+	words[1] = uint32(len(name))
+	words[2] = uint32(len(help))
+	copy(unsafe.Slice((*byte)(unsafe.Add(d, 16)), MetricNameMax), name)
+	copy(unsafe.Slice((*byte)(unsafe.Add(d, 16+MetricNameMax)), MetricHelpMax), help)
+	atomic.StoreUint32(&hdr[4], uint32(n+1))
+
+	return m.value(slot, n), nil
+}
+
+// ownSlot returns this process's slot, claiming one first if need be. It
+// must be called with the lock held.
+func (m *Metrics) ownSlot() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.slot != 0 {
+		return m.slot, nil
+	}
+
+	free := 0
+	for s := 1; s <= m.cfg.Processes; s++ {
+		pid := int(atomic.LoadUint32(m.slotPID(s)))
+		if pid == 0 {
+			free = s
+			break
+		}
+		if free == 0 && !processAlive(pid) {
+			free = s
+		}
+	}
+	if free == 0 {
+		return 0, ErrMetricsFull
+	}
+
+	if atomic.LoadUint32(m.slotPID(free)) != 0 {
+		m.retire(free)
+	}
+	atomic.StoreUint32(m.slotPID(free), uint32(os.Getpid()))
+	m.slot = free
+	return free, nil
+}
+
+// retire folds a slot's counts into slot 0 and frees it. It must be called
+// with the lock held.
+func (m *Metrics) retire(s int) {
+	n := int(atomic.LoadUint32(&m.header()[4]))
+	for i := 0; i < m.cfg.MaxMetrics; i++ {
+		v := atomic.SwapUint64(m.value(s, i), 0)
+		if i < n && v != 0 {
+			if _, _, kind := m.desc(i); kind == CounterMetric {
+				atomic.AddUint64(m.value(0, i), v)
+			}
+		}
+	}
+	atomic.StoreUint32(m.slotPID(s), 0)
+}
+
+// acquire takes the table lock. A previous holder dying is no matter, since
+// nothing it did under the lock is left half-visible.
+func (m *Metrics) acquire() error {
+	if err := m.lock.Lock(); err != nil && err != ErrOwnerDead {
+		return err
+	}
+	return nil
+}
+
+func (m *Metrics) header() *[8]uint32 {
+	return (*[8]uint32)(m.table.ptr)
+}
+
+func (m *Metrics) descPtr(i int) unsafe.Pointer {
+	return unsafe.Add(m.table.ptr, metricsHeaderSize+i*metricDescSize)
+}
+
+func (m *Metrics) desc(i int) (name, help string, kind MetricKind) {
+	d := m.descPtr(i)
+	words := (*[4]uint32)(d)
+	name = string(unsafe.Slice((*byte)(unsafe.Add(d, 16)), words[1]))
+	help = string(unsafe.Slice((*byte)(unsafe.Add(d, 16+MetricNameMax)), words[2]))
+	return name, help, MetricKind(words[0])
+}
+
+func (m *Metrics) slotPtr(s int) unsafe.Pointer {
+	offset := metricsHeaderSize + m.cfg.MaxMetrics*metricDescSize + s*int(metricsSlotSize(m.cfg.MaxMetrics))
+	return unsafe.Add(m.table.ptr, offset)
+}
+
+func (m *Metrics) slotPID(s int) *uint32 {
+	return (*uint32)(m.slotPtr(s))
+}
+
+func (m *Metrics) value(s, i int) *uint64 {
+	return (*uint64)(unsafe.Add(m.slotPtr(s), 8+8*i))
+}
+
+// metricBase strips any label set from a metric name.
+func metricBase(name string) string {
+	if i := strings.IndexByte(name, '{'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// validMetricName checks for a Prometheus metric name, optionally followed
+// by a brace-enclosed label set.
+func validMetricName(name string) bool {
+	if name == "" || len(name) > MetricNameMax || strings.ContainsRune(name, '\n') {
+		return false
+	}
+	base := metricBase(name)
+	if labels := name[len(base):]; labels != "" && !validLabels(labels) {
+		return false
+	}
+	for i, c := range base {
+		switch {
+		case c == '_' || c == ':' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return base != ""
+}
+
+// validLabels checks for a label set as Prometheus writes it:
+// {name="value",...}, with \\, \" and \n the only escapes in values.
+func validLabels(s string) bool {
+	if len(s) < 2 || s[0] != '{' || s[len(s)-1] != '}' {
+		return false
+	}
+	s = s[1 : len(s)-1]
+	for s != "" {
+		i := 0
+		for i < len(s) && (s[i] == '_' || 'a' <= s[i] && s[i] <= 'z' || 'A' <= s[i] && s[i] <= 'Z' ||
+			i > 0 && '0' <= s[i] && s[i] <= '9') {
+			i++
+		}
+		if i == 0 || !strings.HasPrefix(s[i:], `="`) {
+			return false
+		}
+		s = s[i+2:]
+		for {
+			if s == "" {
+				return false
+			}
+			c := s[0]
+			s = s[1:]
+			if c == '"' {
+				break
+			}
+			if c == '\\' {
+				if s == "" || s[0] != '\\' && s[0] != '"' && s[0] != 'n' {
+					return false
+				}
+				s = s[1:]
+			}
+		}
+		if s != "" {
+			if s[0] != ',' || len(s) == 1 {
+				return false
+			}
+			s = s[1:]
+		}
+	}
+	return true
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,266 @@
+package sysvipc
+
+import (
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func metricsTable(t *testing.T, cfg *MetricsConfig) *SharedMemMount {
+	shm, err := GetSharedMem(0, uint64(MetricsTableSize(cfg)), &SHMFlags{Create: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shm.Remove()
+	mnt, err := shm.Attach(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mnt.Close() })
+	return mnt
+}
+
+func metricTotals(t *testing.T, m *Metrics) map[string]float64 {
+	values, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	totals := make(map[string]float64)
+	for _, v := range values {
+		totals[v.Name] = v.Value
+	}
+	return totals
+}
+
+func TestMetrics(t *testing.T) {
+	mnt := metricsTable(t, nil)
+
+	// two Metrics on one table get separate slots, as two processes would
+	a, err := NewMetrics(mnt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewMetrics(mnt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := a.Counter("requests_total", "Requests served.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb, err := b.Counter("requests_total", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ga, _ := a.Gauge("in_flight", "")
+	gb, _ := b.Gauge("in_flight", "")
+
+	ca.Add(5)
+	cb.Inc()
+	ga.Set(2.5)
+	gb.Inc()
+	gb.Inc()
+	gb.Dec()
+
+	totals := metricTotals(t, a)
+	if totals["requests_total"] != 6 || totals["in_flight"] != 3.5 {
+		t.Errorf("wrong totals %v", totals)
+	}
+
+	if _, err := a.Gauge("requests_total", ""); err == nil {
+		t.Error("re-registering a counter as a gauge should fail")
+	}
+	for _, name := range []string{
+		"", "9lives", "has space", "open{", `x{a="b"`, "é",
+		`x{a=b}`, `x{="b"}`, `x{9a="b"}`, `x{a="b}`, `x{a="b",}`, `x{a="b"c="d"}`,
+		`x{a="\q"}`, `x{a="b"}}`, `x{a-b="c"}`,
+	} {
+		if _, err := a.Counter(name, ""); err == nil {
+			t.Errorf("%q should be an invalid name", name)
+		}
+	}
+
+	if _, err := NewMetrics(mnt, &MetricsConfig{Processes: 3}); err == nil {
+		t.Error("opening with a different configuration should fail")
+	}
+}
+
+func TestMetricsClose(t *testing.T) {
+	mnt := metricsTable(t, &MetricsConfig{Processes: 1})
+
+	a, err := NewMetrics(mnt, &MetricsConfig{Processes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := a.Counter("jobs_total", "")
+	g, _ := a.Gauge("workers", "")
+	c.Add(7)
+	g.Set(1)
+
+	b, err := NewMetrics(mnt, &MetricsConfig{Processes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Counter("jobs_total", ""); err != ErrMetricsFull {
+		t.Fatal("the only slot is taken, but got", err)
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	totals := metricTotals(t, b)
+	if totals["jobs_total"] != 7 || totals["workers"] != 0 {
+		t.Errorf("after Close: %v", totals)
+	}
+
+	c, err = b.Counter("jobs_total", "")
+	if err != nil {
+		t.Fatal("the slot should be free again:", err)
+	}
+	c.Inc()
+	if totals := metricTotals(t, b); totals["jobs_total"] != 8 {
+		t.Errorf("after reusing the slot: %v", totals)
+	}
+}
+
+func TestMetricsDeadProcess(t *testing.T) {
+	cfg := &MetricsConfig{Processes: 1}
+	mnt := metricsTable(t, cfg)
+
+	dead, err := NewMetrics(mnt, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := dead.Counter("jobs_total", "")
+	g, _ := dead.Gauge("workers", "")
+	c.Add(3)
+	g.Set(1)
+
+	// pretend the slot belonged to a process that has exited
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	*dead.slotPID(dead.slot) = uint32(cmd.Process.Pid)
+
+	m, err := NewMetrics(mnt, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if totals := metricTotals(t, m); totals["jobs_total"] != 3 || totals["workers"] != 0 {
+		t.Errorf("with a dead process: %v", totals)
+	}
+
+	// taking over its slot keeps its count
+	c, err = m.Counter("jobs_total", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Inc()
+	if totals := metricTotals(t, m); totals["jobs_total"] != 4 {
+		t.Errorf("after taking over the slot: %v", totals)
+	}
+}
+
+func TestMetricsFull(t *testing.T) {
+	cfg := &MetricsConfig{MaxMetrics: 2}
+	m, err := NewMetrics(metricsTable(t, cfg), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Counter("a", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Gauge("b", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Counter("c", ""); err != ErrMetricsFull {
+		t.Error("should be out of room", err)
+	}
+	if _, err := m.Counter("a", ""); err != nil {
+		t.Error("finding an existing metric should still work", err)
+	}
+
+	if _, err := NewMetrics(metricsTable(t, cfg), nil); err == nil {
+		t.Error("a table too small for the default config should fail")
+	}
+}
+
+func TestMetricsPrometheus(t *testing.T) {
+	m, err := NewMetrics(metricsTable(t, nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, _ := m.Counter(`http_requests_total{code="200"}`, "Requests by status.\nSee \\docs.")
+	g, _ := m.Gauge("temperature", "")
+	notFound, _ := m.Counter(`http_requests_total{code="404"}`, "")
+	ok.Add(10)
+	notFound.Inc()
+	g.Set(-1.5)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := `# HELP http_requests_total Requests by status.\nSee \\docs.
+# TYPE http_requests_total counter
+http_requests_total{code="200"} 10
+http_requests_total{code="404"} 1
+# TYPE temperature gauge
+temperature -1.5
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Error("wrong content type", ct)
+	}
+}
+
+func TestMetricsPrometheusSeries(t *testing.T) {
+	m, err := NewMetrics(metricsTable(t, nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first series registered sets the help, even if it sorts later
+	c404, err := m.Counter(`errors_total{code="404",path="/a\"b\\c\n"}`, "Errors served.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c500, err := m.Counter(`errors_total{code="500"}`, "Something else.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Gauge(`errors_total{code="503"}`, ""); err == nil {
+		t.Error("a gauge series of a counter should be rejected")
+	}
+	if _, err := m.Gauge("errors_total", ""); err == nil {
+		t.Error("a gauge under a counter's name should be rejected")
+	}
+	c404.Inc()
+	c500.Add(2)
+
+	var sb strings.Builder
+	if err := m.WritePrometheus(&sb); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP errors_total Errors served.
+# TYPE errors_total counter
+errors_total{code="404",path="/a\"b\\c\n"} 1
+errors_total{code="500"} 2
+`
+	if got := sb.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	values, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range values {
+		if v.Help != "Errors served." {
+			t.Errorf("%s has help %q", v.Name, v.Help)
+		}
+	}
+}
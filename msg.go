@@ -1,6 +1,7 @@
 package sysvipc
 
 /*
+#define _GNU_SOURCE // for IPC_INFO and struct msginfo
 #include <sys/types.h>
 #include <sys/ipc.h>
 #include <sys/msg.h>
@@ -8,47 +9,100 @@ int msgget(key_t key, int msgflg);
 int msgsnd(int msqid, const void *msgp, size_t msgsz, int msgflg);
 ssize_t msgrcv(int msqid, void *msgp, size_t msgsz, long msgtyp, int msgflg);
 int msgctl(int msqid, int cmd, struct msqid_ds *buf);
+int msgctl_info(struct msginfo *buf) {
+	return msgctl(0, IPC_INFO, (struct msqid_ds *)buf);
+};
 */
 import "C"
 import (
+	"math"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 )
 
+// DefaultMsgMax is the kernel's default msgmax, the largest message body a
+// queue accepts unless /proc/sys/kernel/msgmax has been raised.
+const DefaultMsgMax = 8192
+
 // MessageQueue is a kernel-maintained queue.
 type MessageQueue int64
 
 // GetMsgQueue creates or retrieves a message queue id for a given IPC key.
 func GetMsgQueue(key int64, flags *MQFlags) (MessageQueue, error) {
+	ob := observe()
 	rc, err := C.msgget(C.key_t(key), C.int(flags.flags()))
+	ob.done(OpMsgGet, int64(rc), 0, rc == -1, err)
 	if rc == -1 {
 		return -1, err
 	}
 	return MessageQueue(rc), nil
 }
 
+// OpenMsgQueueByID returns the message queue with a kernel id, such as one
+// passed down from a parent process or listed by ipcs. It fails if there is
+// no such queue or the caller isn't allowed to read it.
+func OpenMsgQueueByID(id int64) (MessageQueue, error) {
+	mq := MessageQueue(id)
+	if _, err := mq.Stat(); err != nil {
+		return -1, err
+	}
+	return mq, nil
+}
+
+// ID returns the kernel's id for the queue.
+func (mq MessageQueue) ID() int64 {
+	return int64(mq)
+}
+
 // Send places a new message onto the queue
 func (mq MessageQueue) Send(mtyp int64, body []byte, flags *MQSendFlags) error {
 	b := make([]byte, len(body)+8)
 	copy(b[:8], serialize(mtyp))
 	copy(b[8:], body)
 
+	ob := observe()
 	rc, err := C.msgsnd(
 		C.int(mq),
 		unsafe.Pointer(&b[0]),
 		C.size_t(len(body)),
 		C.int(flags.flags()),
 	)
+	ob.done(OpMsgSend, int64(mq), len(body), rc == -1, err)
 	if rc == -1 {
 		return err
 	}
 	return nil
 }
 
-// Receive retrieves a message from the queue.
+// Receive retrieves a message from the queue. A maxlen over math.MaxInt32,
+// more than any msgmax setting allows, fails with syscall.EINVAL.
+//
+// No more than the system's msgmax is allocated, however large maxlen is.
+// msgmax is read once, and again only when a message turns out to be longer,
+// so with Truncate set a message sent after msgmax was raised may be cut to
+// the old limit.
 func (mq MessageQueue) Receive(maxlen uint, msgtyp int64, flags *MQRecvFlags) ([]byte, int64, error) {
+	if maxlen > math.MaxInt32 {
+		return nil, 0, syscall.EINVAL
+	}
+
+	size := min(maxlen, msgMax())
+	body, mtyp, err := mq.receive(size, msgtyp, flags)
+	if err == syscall.E2BIG && size < maxlen {
+		// msgmax has been raised since it was read
+		if m := readMsgMax(); m > size {
+			return mq.receive(min(maxlen, m), msgtyp, flags)
+		}
+	}
+	return body, mtyp, err
+}
+
+func (mq MessageQueue) receive(maxlen uint, msgtyp int64, flags *MQRecvFlags) ([]byte, int64, error) {
 	b := make([]byte, maxlen+8)
 
+	ob := observe()
 	rc, err := C.msgrcv(
 		C.int(mq),
 		unsafe.Pointer(&b[0]),
@@ -56,6 +110,7 @@ func (mq MessageQueue) Receive(maxlen uint, msgtyp int64, flags *MQRecvFlags) ([
 		C.long(msgtyp),
 		C.int(flags.flags()),
 	)
+	ob.done(OpMsgReceive, int64(mq), int(rc), rc == -1, err)
 	if rc == -1 {
 		return nil, 0, err
 	}
@@ -64,35 +119,62 @@ func (mq MessageQueue) Receive(maxlen uint, msgtyp int64, flags *MQRecvFlags) ([
 	return b[8 : rc+8], mtyp, nil
 }
 
+// cachedMsgMax is the system's msgmax as last read, or 0 before the first
+// read.
+var cachedMsgMax atomic.Uint64
+
+// msgMax returns the system's msgmax, reading it the first time.
+func msgMax() uint {
+	if m := cachedMsgMax.Load(); m != 0 {
+		return uint(m)
+	}
+	return readMsgMax()
+}
+
+// readMsgMax reads and caches the system's msgmax. If it can't be read there
+// is taken to be no limit short of math.MaxInt32.
+func readMsgMax() uint {
+	var info C.struct_msginfo
+	ob := observe()
+	rc, err := C.msgctl_info(&info)
+	ob.done(OpMsgInfo, 0, 0, rc == -1, err)
+
+	m := uint64(math.MaxInt32)
+	if rc != -1 && info.msgmax > 0 {
+		m = uint64(info.msgmax)
+	}
+	cachedMsgMax.Store(m)
+	return uint(m)
+}
+
 // Stat produces information about the queue.
 func (mq MessageQueue) Stat() (*MQInfo, error) {
 	mqds := C.struct_msqid_ds{}
 
+	ob := observe()
 	rc, err := C.msgctl(C.int(mq), C.IPC_STAT, &mqds)
+	ob.done(OpMsgStat, int64(mq), 0, rc == -1, err)
 	if rc == -1 {
 		return nil, err
 	}
 
 	mqinf := MQInfo{
-		Perms: IpcPerms{
-			OwnerUID:   int(mqds.msg_perm.uid),
-			OwnerGID:   int(mqds.msg_perm.gid),
-			CreatorUID: int(mqds.msg_perm.cuid),
-			CreatorGID: int(mqds.msg_perm.cgid),
-			Mode:       uint16(mqds.msg_perm.mode),
-		},
-		LastSend:   time.Unix(int64(mqds.msg_stime), 0),
-		LastRcv:    time.Unix(int64(mqds.msg_rtime), 0),
-		LastChange: time.Unix(int64(mqds.msg_ctime), 0),
-		MsgCount:   uint(mqds.msg_qnum),
-		MaxBytes:   uint(mqds.msg_qbytes),
-		LastSender: int(mqds.msg_lspid),
-		LastRcver:  int(mqds.msg_lrpid),
+		Perms:        ipcPerms(&mqds.msg_perm),
+		LastSend:     ipcTime(int64(mqds.msg_stime)),
+		LastRcv:      ipcTime(int64(mqds.msg_rtime)),
+		LastChange:   ipcTime(int64(mqds.msg_ctime)),
+		MsgCount:     uint(mqds.msg_qnum),
+		MaxBytes:     uint(mqds.msg_qbytes),
+		CurrentBytes: uint(mqds.__msg_cbytes),
+		LastSender:   int(mqds.msg_lspid),
+		LastRcver:    int(mqds.msg_lrpid),
 	}
 	return &mqinf, nil
 }
 
-// Set updates parameters of the queue.
+// Set updates parameters of the queue. Every settable field (owner, mode
+// and MaxBytes) is written, so start from Stat or use Update to change some
+// of them.
 func (mq MessageQueue) Set(mqi *MQInfo) error {
 	mqds := &C.struct_msqid_ds{
 		msg_perm: C.struct_ipc_perm{
@@ -103,17 +185,49 @@ func (mq MessageQueue) Set(mqi *MQInfo) error {
 		msg_qbytes: C.msglen_t(mqi.MaxBytes),
 	}
 
+	ob := observe()
 	rc, err := C.msgctl(C.int(mq), C.IPC_SET, mqds)
+	ob.done(OpMsgSet, int64(mq), 0, rc == -1, err)
 	if rc == -1 {
 		return err
 	}
 	return nil
 }
 
+// Update reads the queue's parameters, passes them to fn for changes, and
+// writes them back. Fields fn leaves alone keep their current values.
+func (mq MessageQueue) Update(fn func(*MQInfo)) error {
+	mqi, err := mq.Stat()
+	if err != nil {
+		return err
+	}
+	fn(mqi)
+	return mq.Set(mqi)
+}
+
+// Chmod changes the permission bits (rwxrwxrwx) of the queue.
+func (mq MessageQueue) Chmod(perms int) error {
+	return mq.Update(func(mqi *MQInfo) { mqi.Perms.Mode = uint16(perms) })
+}
+
+// Chown changes the owner of the queue. A uid or gid of -1 leaves that value
+// unchanged.
+func (mq MessageQueue) Chown(uid, gid int) error {
+	return mq.Update(func(mqi *MQInfo) { chown(&mqi.Perms, uid, gid) })
+}
+
+// SetMaxBytes changes the maximum number of bytes the queue will hold.
+// Raising it above msgmnb requires CAP_SYS_RESOURCE.
+func (mq MessageQueue) SetMaxBytes(n uint) error {
+	return mq.Update(func(mqi *MQInfo) { mqi.MaxBytes = n })
+}
+
 // Remove deletes the queue.
 // This will also awake all waiting readers and writers with EIDRM.
 func (mq MessageQueue) Remove() error {
+	ob := observe()
 	rc, err := C.msgctl(C.int(mq), C.IPC_RMID, nil)
+	ob.done(OpMsgRemove, int64(mq), 0, rc == -1, err)
 	if rc == -1 {
 		return err
 	}
@@ -121,14 +235,16 @@ func (mq MessageQueue) Remove() error {
 }
 
 // MQInfo holds meta information about a message queue.
+// Times are the zero time.Time if the event hasn't happened yet.
 type MQInfo struct {
 	Perms      IpcPerms
 	LastSend   time.Time
 	LastRcv    time.Time
 	LastChange time.Time
 
-	MsgCount uint
-	MaxBytes uint
+	MsgCount     uint
+	MaxBytes     uint
+	CurrentBytes uint
 
 	LastSender int
 	LastRcver  int
@@ -217,10 +333,7 @@ real c-style pointer casting
 
 func serialize(num int64) []byte {
 	b := make([]byte, 8)
-	base := uintptr(unsafe.Pointer(&num))
-	for i := 0; i < 8; i++ {
-		b[i] = *(*byte)(unsafe.Pointer(base + uintptr(i)))
-	}
+	*(*int64)(unsafe.Pointer(&b[0])) = num
 	return b
 }
 
@@ -1,7 +1,11 @@
 package sysvipc
 
 import (
+	"bytes"
+	"fmt"
+	"math"
 	"os"
+	"runtime"
 	"syscall"
 	"testing"
 )
@@ -39,20 +43,7 @@ func TestNonBlockingSend(t *testing.T) {
 	msgSetup(t)
 	defer msgTeardown(t)
 
-	info, err := q.Stat()
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	err = q.Set(&MQInfo{
-		Perms: IpcPerms{
-			OwnerUID: info.Perms.OwnerUID,
-			OwnerGID: info.Perms.OwnerGID,
-			Mode:     info.Perms.Mode,
-		},
-		MaxBytes: 8,
-	})
-	if err != nil {
+	if err := q.SetMaxBytes(8); err != nil {
 		t.Fatal(err)
 	}
 
@@ -128,6 +119,88 @@ func TestMSGStats(t *testing.T) {
 	}
 }
 
+func TestMSGStatDetails(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	info, err := q.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Perms.Key != 0xDA7ABA5E {
+		t.Errorf("wrong key: %x", info.Perms.Key)
+	}
+	if !info.LastSend.IsZero() || !info.LastRcv.IsZero() {
+		t.Error("send/receive times set before any traffic:", info.LastSend, info.LastRcv)
+	}
+	if info.LastChange.IsZero() {
+		t.Error("creation didn't set the change time")
+	}
+	if info.CurrentBytes != 0 {
+		t.Error("phantom bytes:", info.CurrentBytes)
+	}
+
+	if err := q.Send(4, []byte("eleven byte"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err = q.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.CurrentBytes != 11 {
+		t.Error("wrong byte count:", info.CurrentBytes)
+	}
+	if info.LastSend.IsZero() || !info.LastRcv.IsZero() {
+		t.Error("wrong times after send:", info.LastSend, info.LastRcv)
+	}
+}
+
+func TestMSGUpdate(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	before, err := q.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Chmod(0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SetMaxBytes(before.MaxBytes / 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Chown(-1, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := q.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Perms.Mode&0777 != 0640 {
+		t.Errorf("wrong mode: %o", info.Perms.Mode)
+	}
+	if info.MaxBytes != before.MaxBytes/2 {
+		t.Error("wrong max bytes:", info.MaxBytes)
+	}
+	if info.Perms.OwnerUID != before.Perms.OwnerUID || info.Perms.OwnerGID != before.Perms.OwnerGID {
+		t.Error("owner changed:", info.Perms.OwnerUID, info.Perms.OwnerGID)
+	}
+
+	err = q.Update(func(mqi *MQInfo) { mqi.MaxBytes = 100 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err = q.Stat(); err != nil {
+		t.Fatal(err)
+	}
+	if info.MaxBytes != 100 || info.Perms.Mode&0777 != 0640 {
+		t.Errorf("Update didn't preserve other fields: %d %o", info.MaxBytes, info.Perms.Mode)
+	}
+}
+
 func TestMSGSet(t *testing.T) {
 	msgSetup(t)
 	defer msgTeardown(t)
@@ -199,3 +272,191 @@ func msgTeardown(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// benchMsgSizes are the message sizes benchmarked, up to the default
+// msgmax.
+var benchMsgSizes = []int{16, 256, 2048, 8192}
+
+func benchMsgQueue(b *testing.B, ns Namespace) Queue {
+	q, err := ns.GetMsgQueue(0, &MQFlags{Create: true, Perms: 0600})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { q.Remove() })
+	return q
+}
+
+// BenchmarkMsgRoundTrip measures the latency of a Send followed by the
+// Receive of the same message.
+func BenchmarkMsgRoundTrip(b *testing.B) {
+	backends(b, func(b *testing.B, ns Namespace) {
+		for _, size := range benchMsgSizes {
+			b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+				q := benchMsgQueue(b, ns)
+				body := make([]byte, size)
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					if err := q.Send(1, body, nil); err != nil {
+						b.Fatal(err)
+					}
+					if _, _, err := q.Receive(uint(size), 0, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	})
+}
+
+// BenchmarkMsgThroughput measures a sender and a receiver streaming
+// messages through a queue at the same time.
+func BenchmarkMsgThroughput(b *testing.B) {
+	backends(b, func(b *testing.B, ns Namespace) {
+		for _, size := range benchMsgSizes {
+			b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+				q := benchMsgQueue(b, ns)
+				body := make([]byte, size)
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+
+				errs := make(chan error, 1)
+				go func() {
+					for i := 0; i < b.N; i++ {
+						if err := q.Send(1, body, nil); err != nil {
+							errs <- err
+							return
+						}
+					}
+					errs <- nil
+				}()
+				for i := 0; i < b.N; i++ {
+					if _, _, err := q.Receive(uint(size), 0, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := <-errs; err != nil {
+					b.Fatal(err)
+				}
+			})
+		}
+	})
+}
+
+// FuzzSendReceive sends a message and receives with the given options, on
+// a kernel queue and a Fake's, checking they agree and that what comes out
+// is what went in.
+func FuzzSendReceive(f *testing.F) {
+	f.Add(int64(1), []byte("hello"), uint64(64), int64(0), false)
+	f.Add(int64(3), []byte("hello"), uint64(2), int64(3), false)
+	f.Add(int64(3), []byte("hello"), uint64(2), int64(-3), true)
+	f.Add(int64(5), []byte{}, uint64(0), int64(4), false)
+	f.Add(int64(0), []byte("x"), uint64(8), int64(0), false)
+	f.Add(int64(math.MaxInt64), []byte("max"), uint64(8), int64(math.MinInt64), false)
+	f.Add(int64(7), make([]byte, fakeMsgMax+1), uint64(8), int64(0), true)
+	f.Add(int64(2), []byte("big"), uint64(1<<30), int64(0), false)
+	f.Add(int64(2), []byte("too big"), uint64(math.MaxInt32+1), int64(0), false)
+	f.Add(int64(2), []byte("wraps"), uint64(math.MaxUint64), int64(0), false)
+
+	var queues []Queue
+	for _, ns := range []Namespace{Kernel, NewFake()} {
+		q, err := ns.GetMsgQueue(0, &MQFlags{Create: true, Perms: 0600})
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Cleanup(func() { q.Remove() })
+		queues = append(queues, q)
+	}
+
+	type result struct {
+		sendErr, recvErr error
+		body             []byte
+		mtyp             int64
+	}
+
+	f.Fuzz(func(t *testing.T, mtyp int64, body []byte, maxlen uint64, msgtyp int64, truncate bool) {
+		var results []result
+		for _, q := range queues {
+			var r result
+			r.sendErr = q.Send(mtyp, body, &MQSendFlags{DontWait: true})
+			r.body, r.mtyp, r.recvErr = q.Receive(uint(maxlen), msgtyp, &MQRecvFlags{
+				DontWait: true,
+				Truncate: truncate,
+			})
+			// leave it empty for the next input
+			for {
+				if _, _, err := q.Receive(fakeMsgMax, 0, &MQRecvFlags{DontWait: true}); err != nil {
+					break
+				}
+			}
+			results = append(results, r)
+
+			if r.sendErr == nil && r.recvErr == nil {
+				want := body
+				if uint64(len(want)) > maxlen {
+					want = want[:maxlen]
+				}
+				if r.mtyp != mtyp || !bytes.Equal(r.body, want) {
+					t.Fatalf("received %q (type %d), want %q (type %d)", r.body, r.mtyp, want, mtyp)
+				}
+			}
+		}
+
+		kernel, fake := results[0], results[1]
+		if kernel.sendErr != fake.sendErr || kernel.recvErr != fake.recvErr {
+			t.Fatalf("kernel errors %v, %v; fake %v, %v", kernel.sendErr, kernel.recvErr, fake.sendErr, fake.recvErr)
+		}
+		if kernel.mtyp != fake.mtyp || !bytes.Equal(kernel.body, fake.body) {
+			t.Fatalf("kernel received %q (type %d), fake %q (type %d)", kernel.body, kernel.mtyp, fake.body, fake.mtyp)
+		}
+	})
+}
+
+func TestReceiveHugeMaxlen(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	for _, maxlen := range []uint{^uint(0), 1 << 50, math.MaxInt32 + 1} {
+		if _, _, err := q.Receive(maxlen, 0, &MQRecvFlags{DontWait: true}); err != syscall.EINVAL {
+			t.Errorf("maxlen %d should fail EINVAL: %v", maxlen, err)
+		}
+	}
+
+	// within the bound, but far over msgmax: no need for a buffer this size
+	if err := q.Send(1, []byte("hello"), nil); err != nil {
+		t.Fatal(err)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	body, _, err := q.Receive(1<<30, 0, nil)
+	runtime.ReadMemStats(&after)
+	if err != nil || string(body) != "hello" {
+		t.Fatalf("got %q, %v", body, err)
+	}
+	if grew := after.TotalAlloc - before.TotalAlloc; grew > 1<<20 {
+		t.Errorf("receiving allocated %d bytes", grew)
+	}
+}
+
+func TestReceiveMsgMaxRaised(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	// pretend msgmax was read before being raised past the message's size
+	actual := msgMax()
+	cachedMsgMax.Store(16)
+	defer cachedMsgMax.Store(uint64(actual))
+
+	body := bytes.Repeat([]byte("x"), 100)
+	if err := q.Send(1, body, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := q.Receive(1000, 0, &MQRecvFlags{DontWait: true})
+	if err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+	if m := cachedMsgMax.Load(); m != uint64(actual) {
+		t.Errorf("msgmax should have been re-read as %d, is %d", actual, m)
+	}
+}
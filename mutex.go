@@ -0,0 +1,243 @@
+package sysvipc
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// MutexSize is the number of bytes of shared memory a Mutex occupies.
+const MutexSize = 4
+
+var (
+	// ErrOwnerDead is returned by a robust Mutex's Lock when the lock was
+	// acquired from a process that died while holding it. The caller now
+	// holds the lock, but the data it protects may be inconsistent.
+	ErrOwnerDead = errors.New("sysvipc: previous mutex owner died")
+
+	// ErrNotLocked is returned by Unlock on a Mutex that isn't held (or, for
+	// a robust Mutex, isn't held by this process).
+	ErrNotLocked = errors.New("sysvipc: unlock of unheld mutex")
+)
+
+const (
+	futexWait = 0
+	futexWake = 1
+
+	// mutex word states for the non-robust variant
+	mutexUnlocked  = 0
+	mutexLocked    = 1
+	mutexContended = 2
+
+	// the robust variant stores the owner's PID with this bit marking waiters
+	mutexWaiters = 1 << 31
+
+	// how often a blocked robust Lock re-checks whether the owner is alive
+	robustPoll = 50 * time.Millisecond
+)
+
+// Mutex is an interprocess lock stored in a 4-byte word of shared memory.
+//
+// Uncontended Lock and Unlock are a single atomic operation with no syscall;
+// contended waiters sleep with FUTEX_WAIT on the shared word. Any process
+// that has the segment attached may use a Mutex at the same offset, and a
+// zero-filled word (as in a new segment) is an unlocked Mutex.
+type Mutex struct {
+	word   *uint32
+	robust bool
+
+	// pid is this process's, cached for the robust variant since Getpid is a
+	// syscall. Go processes don't fork without exec, so it can't go stale.
+	pid uint32
+}
+
+// NewMutex creates a Mutex at offset in an attached shared memory segment.
+// The offset must be 4-byte aligned.
+func NewMutex(mnt *SharedMemMount, offset uint) (*Mutex, error) {
+	word, err := mutexWord(mnt, offset)
+	if err != nil {
+		return nil, err
+	}
+	return &Mutex{word: word}, nil
+}
+
+// NewRobustMutex creates a Mutex which records the holder's PID in the
+// shared word, so that waiters can detect and take over from an owner that
+// died without unlocking (see ErrOwnerDead).
+//
+// A robust Mutex is held per-process: any goroutine in the owning process may
+// Unlock it. PID reuse can hide a dead owner until the new process exits.
+func NewRobustMutex(mnt *SharedMemMount, offset uint) (*Mutex, error) {
+	word, err := mutexWord(mnt, offset)
+	if err != nil {
+		return nil, err
+	}
+	return &Mutex{word: word, robust: true, pid: uint32(os.Getpid())}, nil
+}
+
+func mutexWord(mnt *SharedMemMount, offset uint) (*uint32, error) {
+	if mnt.readonly {
+		return nil, ErrReadOnlyShm
+	}
+	if offset%4 != 0 {
+		return nil, errors.New("sysvipc: mutex offset must be 4-byte aligned")
+	}
+	if offset > mnt.length || mnt.length-offset < MutexSize {
+		return nil, errors.New("sysvipc: mutex offset out of range")
+	}
+	return (*uint32)(unsafe.Pointer(uintptr(mnt.ptr) + uintptr(offset))), nil
+}
+
+// Lock acquires the mutex, blocking until it is available.
+func (m *Mutex) Lock() error {
+	if m.robust {
+		return m.lockRobust()
+	}
+
+	if atomic.CompareAndSwapUint32(m.word, mutexUnlocked, mutexLocked) {
+		return nil
+	}
+	for atomic.SwapUint32(m.word, mutexContended) != mutexUnlocked {
+		if err := futex(m.word, futexWait, mutexContended, -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TryLock acquires the mutex if it is available, without blocking.
+// For a robust Mutex it can return true with ErrOwnerDead.
+func (m *Mutex) TryLock() (bool, error) {
+	if !m.robust {
+		return atomic.CompareAndSwapUint32(m.word, mutexUnlocked, mutexLocked), nil
+	}
+
+	me := m.pid
+	for {
+		v := atomic.LoadUint32(m.word)
+		if v == mutexUnlocked {
+			if atomic.CompareAndSwapUint32(m.word, v, me) {
+				return true, nil
+			}
+			continue
+		}
+		if !processAlive(int(v &^ mutexWaiters)) {
+			if atomic.CompareAndSwapUint32(m.word, v, me|mutexWaiters) {
+				return true, ErrOwnerDead
+			}
+			continue
+		}
+		return false, nil
+	}
+}
+
+// Unlock releases the mutex, waking one waiter if there are any.
+func (m *Mutex) Unlock() error {
+	var old uint32
+	if m.robust {
+		v := atomic.LoadUint32(m.word)
+		if v&^mutexWaiters != m.pid {
+			return ErrNotLocked
+		}
+		old = atomic.SwapUint32(m.word, mutexUnlocked)
+	} else {
+		old = atomic.SwapUint32(m.word, mutexUnlocked)
+		if old == mutexUnlocked {
+			return ErrNotLocked
+		}
+	}
+
+	if old == mutexContended || (m.robust && old&mutexWaiters != 0) {
+		return futex(m.word, futexWake, 1, -1)
+	}
+	return nil
+}
+
+// Owner returns the PID recorded in a robust Mutex, or 0 if it is unlocked
+// or not robust.
+func (m *Mutex) Owner() int {
+	if !m.robust {
+		return 0
+	}
+	return int(atomic.LoadUint32(m.word) &^ mutexWaiters)
+}
+
+func (m *Mutex) lockRobust() error {
+	me := m.pid
+
+	// once we've slept we can't know whether others are still waiting, so
+	// every acquisition after that leaves the waiters bit set
+	var flag uint32
+	for {
+		v := atomic.LoadUint32(m.word)
+		if v == mutexUnlocked {
+			if atomic.CompareAndSwapUint32(m.word, v, me|flag) {
+				return nil
+			}
+			continue
+		}
+
+		if !processAlive(int(v &^ mutexWaiters)) {
+			if atomic.CompareAndSwapUint32(m.word, v, me|mutexWaiters) {
+				return ErrOwnerDead
+			}
+			continue
+		}
+
+		if v&mutexWaiters == 0 && !atomic.CompareAndSwapUint32(m.word, v, v|mutexWaiters) {
+			continue
+		}
+		if err := futex(m.word, futexWait, v|mutexWaiters, robustPoll); err != nil {
+			return err
+		}
+		flag = mutexWaiters
+	}
+}
+
+// processAlive reports whether pid names a running process. Zombies (exited
+// but not yet reaped by their parent) count as dead.
+func processAlive(pid int) bool {
+	if syscall.Kill(pid, 0) == syscall.ESRCH {
+		return false
+	}
+
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return true
+	}
+	// the state follows the parenthesized command name, which may itself
+	// contain spaces or parens
+	if i := bytes.LastIndexByte(stat, ')'); i >= 0 && i+2 < len(stat) {
+		return stat[i+2] != 'Z'
+	}
+	return true
+}
+
+// futex makes a shared (not FUTEX_PRIVATE) futex call on addr.
+// Wait timeouts and spurious wakeups aren't errors: callers re-check the word.
+func futex(addr *uint32, op int, val uint32, timeout time.Duration) error {
+	var ts *syscall.Timespec
+	if timeout >= 0 {
+		t := syscall.NsecToTimespec(int64(timeout))
+		ts = &t
+	}
+
+	_, _, errno := syscall.Syscall6(
+		syscall.SYS_FUTEX,
+		uintptr(unsafe.Pointer(addr)),
+		uintptr(op),
+		uintptr(val),
+		uintptr(unsafe.Pointer(ts)),
+		0, 0,
+	)
+	switch errno {
+	case 0, syscall.EAGAIN, syscall.EINTR, syscall.ETIMEDOUT:
+		return nil
+	}
+	return errno
+}
@@ -0,0 +1,205 @@
+package sysvipc
+
+import (
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMutexErrors(t *testing.T) {
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	if _, err := NewMutex(mount, 2); err == nil {
+		t.Error("misaligned offset should fail")
+	}
+
+	if _, err := NewMutex(mount, 4096); err == nil {
+		t.Error("offset past the end should fail")
+	}
+
+	roat, err := shm.Attach(&SHMAttachFlags{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer roat.Close()
+
+	if _, err := NewMutex(roat, 0); err != ErrReadOnlyShm {
+		t.Error("mutex in a read-only mount should fail", err)
+	}
+
+	for _, robust := range []bool{false, true} {
+		mu := newTestMutex(t, mount, 8, robust)
+		if err := mu.Unlock(); err != ErrNotLocked {
+			t.Error("unlock of an unlocked mutex should fail", robust, err)
+		}
+	}
+}
+
+func TestMutexTryLock(t *testing.T) {
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	for _, robust := range []bool{false, true} {
+		mu := newTestMutex(t, mount, 0, robust)
+
+		if ok, err := mu.TryLock(); !ok || err != nil {
+			t.Fatal("TryLock of an unlocked mutex should succeed", robust, err)
+		}
+		if ok, err := mu.TryLock(); ok || err != nil {
+			t.Error("TryLock of a locked mutex should fail", robust, err)
+		}
+		if err := mu.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMutexContention(t *testing.T) {
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	for _, robust := range []bool{false, true} {
+		// every worker gets its own attachment, so the futex has to match up
+		// waiters across different mappings of the same segment
+		mounts := make([]*SharedMemMount, 8)
+		for i := range mounts {
+			mnt, err := shm.Attach(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mnt.Close()
+			mounts[i] = mnt
+		}
+
+		// the counter lives in the segment and is bumped non-atomically, so
+		// only the mutex keeps increments from getting lost
+		wg := &sync.WaitGroup{}
+		for _, mnt := range mounts {
+			mu := newTestMutex(t, mnt, 0, robust)
+			wg.Add(1)
+			go func(mnt *SharedMemMount) {
+				defer wg.Done()
+				b := make([]byte, 8)
+				for i := 0; i < 2000; i++ {
+					if err := mu.Lock(); err != nil {
+						t.Error(err)
+						return
+					}
+					mnt.Seek(64, 0)
+					mnt.Read(b)
+					mnt.Seek(64, 0)
+					binary.NativeEndian.PutUint64(b, binary.NativeEndian.Uint64(b)+1)
+					mnt.Write(b)
+					if err := mu.Unlock(); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}(mnt)
+		}
+		wg.Wait()
+
+		b := make([]byte, 8)
+		mount.Seek(64, 0)
+		mount.Read(b)
+		if counter := binary.NativeEndian.Uint64(b); counter != uint64(len(mounts)*2000) {
+			t.Errorf("lost updates: %d (robust: %v)", counter, robust)
+		}
+		mount.Seek(64, 0)
+		mount.Write(make([]byte, 8))
+	}
+}
+
+func TestRobustMutexOwner(t *testing.T) {
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	mu := newTestMutex(t, mount, 0, true)
+	if err := mu.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if mu.Owner() != os.Getpid() {
+		t.Error("wrong owner", mu.Owner())
+	}
+	if err := mu.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if mu.Owner() != 0 {
+		t.Error("unlocked mutex shouldn't have an owner", mu.Owner())
+	}
+
+	mount.Seek(0, 0)
+	mount.AtomicWriteUint32(uint32(os.Getpid() + 1))
+	if err := mu.Unlock(); err != ErrNotLocked {
+		t.Error("unlock of another process's mutex should fail", err)
+	}
+	mount.Seek(0, 0)
+	mount.AtomicWriteUint32(0)
+}
+
+func TestRobustMutexDeadOwner(t *testing.T) {
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	dead := deadPID(t)
+	mu := newTestMutex(t, mount, 0, true)
+
+	// pretend the dead process took the lock
+	mount.Seek(0, 0)
+	if err := mount.AtomicWriteUint32(uint32(dead)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mu.Lock(); err != ErrOwnerDead {
+		t.Fatal("should have taken over from a dead owner", err)
+	}
+	if mu.Owner() != os.Getpid() {
+		t.Error("wrong owner after recovery", mu.Owner())
+	}
+	if err := mu.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// and with a waiter already asleep when the owner goes away
+	holder := exec.Command("sleep", "0.2")
+	if err := holder.Start(); err != nil {
+		t.Fatal(err)
+	}
+	mount.Seek(0, 0)
+	mount.AtomicWriteUint32(uint32(holder.Process.Pid))
+
+	go holder.Wait()
+
+	start := time.Now()
+	if err := mu.Lock(); err != ErrOwnerDead {
+		t.Fatal("should have taken over from a dead owner", err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("took the lock before the owner was dead")
+	}
+	mu.Unlock()
+}
+
+func newTestMutex(t *testing.T, mnt *SharedMemMount, offset uint, robust bool) *Mutex {
+	newfn := NewMutex
+	if robust {
+		newfn = NewRobustMutex
+	}
+	mu, err := newfn(mnt, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mu
+}
+
+func deadPID(t *testing.T) int {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
@@ -0,0 +1,171 @@
+package sysvipc
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Op names a system call the package makes, with the ctl command in
+// parentheses for the msgctl, semctl and shmctl calls.
+type Op string
+
+const (
+	OpMsgGet     Op = "msgget"
+	OpMsgSend    Op = "msgsnd"
+	OpMsgReceive Op = "msgrcv"
+	OpMsgStat    Op = "msgctl(IPC_STAT)"
+	OpMsgSet     Op = "msgctl(IPC_SET)"
+	OpMsgRemove  Op = "msgctl(IPC_RMID)"
+	OpMsgInfo    Op = "msgctl(IPC_INFO)"
+
+	OpSemGet     Op = "semget"
+	OpSemRun     Op = "semtimedop"
+	OpSemGetval  Op = "semctl(GETVAL)"
+	OpSemSetval  Op = "semctl(SETVAL)"
+	OpSemGetall  Op = "semctl(GETALL)"
+	OpSemSetall  Op = "semctl(SETALL)"
+	OpSemGetpid  Op = "semctl(GETPID)"
+	OpSemGetNCnt Op = "semctl(GETNCNT)"
+	OpSemGetZCnt Op = "semctl(GETZCNT)"
+	OpSemStat    Op = "semctl(IPC_STAT)"
+	OpSemSet     Op = "semctl(IPC_SET)"
+	OpSemRemove  Op = "semctl(IPC_RMID)"
+
+	OpShmGet    Op = "shmget"
+	OpShmAttach Op = "shmat"
+	OpShmDetach Op = "shmdt"
+	OpShmStat   Op = "shmctl(IPC_STAT)"
+	OpShmSet    Op = "shmctl(IPC_SET)"
+	OpShmLock   Op = "shmctl(SHM_LOCK)"
+	OpShmUnlock Op = "shmctl(SHM_UNLOCK)"
+	OpShmRemove Op = "shmctl(IPC_RMID)"
+)
+
+// Call describes one finished system call.
+type Call struct {
+	Op Op
+
+	// ID is the object's id, or for the get calls the id they returned
+	// (-1 if they failed).
+	ID int64
+
+	// Duration is the time spent in the call, including any blocking.
+	Duration time.Duration
+
+	// Bytes is the message size for msgsnd and msgrcv, and the segment size
+	// for shmat. It is 0 for other calls and failed ones.
+	Bytes int
+
+	Err error
+}
+
+// Observer is told about every system call made by a MessageQueue,
+// SemaphoreSet, SharedMem or SharedMemMount (not those of a Fake). Observe
+// is called on the calling goroutine, after the call returns, so it should
+// be quick and safe for concurrent use.
+type Observer interface {
+	Observe(c Call)
+}
+
+type observerBox struct {
+	o Observer
+}
+
+var observer atomic.Pointer[observerBox]
+
+// SetObserver installs o to be told about system calls, replacing any
+// previous Observer. A nil o removes it, and with none installed the only
+// cost to each call is an atomic load.
+func SetObserver(o Observer) {
+	if o == nil {
+		observer.Store(nil)
+		return
+	}
+	observer.Store(&observerBox{o})
+}
+
+// observing times one call for the installed Observer, if there is one.
+type observing struct {
+	o     Observer
+	start time.Time
+}
+
+func observe() observing {
+	if box := observer.Load(); box != nil {
+		return observing{box.o, time.Now()}
+	}
+	return observing{}
+}
+
+// done reports the call, with n bytes if it didn't fail.
+func (ob observing) done(op Op, id int64, n int, failed bool, err error) {
+	if ob.o == nil {
+		return
+	}
+	c := Call{Op: op, ID: id, Duration: time.Since(ob.start)}
+	if failed {
+		c.Err = err
+	} else {
+		c.Bytes = n
+	}
+	ob.o.Observe(c)
+}
+
+// ExpvarObserver is an Observer that keeps totals per Op in an expvar.Map,
+// for /debug/vars. Each Op's entry is a map of "calls", "errors",
+// "nanoseconds" (the total time spent) and "bytes".
+type ExpvarObserver struct {
+	vars *expvar.Map
+
+	mu  sync.RWMutex
+	ops map[Op]*opVars
+}
+
+type opVars struct {
+	calls, errors, nanoseconds, bytes expvar.Int
+}
+
+// NewExpvarObserver creates an ExpvarObserver publishing its totals under
+// name. Like expvar.NewMap, it panics if the name is already in use.
+func NewExpvarObserver(name string) *ExpvarObserver {
+	return &ExpvarObserver{
+		vars: expvar.NewMap(name),
+		ops:  make(map[Op]*opVars),
+	}
+}
+
+// Observe implements Observer.
+func (eo *ExpvarObserver) Observe(c Call) {
+	v := eo.opVars(c.Op)
+	v.calls.Add(1)
+	if c.Err != nil {
+		v.errors.Add(1)
+	}
+	v.nanoseconds.Add(int64(c.Duration))
+	v.bytes.Add(int64(c.Bytes))
+}
+
+func (eo *ExpvarObserver) opVars(op Op) *opVars {
+	eo.mu.RLock()
+	v := eo.ops[op]
+	eo.mu.RUnlock()
+	if v != nil {
+		return v
+	}
+
+	eo.mu.Lock()
+	defer eo.mu.Unlock()
+	if v = eo.ops[op]; v == nil {
+		v = new(opVars)
+		m := new(expvar.Map)
+		m.Set("calls", &v.calls)
+		m.Set("errors", &v.errors)
+		m.Set("nanoseconds", &v.nanoseconds)
+		m.Set("bytes", &v.bytes)
+		eo.vars.Set(string(op), m)
+		eo.ops[op] = v
+	}
+	return v
+}
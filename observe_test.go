@@ -0,0 +1,215 @@
+package sysvipc
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+type recorder struct {
+	mu    sync.Mutex
+	calls []Call
+}
+
+func (r *recorder) Observe(c Call) {
+	r.mu.Lock()
+	r.calls = append(r.calls, c)
+	r.mu.Unlock()
+}
+
+func observeWith(t testing.TB, o Observer) {
+	SetObserver(o)
+	t.Cleanup(func() { SetObserver(nil) })
+}
+
+func TestObserver(t *testing.T) {
+	msgMax() // its one-off msgctl(IPC_INFO) is checked separately
+	rec := new(recorder)
+	observeWith(t, rec)
+
+	mq, err := GetMsgQueue(0, &MQFlags{Create: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mq.Send(1, []byte("hello"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := mq.Receive(64, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := mq.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mq.Remove(); err != syscall.EINVAL {
+		t.Fatal("removing twice should fail", err)
+	}
+
+	shm, err := GetSharedMem(0, 4096, &SHMFlags{Create: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt, err := shm.Attach(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt.Close()
+	shm.Remove()
+
+	want := []Call{
+		{Op: OpMsgGet, ID: int64(mq)},
+		{Op: OpMsgSend, ID: int64(mq), Bytes: 5},
+		{Op: OpMsgReceive, ID: int64(mq), Bytes: 5},
+		{Op: OpMsgRemove, ID: int64(mq)},
+		{Op: OpMsgRemove, ID: int64(mq), Err: syscall.EINVAL},
+		{Op: OpShmGet, ID: shm.id},
+		{Op: OpShmAttach, ID: shm.id, Bytes: 4096},
+		{Op: OpShmDetach, ID: shm.id},
+		{Op: OpShmRemove, ID: shm.id},
+	}
+	if len(rec.calls) != len(want) {
+		t.Fatalf("got %d calls, want %d: %v", len(rec.calls), len(want), rec.calls)
+	}
+	for i, c := range rec.calls {
+		if c.Duration <= 0 {
+			t.Errorf("%s took no time", c.Op)
+		}
+		c.Duration = 0
+		if c != want[i] {
+			t.Errorf("call %d: got %+v, want %+v", i, c, want[i])
+		}
+	}
+
+	SetObserver(nil)
+	GetMsgQueue(0xDA7ABA5E, nil)
+	if len(rec.calls) != len(want) {
+		t.Error("calls were observed after SetObserver(nil)")
+	}
+}
+
+func TestObserverMsgInfo(t *testing.T) {
+	mq, err := GetMsgQueue(0, &MQFlags{Create: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.Remove()
+
+	cachedMsgMax.Store(0)
+	rec := new(recorder)
+	observeWith(t, rec)
+	for i := 0; i < 3; i++ {
+		mq.Receive(1<<20, 0, &MQRecvFlags{DontWait: true})
+	}
+
+	wantOps := []Op{OpMsgInfo, OpMsgReceive, OpMsgReceive, OpMsgReceive}
+	if len(rec.calls) != len(wantOps) {
+		t.Fatalf("got %v", rec.calls)
+	}
+	for i, c := range rec.calls {
+		if c.Op != wantOps[i] {
+			t.Errorf("call %d: got %s, want %s", i, c.Op, wantOps[i])
+		}
+	}
+}
+
+func TestObserverSemaphores(t *testing.T) {
+	rec := new(recorder)
+	observeWith(t, rec)
+
+	ss, err := GetSemSet(0, 1, &SemSetFlags{Create: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Remove()
+	ops := NewSemOps()
+	ops.Increment(0, 1, nil)
+	if err := ss.Run(ops, -1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Getval(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Getval(5); err != syscall.EINVAL {
+		t.Fatal("Getval past the end should fail", err)
+	}
+
+	wantOps := []Op{OpSemGet, OpSemRun, OpSemGetval, OpSemGetval}
+	if len(rec.calls) != len(wantOps) {
+		t.Fatalf("got %v", rec.calls)
+	}
+	for i, c := range rec.calls {
+		if c.Op != wantOps[i] || c.ID != ss.id {
+			t.Errorf("call %d: got %+v, want %s on %d", i, c, wantOps[i], ss.id)
+		}
+	}
+	if last := rec.calls[3]; last.Err != syscall.EINVAL {
+		t.Error("the failed Getval should carry its error", last.Err)
+	}
+}
+
+// expvarRuns makes TestExpvarObserver's name unique, for -count.
+var expvarRuns atomic.Int32
+
+func TestExpvarObserver(t *testing.T) {
+	name := fmt.Sprintf("sysvipc_test_%d", expvarRuns.Add(1))
+	eo := NewExpvarObserver(name)
+	observeWith(t, eo)
+
+	mq, err := GetMsgQueue(0, &MQFlags{Create: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mq.Send(1, []byte("abc"), nil)
+	mq.Send(1, []byte("defgh"), nil)
+	mq.Remove()
+	mq.Remove()
+
+	vars := expvar.Get(name).(*expvar.Map)
+	get := func(op Op, name string) int64 {
+		m, ok := vars.Get(string(op)).(*expvar.Map)
+		if !ok {
+			t.Fatalf("no entry for %s", op)
+		}
+		return m.Get(name).(*expvar.Int).Value()
+	}
+	if calls, bytes := get(OpMsgSend, "calls"), get(OpMsgSend, "bytes"); calls != 2 || bytes != 8 {
+		t.Errorf("msgsnd: %d calls, %d bytes", calls, bytes)
+	}
+	if get(OpMsgSend, "nanoseconds") <= 0 {
+		t.Error("msgsnd took no time")
+	}
+	if calls, errs := get(OpMsgRemove, "calls"), get(OpMsgRemove, "errors"); calls != 2 || errs != 1 {
+		t.Errorf("msgctl(IPC_RMID): %d calls, %d errors", calls, errs)
+	}
+}
+
+// benchObserver is shared by runs of BenchmarkObserver, since an expvar name
+// can only be published once.
+var benchObserver = sync.OnceValue(func() *ExpvarObserver {
+	return NewExpvarObserver("sysvipc_bench")
+})
+
+func BenchmarkObserver(b *testing.B) {
+	ss, err := GetSemSet(0, 1, &SemSetFlags{Create: true, Perms: 0600})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ss.Remove()
+
+	for _, bc := range []struct {
+		name string
+		o    Observer
+	}{
+		{"none", nil},
+		{"expvar", benchObserver()},
+	} {
+		b.Run("observer="+bc.name, func(b *testing.B) {
+			observeWith(b, bc.o)
+			for i := 0; i < b.N; i++ {
+				ss.Getval(0)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package sysvipc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// PriorityQueue sends messages at named priority levels and always receives
+// the highest priority message waiting.
+//
+// Levels map to consecutive mtypes starting at a base, most important
+// first, and Receive uses msgrcv's negative msgtyp ("lowest type <= |msgtyp|
+// first") over that range. Messages on the queue with types below the base
+// would be taken first too, so they shouldn't be used for anything else.
+type PriorityQueue struct {
+	mq     MessageQueue
+	base   int64
+	levels []string
+	types  map[string]int64
+}
+
+// NewPriorityQueue creates a PriorityQueue with levels listed from highest
+// priority to lowest, using mtypes base, base+1, and so on. base must be at
+// least 1.
+func NewPriorityQueue(mq MessageQueue, base int64, levels ...string) (*PriorityQueue, error) {
+	if base < 1 {
+		return nil, errors.New("sysvipc: priority base mtype must be positive")
+	}
+	if len(levels) == 0 {
+		return nil, errors.New("sysvipc: no priority levels")
+	}
+
+	types := make(map[string]int64, len(levels))
+	for i, level := range levels {
+		if _, ok := types[level]; ok {
+			return nil, fmt.Errorf("sysvipc: duplicate priority level %q", level)
+		}
+		types[level] = base + int64(i)
+	}
+
+	return &PriorityQueue{
+		mq:     mq,
+		base:   base,
+		levels: append([]string(nil), levels...),
+		types:  types,
+	}, nil
+}
+
+// Type returns the mtype used for a priority level.
+func (pq *PriorityQueue) Type(level string) (int64, bool) {
+	mtyp, ok := pq.types[level]
+	return mtyp, ok
+}
+
+// Level returns the priority level an mtype belongs to.
+func (pq *PriorityQueue) Level(mtyp int64) (string, bool) {
+	if mtyp < pq.base || mtyp >= pq.base+int64(len(pq.levels)) {
+		return "", false
+	}
+	return pq.levels[mtyp-pq.base], true
+}
+
+// Send places a message onto the queue at a priority level.
+func (pq *PriorityQueue) Send(level string, body []byte, flags *MQSendFlags) error {
+	mtyp, ok := pq.types[level]
+	if !ok {
+		return fmt.Errorf("sysvipc: unknown priority level %q", level)
+	}
+	return pq.mq.Send(mtyp, body, flags)
+}
+
+// Receive retrieves the oldest message of the highest priority level that
+// has any, and returns it with its level.
+func (pq *PriorityQueue) Receive(maxlen uint, flags *MQRecvFlags) ([]byte, string, error) {
+	last := pq.base + int64(len(pq.levels)) - 1
+	body, mtyp, err := pq.mq.Receive(maxlen, -last, flags)
+	if err != nil {
+		return nil, "", err
+	}
+
+	level, _ := pq.Level(mtyp)
+	return body, level, nil
+}
+
+// RouteHandler processes a message taken off the queue by a Router.
+type RouteHandler func(mtyp int64, body []byte)
+
+// Router dispatches messages received from a queue to handlers registered
+// for ranges of mtypes.
+type Router struct {
+	mq     MessageQueue
+	maxlen uint
+
+	mu       sync.RWMutex
+	routes   []route // sorted and non-overlapping
+	fallback RouteHandler
+}
+
+type route struct {
+	lo, hi  int64
+	handler RouteHandler
+}
+
+// NewRouter creates a Router for a queue, receiving messages up to maxlen
+// bytes long.
+func NewRouter(mq MessageQueue, maxlen uint) *Router {
+	return &Router{mq: mq, maxlen: maxlen}
+}
+
+// Handle registers a handler for messages with lo <= mtype <= hi. The range
+// must not overlap one already registered.
+func (r *Router) Handle(lo, hi int64, h RouteHandler) error {
+	if lo < 1 || hi < lo {
+		return errors.New("sysvipc: bad mtype range")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := sort.Search(len(r.routes), func(i int) bool { return r.routes[i].lo > hi })
+	if i > 0 && r.routes[i-1].hi >= lo {
+		return fmt.Errorf("sysvipc: mtype range %d-%d overlaps %d-%d",
+			lo, hi, r.routes[i-1].lo, r.routes[i-1].hi)
+	}
+
+	r.routes = append(r.routes, route{})
+	copy(r.routes[i+1:], r.routes[i:])
+	r.routes[i] = route{lo, hi, h}
+	return nil
+}
+
+// HandleDefault registers a handler for messages outside every range.
+// Without one, such messages are dropped.
+func (r *Router) HandleDefault(h RouteHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = h
+}
+
+// Dispatch hands a message to the handler for its mtype, reporting whether
+// there was one.
+func (r *Router) Dispatch(mtyp int64, body []byte) bool {
+	r.mu.RLock()
+	h := r.fallback
+	i := sort.Search(len(r.routes), func(i int) bool { return r.routes[i].hi >= mtyp })
+	if i < len(r.routes) && r.routes[i].lo <= mtyp {
+		h = r.routes[i].handler
+	}
+	r.mu.RUnlock()
+
+	if h == nil {
+		return false
+	}
+	h(mtyp, body)
+	return true
+}
+
+// Serve receives every message from the queue and dispatches it, one at a
+// time, until ctx is done (returning nil) or receiving fails.
+func (r *Router) Serve(ctx context.Context) error {
+	var serr error
+	msgs := r.mq.Subscribe(ctx, 0, &ChanFlags{
+		MaxLen:  r.maxlen,
+		OnError: func(err error) { serr = err },
+	})
+
+	for msg := range msgs {
+		r.Dispatch(msg.Type, msg.Body)
+	}
+	// OnError runs before the channel is closed
+	return serr
+}
@@ -0,0 +1,164 @@
+package sysvipc
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	if _, err := NewPriorityQueue(q, 0, "high"); err == nil {
+		t.Error("zero base should fail")
+	}
+	if _, err := NewPriorityQueue(q, 1, "high", "high"); err == nil {
+		t.Error("duplicate levels should fail")
+	}
+
+	pq, err := NewPriorityQueue(q, 10, "urgent", "normal", "bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pq.Send("whenever", nil, nil); err == nil {
+		t.Error("unknown level should fail")
+	}
+
+	sends := []struct{ level, body string }{
+		{"bulk", "b1"},
+		{"normal", "n1"},
+		{"bulk", "b2"},
+		{"urgent", "u1"},
+		{"normal", "n2"},
+	}
+	for _, s := range sends {
+		if err := pq.Send(s.level, []byte(s.body), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a message above the range isn't picked up
+	if err := q.Send(20, []byte("other"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"u1", "n1", "n2", "b1", "b2"} {
+		body, level, err := pq.Receive(64, &MQRecvFlags{DontWait: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != want {
+			t.Errorf("got %q (%s), wanted %q", body, level, want)
+		}
+		if mtyp, _ := pq.Type(level); mtyp < 10 || mtyp > 12 {
+			t.Error("bad level", level)
+		}
+	}
+
+	if _, _, err := pq.Receive(64, &MQRecvFlags{DontWait: true}); err != syscall.ENOMSG {
+		t.Error("should be out of prioritized messages", err)
+	}
+}
+
+func TestRouterHandle(t *testing.T) {
+	r := NewRouter(0, 64)
+
+	if err := r.Handle(5, 4, nil); err == nil {
+		t.Error("backwards range should fail")
+	}
+	if err := r.Handle(0, 4, nil); err == nil {
+		t.Error("non-positive mtype should fail")
+	}
+
+	var got []string
+	handler := func(name string) RouteHandler {
+		return func(mtyp int64, body []byte) { got = append(got, name) }
+	}
+
+	for _, rt := range []struct {
+		lo, hi int64
+		name   string
+	}{{10, 19, "tens"}, {1, 1, "one"}, {100, 199, "hundreds"}} {
+		if err := r.Handle(rt.lo, rt.hi, handler(rt.name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Handle(15, 25, handler("overlap")); err == nil {
+		t.Error("overlapping range should fail")
+	}
+	if err := r.Handle(2, 10, handler("overlap")); err == nil {
+		t.Error("overlapping range should fail")
+	}
+
+	for _, mtyp := range []int64{1, 10, 19, 150} {
+		if !r.Dispatch(mtyp, nil) {
+			t.Error("no handler for", mtyp)
+		}
+	}
+	if r.Dispatch(50, nil) {
+		t.Error("mtype 50 shouldn't have been handled")
+	}
+
+	r.HandleDefault(handler("default"))
+	r.Dispatch(50, nil)
+
+	want := []string{"one", "tens", "tens", "hundreds", "default"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, wanted %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, wanted %v", got, want)
+			break
+		}
+	}
+}
+
+func TestRouterServe(t *testing.T) {
+	msgSetup(t)
+	defer msgTeardown(t)
+
+	mu := &sync.Mutex{}
+	seen := make(map[string]int64)
+	record := func(mtyp int64, body []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[string(body)] = mtyp
+	}
+
+	r := NewRouter(q, 64)
+	r.Handle(1, 9, record)
+	r.Handle(10, 99, record)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- r.Serve(ctx)
+	}()
+
+	q.Send(3, []byte("low"), nil)
+	q.Send(42, []byte("high"), nil)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		n := len(seen)
+		mu.Unlock()
+		if n == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Error("Serve should end cleanly on cancellation", err)
+	}
+	if seen["low"] != 3 || seen["high"] != 42 {
+		t.Error("messages weren't routed", seen)
+	}
+}
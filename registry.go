@@ -0,0 +1,360 @@
+package sysvipc
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// registryProbes is how many keys are tried for a name before giving up.
+const registryProbes = 16
+
+var (
+	// ErrNotRegistered is returned when opening a name that has no live
+	// object in the registry, without asking to create one.
+	ErrNotRegistered = errors.New("sysvipc: name not registered")
+
+	// ErrNoFreeKey is returned when every key derived from a name is
+	// already in use by some other object.
+	ErrNoFreeKey = errors.New("sysvipc: no free key for name")
+)
+
+// NameKey derives the IPC key for a name. Unlike Ftok it doesn't depend on a
+// file's inode, and uses all 32 bits of the key.
+//
+// A name whose key turns out to be taken is given a key from a later
+// attempt by a Registry, so NameKey(name, 0) is only the key that is tried
+// first; the registry is the authority on which key a name actually has.
+func NameKey(name string, attempt int) int64 {
+	h := fnv.New32a()
+	io.WriteString(h, name)
+	if attempt > 0 {
+		h.Write([]byte{0, byte(attempt), byte(attempt >> 8)})
+	}
+	return int64(h.Sum32())
+}
+
+// RegistryEntry records the key and kernel id a name was created with.
+type RegistryEntry struct {
+	Name string     `json:"name"`
+	Kind HandleKind `json:"kind"`
+	Key  int64      `json:"key"`
+	ID   int64      `json:"id"`
+}
+
+// Handle returns a Handle to the entry's object.
+func (e RegistryEntry) Handle() Handle {
+	return Handle{e.Kind, e.ID}
+}
+
+// Registry maps names to IPC objects, so cooperating processes can agree on
+// an object by name rather than by passing raw keys around.
+//
+// The mapping is kept in a JSON file which is flock(2)ed around every use,
+// so any number of processes can share one registry. Each kind of object has
+// its own namespace, as with keys. Entries whose object has been removed are
+// ignored, and replaced when the name is next created.
+type Registry struct {
+	path string
+}
+
+// NewRegistry returns the Registry kept in the file at path. The file (and
+// its directory) is created on first use.
+func NewRegistry(path string) *Registry {
+	return &Registry{path}
+}
+
+// DefaultRegistry is used by the package-level OpenQueue, OpenSemSet and
+// OpenSharedMem. Its file is named by $SYSVIPC_REGISTRY, or else
+// /run/sysvipc/registry.json.
+var DefaultRegistry = NewRegistry(defaultRegistryPath())
+
+func defaultRegistryPath() string {
+	if path := os.Getenv("SYSVIPC_REGISTRY"); path != "" {
+		return path
+	}
+	return "/run/sysvipc/registry.json"
+}
+
+// Path returns the registry's file name.
+func (r *Registry) Path() string {
+	return r.path
+}
+
+// OpenQueue opens the message queue registered as name. If there is none
+// and flags.Create is set, it creates one with flags.Perms and registers it.
+// flags.Exclusive makes it fail with EEXIST if the name is already live.
+func (r *Registry) OpenQueue(name string, flags *MQFlags) (MessageQueue, error) {
+	var create, excl bool
+	if flags != nil {
+		create, excl = flags.Create, flags.Exclusive
+	}
+
+	id, err := r.open(HandleMsgQueue, name, create, excl, func(key int64) (int64, error) {
+		f := *flags
+		f.Exclusive = true
+		mq, err := GetMsgQueue(key, &f)
+		return int64(mq), err
+	})
+	if err != nil {
+		return -1, err
+	}
+	return MessageQueue(id), nil
+}
+
+// OpenSemSet opens the semaphore set registered as name, creating one of
+// count semaphores as OpenQueue does.
+func (r *Registry) OpenSemSet(name string, count int64, flags *SemSetFlags) (*SemaphoreSet, error) {
+	var create, excl bool
+	if flags != nil {
+		create, excl = flags.Create, flags.Exclusive
+	}
+
+	id, err := r.open(HandleSemSet, name, create, excl, func(key int64) (int64, error) {
+		f := *flags
+		f.Exclusive = true
+		ss, err := GetSemSet(key, count, &f)
+		if err != nil {
+			return 0, err
+		}
+		return ss.id, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return OpenSemSetByID(id)
+}
+
+// OpenSharedMem opens the shared memory segment registered as name,
+// creating one of size bytes as OpenQueue does.
+func (r *Registry) OpenSharedMem(name string, size uint64, flags *SHMFlags) (*SharedMem, error) {
+	var create, excl bool
+	if flags != nil {
+		create, excl = flags.Create, flags.Exclusive
+	}
+
+	id, err := r.open(HandleSharedMem, name, create, excl, func(key int64) (int64, error) {
+		f := *flags
+		f.Exclusive = true
+		shm, err := GetSharedMem(key, size, &f)
+		if err != nil {
+			return 0, err
+		}
+		return shm.id, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return OpenSharedMemByID(id)
+}
+
+// Lookup returns the registry entry for a name, if it has a live object.
+func (r *Registry) Lookup(kind HandleKind, name string) (RegistryEntry, bool, error) {
+	entries, err := r.Entries()
+	if err != nil {
+		return RegistryEntry{}, false, err
+	}
+	if i := findEntry(entries, kind, name); i >= 0 && entryLive(entries[i]) {
+		return entries[i], true, nil
+	}
+	return RegistryEntry{}, false, nil
+}
+
+// Entries returns everything in the registry, including entries whose
+// object no longer exists.
+func (r *Registry) Entries() ([]RegistryEntry, error) {
+	var entries []RegistryEntry
+	err := r.locked(syscall.LOCK_SH, func(f *os.File) error {
+		var err error
+		entries, err = readEntries(f)
+		return err
+	})
+	return entries, err
+}
+
+// Forget drops a name from the registry. The object itself is left alone.
+func (r *Registry) Forget(kind HandleKind, name string) error {
+	return r.update(func(entries []RegistryEntry) ([]RegistryEntry, error) {
+		if i := findEntry(entries, kind, name); i >= 0 {
+			return append(entries[:i], entries[i+1:]...), nil
+		}
+		return nil, nil
+	})
+}
+
+// OpenQueue opens a named message queue in the DefaultRegistry.
+func OpenQueue(name string, flags *MQFlags) (MessageQueue, error) {
+	return DefaultRegistry.OpenQueue(name, flags)
+}
+
+// OpenSemSet opens a named semaphore set in the DefaultRegistry.
+func OpenSemSet(name string, count int64, flags *SemSetFlags) (*SemaphoreSet, error) {
+	return DefaultRegistry.OpenSemSet(name, count, flags)
+}
+
+// OpenSharedMem opens a named shared memory segment in the DefaultRegistry.
+func OpenSharedMem(name string, size uint64, flags *SHMFlags) (*SharedMem, error) {
+	return DefaultRegistry.OpenSharedMem(name, size, flags)
+}
+
+// open finds the live object registered under kind and name, or calls get
+// with successive keys derived from name until one creates a new object.
+func (r *Registry) open(kind HandleKind, name string, create, excl bool, get func(key int64) (int64, error)) (int64, error) {
+	var id int64
+	err := r.update(func(entries []RegistryEntry) ([]RegistryEntry, error) {
+		i := findEntry(entries, kind, name)
+		if i >= 0 {
+			if entryLive(entries[i]) {
+				if excl {
+					return nil, syscall.EEXIST
+				}
+				id = entries[i].ID
+				return nil, nil
+			}
+			entries = append(entries[:i], entries[i+1:]...)
+		}
+		if !create {
+			if i < 0 {
+				return nil, ErrNotRegistered
+			}
+			// still write back the stale entry's removal
+			return entries, ErrNotRegistered
+		}
+
+		taken := make(map[int64]bool)
+		for _, e := range entries {
+			if e.Kind == kind {
+				taken[e.Key] = true
+			}
+		}
+
+		for attempt := 0; attempt < registryProbes; attempt++ {
+			key := NameKey(name, attempt)
+			if key == 0 || taken[key] {
+				continue
+			}
+
+			var err error
+			id, err = get(key)
+			if err == syscall.EEXIST {
+				// some unregistered object already has this key
+				continue
+			}
+			if err != nil {
+				return entries, err
+			}
+			return append(entries, RegistryEntry{name, kind, key, id}), nil
+		}
+		return entries, ErrNoFreeKey
+	})
+	return id, err
+}
+
+// update runs fn on the registry's entries under an exclusive lock, and
+// writes back whatever non-nil slice it returns (even alongside an error).
+func (r *Registry) update(fn func([]RegistryEntry) ([]RegistryEntry, error)) error {
+	return r.locked(syscall.LOCK_EX, func(f *os.File) error {
+		entries, err := readEntries(f)
+		if err != nil {
+			return err
+		}
+
+		entries, ferr := fn(entries)
+		if entries != nil {
+			if err := writeEntries(f, entries); err != nil {
+				return err
+			}
+		}
+		return ferr
+	})
+}
+
+func (r *Registry) locked(how int, fn func(*os.File) error) error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		return err
+	}
+	// closing the file releases the lock
+	return fn(f)
+}
+
+func readEntries(f *os.File) ([]RegistryEntry, error) {
+	data, err := io.ReadAll(f)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	var entries []RegistryEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func writeEntries(f *os.File, entries []RegistryEntry) error {
+	data, err := json.MarshalIndent(entries, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(append(data, '\n'), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func findEntry(entries []RegistryEntry, kind HandleKind, name string) int {
+	for i, e := range entries {
+		if e.Kind == kind && e.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// entryLive reports whether an entry's object still exists and is the one
+// that was registered, rather than a later object that reused the slot. An
+// object the caller isn't allowed to stat is assumed to be live.
+func entryLive(e RegistryEntry) bool {
+	var perms IpcPerms
+	var err error
+	switch e.Kind {
+	case HandleMsgQueue:
+		var info *MQInfo
+		if info, err = MessageQueue(e.ID).Stat(); err == nil {
+			perms = info.Perms
+		}
+	case HandleSemSet:
+		var info *SemSetInfo
+		if info, err = (&SemaphoreSet{id: e.ID}).Stat(); err == nil {
+			perms = info.Perms
+		}
+	case HandleSharedMem:
+		// a segment marked for removal has lost its key, so this also
+		// treats those as gone
+		var info *SHMInfo
+		if info, err = (&SharedMem{id: e.ID}).Stat(); err == nil {
+			perms = info.Perms
+		}
+	default:
+		return false
+	}
+
+	if err == syscall.EACCES {
+		return true
+	}
+	return err == nil && perms.Key == e.Key
+}
@@ -0,0 +1,168 @@
+package sysvipc
+
+import (
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func testRegistry(t *testing.T) *Registry {
+	return NewRegistry(filepath.Join(t.TempDir(), "ipc", "registry.json"))
+}
+
+func TestNameKey(t *testing.T) {
+	if NameKey("billing.events", 0) != NameKey("billing.events", 0) {
+		t.Error("keys should be deterministic")
+	}
+	if NameKey("billing.events", 0) == NameKey("billing.events", 1) {
+		t.Error("later attempts should give different keys")
+	}
+	if NameKey("billing.events", 0) == NameKey("billing.event", 0) {
+		t.Error("different names should give different keys")
+	}
+}
+
+func TestRegistryOpenQueue(t *testing.T) {
+	reg := testRegistry(t)
+
+	if _, err := reg.OpenQueue("test.events", nil); err != ErrNotRegistered {
+		t.Error("opening an unregistered name should fail", err)
+	}
+
+	mq, err := reg.OpenQueue("test.events", &MQFlags{Create: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.Remove()
+
+	info, err := mq.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Perms.Key != NameKey("test.events", 0) {
+		t.Errorf("wrong key %x", info.Perms.Key)
+	}
+
+	// a second process would use its own Registry on the same file
+	again, err := NewRegistry(reg.Path()).OpenQueue("test.events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != mq {
+		t.Error("reopened a different queue", again, mq)
+	}
+
+	if _, err := reg.OpenQueue("test.events", &MQFlags{Create: true, Exclusive: true}); err != syscall.EEXIST {
+		t.Error("exclusive create of a live name should fail", err)
+	}
+
+	entry, ok, err := reg.Lookup(HandleMsgQueue, "test.events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || entry.ID != int64(mq) || entry.Handle() != mq.Handle() {
+		t.Error("wrong entry", entry, ok)
+	}
+	if _, ok, _ := reg.Lookup(HandleSemSet, "test.events"); ok {
+		t.Error("kinds should have separate namespaces")
+	}
+}
+
+func TestRegistryCollision(t *testing.T) {
+	reg := testRegistry(t)
+
+	// an unrelated queue already holds the name's first key
+	squatter, err := GetMsgQueue(NameKey("test.collide", 0), &MQFlags{
+		Create:    true,
+		Exclusive: true,
+		Perms:     0600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer squatter.Remove()
+
+	mq, err := reg.OpenQueue("test.collide", &MQFlags{Create: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.Remove()
+
+	if mq == squatter {
+		t.Fatal("registry handed out the colliding queue")
+	}
+	entry, ok, err := reg.Lookup(HandleMsgQueue, "test.collide")
+	if err != nil || !ok {
+		t.Fatal("missing entry", err)
+	}
+	if entry.Key != NameKey("test.collide", 1) {
+		t.Errorf("expected the second key, got %x", entry.Key)
+	}
+}
+
+func TestRegistryStale(t *testing.T) {
+	reg := testRegistry(t)
+
+	mq, err := reg.OpenQueue("test.stale", &MQFlags{Create: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mq.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, _ := reg.Lookup(HandleMsgQueue, "test.stale"); ok {
+		t.Error("removed queue still looks live")
+	}
+
+	mq2, err := reg.OpenQueue("test.stale", &MQFlags{Create: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq2.Remove()
+	if mq2 == mq {
+		t.Error("stale id handed out again")
+	}
+
+	entries, err := reg.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != int64(mq2) {
+		t.Error("stale entry not replaced", entries)
+	}
+
+	if err := reg.Forget(HandleMsgQueue, "test.stale"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.OpenQueue("test.stale", nil); err != ErrNotRegistered {
+		t.Error("forgotten name should be unregistered", err)
+	}
+}
+
+func TestRegistrySemShm(t *testing.T) {
+	reg := testRegistry(t)
+
+	s, err := reg.OpenSemSet("test.sems", 3, &SemSetFlags{Create: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Remove()
+	if s.count != 3 {
+		t.Error("wrong count", s.count)
+	}
+
+	m, err := reg.OpenSharedMem("test.mem", 4096, &SHMFlags{Create: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Remove()
+
+	m2, err := reg.OpenSharedMem("test.mem", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.ID() != m.ID() || m2.length != 4096 {
+		t.Error("reopened the wrong segment", m2.ID(), m2.length)
+	}
+}
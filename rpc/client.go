@@ -0,0 +1,242 @@
+package rpc
+
+import (
+	"context"
+	"math"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/teepark/go-sysvipc"
+)
+
+// Client makes calls to Servers on a message queue. It is safe for
+// concurrent use, with any number of calls in flight at once.
+type Client struct {
+	q         sysvipc.MessageQueue
+	reqType   int64
+	replyType int64
+	maxSize   uint
+
+	mu      sync.Mutex
+	pending map[uint64]chan *reply
+	nextID  uint64
+	closing bool
+	err     error
+
+	done chan struct{}
+}
+
+// ClientOptions holds the options for NewClient.
+type ClientOptions struct {
+	// RequestType is the mtype to send requests with. It defaults to
+	// DefaultRequestType and must match the servers' setting.
+	RequestType int64
+
+	// ReplyType is the mtype this client receives replies on, defaulting to
+	// the PID. Clients sharing a queue must each have their own.
+	ReplyType int64
+
+	// MaxSize is the largest reply message (including its header) to
+	// accept, defaulting to DefaultMaxSize.
+	MaxSize uint
+}
+
+func (co *ClientOptions) requestType() int64 {
+	if co == nil || co.RequestType == 0 {
+		return DefaultRequestType
+	}
+	return co.RequestType
+}
+
+func (co *ClientOptions) replyType() int64 {
+	if co == nil || co.ReplyType == 0 {
+		return int64(os.Getpid())
+	}
+	return co.ReplyType
+}
+
+func (co *ClientOptions) maxSize() uint {
+	if co == nil || co.MaxSize == 0 {
+		return DefaultMaxSize
+	}
+	return co.MaxSize
+}
+
+// NewClient creates a Client on q and starts receiving its replies.
+func NewClient(q sysvipc.MessageQueue, opts *ClientOptions) *Client {
+	c := &Client{
+		q:         q,
+		reqType:   opts.requestType(),
+		replyType: opts.replyType(),
+		maxSize:   opts.maxSize(),
+		pending:   make(map[uint64]chan *reply),
+		// a fresh starting point, so replies left over from an earlier
+		// Client with the same ReplyType don't match our calls
+		nextID: uint64(time.Now().UnixNano()) | 1,
+		done:   make(chan struct{}),
+	}
+	go c.receive()
+	return c
+}
+
+// Call invokes method on a server and waits for its reply, or for ctx to be
+// done. That includes waiting for room if the queue is full. The ctx
+// deadline is passed along, and servers drop requests that have expired
+// before they get to them. Errors returned by the remote handler are of type
+// ServerError.
+func (c *Client) Call(ctx context.Context, method string, body []byte) ([]byte, error) {
+	if len(method) > math.MaxUint16 {
+		return nil, ErrMethodTooLong
+	}
+	ch := make(chan *reply, 1)
+
+	c.mu.Lock()
+	if c.closing || c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		if err == nil {
+			err = ErrShutdown
+		}
+		return nil, err
+	}
+	id := c.nextID
+	c.nextID++
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	req := &request{
+		replyType: c.replyType,
+		id:        id,
+		method:    method,
+		body:      body,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		req.deadline = deadline.UnixNano()
+	}
+
+	if err := send(c.q, c.reqType, req.encode(), ctx.Done()); err != nil {
+		c.forget(id)
+		if err == errStopped {
+			err = ctx.Err()
+		}
+		return nil, err
+	}
+
+	select {
+	case rep := <-ch:
+		if rep == nil {
+			// the receive loop failed, and c.err says why
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return nil, c.err
+		}
+		if rep.status != statusOK {
+			return nil, ServerError(rep.body)
+		}
+		return rep.body, nil
+	case <-ctx.Done():
+		c.forget(id)
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops receiving replies. Calls still in flight fail with ErrShutdown,
+// and replies already queued for them are discarded. Replies arriving after
+// Close stay on the queue until another Client with the same ReplyType
+// receives and ignores them.
+//
+// Close waits for room on a full queue to wake the receive loop, unless the
+// loop stops first because a reply arrived or the queue was removed.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return ErrShutdown
+	}
+	c.closing = true
+	failed := c.err != nil
+	c.mu.Unlock()
+	c.fail(ErrShutdown)
+
+	// wake up our own blocked msgrcv with a reply nobody is waiting for
+	wake := &reply{id: 0}
+	if err := send(c.q, c.replyType, wake.encode(), c.done); err != nil && err != errStopped && !failed {
+		return err
+	}
+
+	<-c.done
+	c.drain()
+	return nil
+}
+
+// drain discards replies left on the queue for calls that gave up.
+func (c *Client) drain() {
+	for {
+		_, _, err := c.q.Receive(c.maxSize, c.replyType, &sysvipc.MQRecvFlags{DontWait: true, Truncate: true})
+		if err != nil && err != syscall.EINTR {
+			return
+		}
+	}
+}
+
+func (c *Client) forget(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+func (c *Client) receive() {
+	defer close(c.done)
+
+	for {
+		msg, _, err := c.q.Receive(c.maxSize, c.replyType, &sysvipc.MQRecvFlags{Truncate: true})
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		c.mu.Lock()
+		closing := c.closing
+		c.mu.Unlock()
+		if closing {
+			// whatever it is, nobody is waiting for it now
+			return
+		}
+
+		rep, err := decodeReply(msg)
+		if rep == nil || rep.id == 0 {
+			continue
+		}
+		if err != nil {
+			rep.status = statusError
+			rep.body = []byte(err.Error())
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[rep.id]
+		delete(c.pending, rep.id)
+		c.mu.Unlock()
+		if ok {
+			ch <- rep
+		}
+	}
+}
+
+// fail records why the client stopped and releases all waiting calls.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil {
+		c.err = err
+	}
+	for id, ch := range c.pending {
+		delete(c.pending, id)
+		ch <- nil
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Package rpc implements request/reply calls over a single System V message
+queue.
+
+Requests are sent with a shared request mtype that every Server receives on.
+Each Client receives replies on its own mtype (by default its PID), which it
+puts in the request header along with a correlation ID so concurrent calls
+can share the queue.
+*/
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"syscall"
+	"time"
+
+	"github.com/teepark/go-sysvipc"
+)
+
+// DefaultRequestType is the mtype requests are sent with unless overridden.
+// It is above the kernel's PID_MAX_LIMIT so it can't collide with a
+// PID-derived reply type.
+const DefaultRequestType = math.MaxInt32
+
+// DefaultMaxSize is the largest message body read off the queue unless
+// overridden.
+const DefaultMaxSize = sysvipc.DefaultMsgMax
+
+// ServerError is an error returned by a remote handler.
+type ServerError string
+
+func (e ServerError) Error() string {
+	return string(e)
+}
+
+var (
+	// ErrShutdown is returned by calls on a Client that has been closed.
+	ErrShutdown = errors.New("rpc: client is shut down")
+
+	// ErrMethodTooLong is returned by Client.Call for a method name that
+	// doesn't fit the 16-bit length in the request header.
+	ErrMethodTooLong = errors.New("rpc: method name longer than 65535 bytes")
+
+	errMalformed = errors.New("rpc: malformed message")
+	errTooLarge  = errors.New("rpc: message truncated, raise MaxSize")
+	errStopped   = errors.New("rpc: gave up sending")
+)
+
+// maxSendBackoff caps the wait between attempts to send to a full queue.
+const maxSendBackoff = 50 * time.Millisecond
+
+// send sends a message without blocking in msgsnd, so a full queue can't
+// hold the sender forever. It retries with backoff until there's room, or
+// fails with errStopped once stop is closed.
+func send(q sysvipc.MessageQueue, mtyp int64, msg []byte, stop <-chan struct{}) error {
+	wait := time.Millisecond
+	for {
+		err := q.Send(mtyp, msg, &sysvipc.MQSendFlags{DontWait: true})
+		if err != syscall.EAGAIN && err != syscall.EINTR {
+			return err
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-stop:
+			t.Stop()
+			return errStopped
+		}
+		if wait < maxSendBackoff {
+			wait *= 2
+		}
+	}
+}
+
+/*
+wire format, all integers little-endian:
+
+request:  replyType int64 | id uint64 | deadline int64 (unix ns, 0 for none) |
+          bodyLen uint32 | methodLen uint16 | method | body
+reply:    id uint64 | status uint8 | bodyLen uint32 | body (or error text)
+*/
+
+const (
+	requestHeaderLen = 8 + 8 + 8 + 4 + 2
+	replyHeaderLen   = 8 + 1 + 4
+
+	statusOK    = 0
+	statusError = 1
+)
+
+type request struct {
+	replyType int64
+	id        uint64
+	deadline  int64
+	method    string
+	body      []byte
+}
+
+func (r *request) encode() []byte {
+	b := make([]byte, requestHeaderLen+len(r.method)+len(r.body))
+	binary.LittleEndian.PutUint64(b[0:], uint64(r.replyType))
+	binary.LittleEndian.PutUint64(b[8:], r.id)
+	binary.LittleEndian.PutUint64(b[16:], uint64(r.deadline))
+	binary.LittleEndian.PutUint32(b[24:], uint32(len(r.body)))
+	binary.LittleEndian.PutUint16(b[28:], uint16(len(r.method)))
+	copy(b[requestHeaderLen:], r.method)
+	copy(b[requestHeaderLen+len(r.method):], r.body)
+	return b
+}
+
+// decodeRequest parses a request. If only the body was cut short by
+// truncation, it returns the header with errTooLarge so the caller can
+// still be told.
+func decodeRequest(b []byte) (*request, error) {
+	if len(b) < requestHeaderLen {
+		return nil, errMalformed
+	}
+
+	r := &request{
+		replyType: int64(binary.LittleEndian.Uint64(b[0:])),
+		id:        binary.LittleEndian.Uint64(b[8:]),
+		deadline:  int64(binary.LittleEndian.Uint64(b[16:])),
+	}
+	bodyLen := int(binary.LittleEndian.Uint32(b[24:]))
+	methodLen := int(binary.LittleEndian.Uint16(b[28:]))
+
+	b = b[requestHeaderLen:]
+	if len(b) < methodLen {
+		return r, errTooLarge
+	}
+	r.method = string(b[:methodLen])
+	if len(b)-methodLen != bodyLen {
+		if len(b)-methodLen < bodyLen {
+			return r, errTooLarge
+		}
+		return r, errMalformed
+	}
+	r.body = b[methodLen:]
+	return r, nil
+}
+
+type reply struct {
+	id     uint64
+	status uint8
+	body   []byte
+}
+
+func (r *reply) encode() []byte {
+	b := make([]byte, replyHeaderLen+len(r.body))
+	binary.LittleEndian.PutUint64(b[0:], r.id)
+	b[8] = r.status
+	binary.LittleEndian.PutUint32(b[9:], uint32(len(r.body)))
+	copy(b[replyHeaderLen:], r.body)
+	return b
+}
+
+func decodeReply(b []byte) (*reply, error) {
+	if len(b) < replyHeaderLen {
+		return nil, errMalformed
+	}
+
+	r := &reply{
+		id:     binary.LittleEndian.Uint64(b[0:]),
+		status: b[8],
+	}
+	bodyLen := int(binary.LittleEndian.Uint32(b[9:]))
+	b = b[replyHeaderLen:]
+	if len(b) != bodyLen {
+		if len(b) < bodyLen {
+			return r, errTooLarge
+		}
+		return r, errMalformed
+	}
+	r.body = b
+	return r, nil
+}
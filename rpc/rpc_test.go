@@ -0,0 +1,295 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/teepark/go-sysvipc"
+)
+
+func TestCall(t *testing.T) {
+	q, served := rpcSetup(t, nil)
+	defer rpcTeardown(t, q, served)
+
+	c := NewClient(q, nil)
+	defer c.Close()
+
+	rep, err := c.Call(context.Background(), "echo", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rep) != "hello" {
+		t.Errorf("got back %q", rep)
+	}
+
+	rep, err = c.Call(context.Background(), "echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep) != 0 {
+		t.Errorf("got back %q", rep)
+	}
+}
+
+func TestCallErrors(t *testing.T) {
+	q, served := rpcSetup(t, &ServerOptions{MaxSize: 256})
+	defer rpcTeardown(t, q, served)
+
+	c := NewClient(q, nil)
+	defer c.Close()
+
+	_, err := c.Call(context.Background(), "missing", nil)
+	if _, ok := err.(ServerError); !ok {
+		t.Error("unknown method should give a ServerError", err)
+	}
+
+	_, err = c.Call(context.Background(), "fail", []byte("boom"))
+	if err != ServerError("boom") {
+		t.Error("handler error should come back as a ServerError", err)
+	}
+
+	_, err = c.Call(context.Background(), "echo", bytes.Repeat([]byte("x"), 1024))
+	if _, ok := err.(ServerError); !ok {
+		t.Error("oversized request should give a ServerError", err)
+	}
+}
+
+func TestCallDeadline(t *testing.T) {
+	q, served := rpcSetup(t, nil)
+	defer rpcTeardown(t, q, served)
+
+	c := NewClient(q, nil)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := c.Call(ctx, "sleep", nil); err != context.DeadlineExceeded {
+		t.Error("slow call should have hit its deadline", err)
+	}
+
+	// the late reply must not confuse the next call
+	time.Sleep(100 * time.Millisecond)
+	rep, err := c.Call(context.Background(), "echo", []byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rep) != "after" {
+		t.Errorf("got back %q", rep)
+	}
+}
+
+func TestCallFullQueue(t *testing.T) {
+	q := fullQueue(t)
+	c := NewClient(q, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := c.Call(ctx, "echo", nil); err != context.DeadlineExceeded {
+		t.Error("call on a full queue should hit its deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("call blocked past its deadline for", elapsed)
+	}
+
+	// make room for Close to wake the receive loop
+	if _, _, err := q.Receive(64, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fullQueue makes a queue with no room for even an empty message.
+func fullQueue(t *testing.T) sysvipc.MessageQueue {
+	q, err := sysvipc.GetMsgQueue(0, &sysvipc.MQFlags{Create: true, Exclusive: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Remove() })
+	if err := q.SetMaxBytes(64); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Send(1, make([]byte, 64), nil); err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestReplyFullQueue(t *testing.T) {
+	q := fullQueue(t)
+	s := NewServer(q, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.reply(ctx, &request{replyType: 2, id: 1}, []byte("late"), nil) }()
+
+	select {
+	case err := <-done:
+		if err != errStopped {
+			t.Error("reply to a full queue should give up", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reply blocked past its context")
+	}
+}
+
+func TestClientCloseFullQueue(t *testing.T) {
+	q := fullQueue(t)
+	c := NewClient(q, nil)
+
+	closed := make(chan error, 1)
+	go func() { closed <- c.Close() }()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := c.Call(context.Background(), "echo", nil); err != ErrShutdown {
+		t.Error("call during Close should fail", err)
+	}
+
+	// make room for the wake message
+	if _, _, err := q.Receive(64, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close didn't finish once there was room")
+	}
+}
+
+func TestCallMethodTooLong(t *testing.T) {
+	q, served := rpcSetup(t, nil)
+	defer rpcTeardown(t, q, served)
+
+	c := NewClient(q, nil)
+	defer c.Close()
+
+	if _, err := c.Call(context.Background(), strings.Repeat("m", 1<<16), nil); err != ErrMethodTooLong {
+		t.Error("a method name over 64KB should be rejected", err)
+	}
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	q, served := rpcSetup(t, nil)
+	defer rpcTeardown(t, q, served)
+
+	clients := []*Client{
+		NewClient(q, &ClientOptions{ReplyType: 1001}),
+		NewClient(q, &ClientOptions{ReplyType: 1002}),
+	}
+	for _, c := range clients {
+		defer c.Close()
+	}
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		c := clients[i%len(clients)]
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := []byte(fmt.Sprintf("call %d", i))
+			rep, err := c.Call(context.Background(), "echo", body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(rep, body) {
+				t.Errorf("call %d got back %q", i, rep)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestClientClose(t *testing.T) {
+	q, served := rpcSetup(t, nil)
+	defer rpcTeardown(t, q, served)
+
+	c := NewClient(q, nil)
+
+	errc := make(chan error)
+	go func() {
+		_, err := c.Call(context.Background(), "sleep", nil)
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != ErrShutdown {
+		t.Error("in-flight call should fail on Close", err)
+	}
+	if _, err := c.Call(context.Background(), "echo", nil); err != ErrShutdown {
+		t.Error("call after Close should fail", err)
+	}
+	if err := c.Close(); err != ErrShutdown {
+		t.Error("double Close should fail", err)
+	}
+}
+
+func TestQueueRemoved(t *testing.T) {
+	q, served := rpcSetup(t, nil)
+	c := NewClient(q, nil)
+
+	if err := q.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	// EINVAL if the queue was already gone when Serve got to msgrcv
+	if err := <-served; err != syscall.EIDRM && err != syscall.EINVAL {
+		t.Error("Serve should end with EIDRM", err)
+	}
+	if _, err := c.Call(context.Background(), "echo", nil); err == nil {
+		t.Error("call on a removed queue should fail")
+	}
+	c.Close()
+}
+
+func rpcSetup(t *testing.T, opts *ServerOptions) (sysvipc.MessageQueue, chan error) {
+	q, err := sysvipc.GetMsgQueue(0, &sysvipc.MQFlags{
+		Create:    true,
+		Exclusive: true,
+		Perms:     0600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(q, opts)
+	s.Handle("echo", func(ctx context.Context, body []byte) ([]byte, error) {
+		return body, nil
+	})
+	s.Handle("fail", func(ctx context.Context, body []byte) ([]byte, error) {
+		return nil, errors.New(string(body))
+	})
+	s.Handle("sleep", func(ctx context.Context, body []byte) ([]byte, error) {
+		time.Sleep(50 * time.Millisecond)
+		return nil, nil
+	})
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve()
+	}()
+	return q, served
+}
+
+func rpcTeardown(t *testing.T, q sysvipc.MessageQueue, served chan error) {
+	if err := q.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	<-served
+}
@@ -0,0 +1,136 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/teepark/go-sysvipc"
+)
+
+// Handler answers a single request. The context carries the caller's
+// deadline, if it set one.
+type Handler func(ctx context.Context, body []byte) ([]byte, error)
+
+// Server reads requests off a message queue and dispatches them by method.
+type Server struct {
+	q       sysvipc.MessageQueue
+	reqType int64
+	maxSize uint
+
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+// ServerOptions holds the options for NewServer.
+type ServerOptions struct {
+	// RequestType is the mtype to receive requests on. It defaults to
+	// DefaultRequestType and must match the clients' setting.
+	RequestType int64
+
+	// MaxSize is the largest request message (including its header) to
+	// accept, defaulting to DefaultMaxSize. Larger requests are answered
+	// with an error.
+	MaxSize uint
+}
+
+func (so *ServerOptions) requestType() int64 {
+	if so == nil || so.RequestType == 0 {
+		return DefaultRequestType
+	}
+	return so.RequestType
+}
+
+func (so *ServerOptions) maxSize() uint {
+	if so == nil || so.MaxSize == 0 {
+		return DefaultMaxSize
+	}
+	return so.MaxSize
+}
+
+// NewServer creates a Server for requests arriving on q.
+func NewServer(q sysvipc.MessageQueue, opts *ServerOptions) *Server {
+	return &Server{
+		q:        q,
+		reqType:  opts.requestType(),
+		maxSize:  opts.maxSize(),
+		handlers: make(map[string]Handler),
+	}
+}
+
+// Handle registers the handler for a method name, replacing any previous one.
+func (s *Server) Handle(method string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[method] = h
+}
+
+// Serve receives and dispatches requests until receiving fails, which is
+// normally because the queue was removed (syscall.EIDRM). Each request is
+// handled in its own goroutine. Handlers' contexts are canceled when Serve
+// returns, and replies still waiting for room on a full queue are dropped.
+func (s *Server) Serve() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for {
+		msg, _, err := s.q.Receive(s.maxSize, s.reqType, &sysvipc.MQRecvFlags{Truncate: true})
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		req, err := decodeRequest(msg)
+		if req == nil {
+			// can't even tell who to reply to
+			continue
+		}
+		go s.dispatch(ctx, req, err)
+	}
+}
+
+func (s *Server) dispatch(ctx context.Context, req *request, decodeErr error) {
+	if decodeErr != nil {
+		s.reply(ctx, req, nil, decodeErr)
+		return
+	}
+
+	if req.deadline != 0 {
+		deadline := time.Unix(0, req.deadline)
+		if time.Now().After(deadline) {
+			// nobody is waiting for this anymore
+			return
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	s.mu.RLock()
+	h, ok := s.handlers[req.method]
+	s.mu.RUnlock()
+	if !ok {
+		s.reply(ctx, req, nil, ServerError("rpc: no such method: "+req.method))
+		return
+	}
+
+	body, err := h(ctx, req.body)
+	s.reply(ctx, req, body, err)
+}
+
+// reply sends a reply, waiting for room on a full queue until ctx is done:
+// then the caller has given up, or Serve has returned. Its error is only
+// for tests; dispatch has nobody to report it to.
+func (s *Server) reply(ctx context.Context, req *request, body []byte, err error) error {
+	rep := &reply{id: req.id, status: statusOK, body: body}
+	if err != nil {
+		rep.status = statusError
+		rep.body = []byte(err.Error())
+	}
+
+	return send(s.q, req.replyType, rep.encode(), ctx.Done())
+}
@@ -0,0 +1,204 @@
+package sysvipc
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// ErrScopeClosed is returned when creating an object through a Scope that
+// has already been closed.
+var ErrScopeClosed = errors.New("sysvipc: scope is closed")
+
+// ScopeFlags holds the options for NewScope.
+type ScopeFlags struct {
+	// CatchSignals makes the scope remove its objects on SIGINT or SIGTERM
+	// and then re-raise the signal, so the process still dies of it (unless
+	// something else is handling it too).
+	CatchSignals bool
+}
+
+func (sf *ScopeFlags) catchSignals() bool {
+	return sf != nil && sf.CatchSignals
+}
+
+// Scope tracks IPC objects so they can all be removed together, typically
+// with a deferred Close, which also runs if the function panics.
+//
+// Only objects the Scope's Get methods actually create are tracked. Ones
+// that already existed are returned untracked, so Close never removes an
+// object some other process made.
+type Scope struct {
+	mu      sync.Mutex
+	handles []Handle
+	closed  bool
+
+	sigs chan os.Signal
+	done chan struct{}
+}
+
+// NewScope creates an empty Scope.
+func NewScope(flags *ScopeFlags) *Scope {
+	sc := &Scope{done: make(chan struct{})}
+
+	if flags.catchSignals() {
+		sc.sigs = make(chan os.Signal, 1)
+		signal.Notify(sc.sigs, syscall.SIGINT, syscall.SIGTERM)
+		go sc.watch()
+	}
+	return sc
+}
+
+func (sc *Scope) watch() {
+	select {
+	case sig := <-sc.sigs:
+		// Close stops the notifications, so the runtime's usual handling
+		// applies to the re-raised signal
+		sc.Close()
+		syscall.Kill(os.Getpid(), sig.(syscall.Signal))
+	case <-sc.done:
+	}
+}
+
+// GetMsgQueue calls the package-level GetMsgQueue, and tracks the queue if
+// this call created it.
+func (sc *Scope) GetMsgQueue(key int64, flags *MQFlags) (MessageQueue, error) {
+	var f MQFlags
+	if flags != nil {
+		f = *flags
+	}
+	mq, created, err := createOrOpen(f.Create, f.Exclusive, func(create, excl bool) (MessageQueue, error) {
+		f.Create, f.Exclusive = create, excl
+		return GetMsgQueue(key, &f)
+	})
+	if err != nil || !created {
+		return mq, err
+	}
+	return mq, sc.track(mq.Handle())
+}
+
+// GetSemSet calls the package-level GetSemSet, and tracks the set if this
+// call created it.
+func (sc *Scope) GetSemSet(key, count int64, flags *SemSetFlags) (*SemaphoreSet, error) {
+	var f SemSetFlags
+	if flags != nil {
+		f = *flags
+	}
+	ss, created, err := createOrOpen(f.Create, f.Exclusive, func(create, excl bool) (*SemaphoreSet, error) {
+		f.Create, f.Exclusive = create, excl
+		return GetSemSet(key, count, &f)
+	})
+	if err != nil || !created {
+		return ss, err
+	}
+	return ss, sc.track(ss.Handle())
+}
+
+// GetSharedMem calls the package-level GetSharedMem, and tracks the segment
+// if this call created it.
+func (sc *Scope) GetSharedMem(key int64, size uint64, flags *SHMFlags) (*SharedMem, error) {
+	var f SHMFlags
+	if flags != nil {
+		f = *flags
+	}
+	shm, created, err := createOrOpen(f.Create, f.Exclusive, func(create, excl bool) (*SharedMem, error) {
+		f.Create, f.Exclusive = create, excl
+		return GetSharedMem(key, size, &f)
+	})
+	if err != nil || !created {
+		return shm, err
+	}
+	return shm, sc.track(shm.Handle())
+}
+
+// createOrOpen calls get with Exclusive added when creating, so that it's
+// known whether the object is new, and falls back to opening the existing
+// one if there is one. It reports whether the object was created.
+func createOrOpen[T any](create, excl bool, get func(create, excl bool) (T, error)) (T, bool, error) {
+	if !create || excl {
+		v, err := get(create, excl)
+		return v, create && err == nil, err
+	}
+	for {
+		v, err := get(true, true)
+		if err != syscall.EEXIST {
+			return v, err == nil, err
+		}
+		// retry the create if it was removed in between
+		if v, err = get(false, false); err != syscall.ENOENT {
+			return v, false, err
+		}
+	}
+}
+
+// Track adds an object obtained some other way to the scope.
+func (sc *Scope) Track(h Handle) error {
+	return sc.track(h)
+}
+
+// track removes the object straight away if the scope is already closed,
+// rather than leak it.
+func (sc *Scope) track(h Handle) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.closed {
+		h.Remove()
+		return ErrScopeClosed
+	}
+	for _, th := range sc.handles {
+		if th == h {
+			return nil
+		}
+	}
+	sc.handles = append(sc.handles, h)
+	return nil
+}
+
+// Keep stops tracking an object, so that Close leaves it in place.
+func (sc *Scope) Keep(h Handle) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for i, th := range sc.handles {
+		if th == h {
+			sc.handles = append(sc.handles[:i], sc.handles[i+1:]...)
+			return
+		}
+	}
+}
+
+// Handles returns the objects currently tracked, oldest first.
+func (sc *Scope) Handles() []Handle {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return append([]Handle(nil), sc.handles...)
+}
+
+// Close removes every tracked object, newest first, and returns the first
+// error encountered. Objects that were already removed aren't an error.
+// Closing a closed Scope does nothing.
+func (sc *Scope) Close() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.closed {
+		return nil
+	}
+	sc.closed = true
+	if sc.sigs != nil {
+		signal.Stop(sc.sigs)
+	}
+	close(sc.done)
+
+	var first error
+	for i := len(sc.handles) - 1; i >= 0; i-- {
+		if err := ignoreGone(sc.handles[i].Remove()); err != nil && first == nil {
+			first = err
+		}
+	}
+	sc.handles = nil
+	return first
+}
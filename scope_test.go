@@ -0,0 +1,215 @@
+package sysvipc
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// scopeObjects creates one of each kind of private object through sc.
+func scopeObjects(t *testing.T, sc *Scope) []Handle {
+	mq, err := sc.GetMsgQueue(0, &MQFlags{Create: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := sc.GetSemSet(0, 2, &SemSetFlags{Create: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := sc.GetSharedMem(0, 4096, &SHMFlags{Create: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []Handle{mq.Handle(), s.Handle(), m.Handle()}
+}
+
+func exists(h Handle) bool {
+	var err error
+	switch h.Kind {
+	case HandleMsgQueue:
+		_, err = h.MsgQueue()
+	case HandleSemSet:
+		_, err = h.SemSet()
+	case HandleSharedMem:
+		_, err = h.SharedMem()
+	}
+	return err == nil
+}
+
+func TestScopeClose(t *testing.T) {
+	sc := NewScope(nil)
+	handles := scopeObjects(t, sc)
+
+	kept := handles[1]
+	sc.Keep(kept)
+	defer kept.Remove()
+
+	if got := sc.Handles(); len(got) != 2 || got[0] != handles[0] || got[1] != handles[2] {
+		t.Error("wrong tracked handles", got)
+	}
+
+	if err := sc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range handles {
+		if h == kept {
+			if !exists(h) {
+				t.Error("kept object was removed", h)
+			}
+		} else if exists(h) {
+			t.Error("object left behind", h)
+		}
+	}
+
+	if err := sc.Close(); err != nil {
+		t.Error("second Close should do nothing", err)
+	}
+}
+
+func TestScopeLeavesExisting(t *testing.T) {
+	const key = 0xDA7ABA5E
+	mq, err := GetMsgQueue(key, &MQFlags{Create: true, Exclusive: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.Remove()
+	ss, err := GetSemSet(key, 1, &SemSetFlags{Create: true, Exclusive: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Remove()
+	shm, err := GetSharedMem(key, 4096, &SHMFlags{Create: true, Exclusive: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shm.Remove()
+
+	sc := NewScope(nil)
+	if got, err := sc.GetMsgQueue(key, &MQFlags{Create: true, Perms: 0600}); err != nil || got != mq {
+		t.Fatal("should have opened the existing queue", got, err)
+	}
+	if got, err := sc.GetSemSet(key, 1, &SemSetFlags{Create: true, Perms: 0600}); err != nil || got.ID() != ss.ID() {
+		t.Fatal("should have opened the existing set", err)
+	}
+	if got, err := sc.GetSharedMem(key, 4096, nil); err != nil || got.ID() != shm.ID() {
+		t.Fatal("should have opened the existing segment", err)
+	}
+	if _, err := sc.GetMsgQueue(key, &MQFlags{Create: true, Exclusive: true}); err != syscall.EEXIST {
+		t.Error("Exclusive should still fail on an existing queue", err)
+	}
+	created := scopeObjects(t, sc)
+
+	if got := sc.Handles(); len(got) != len(created) {
+		t.Error("only the created objects should be tracked", got)
+	}
+	if err := sc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []Handle{mq.Handle(), ss.Handle(), shm.Handle()} {
+		if !exists(h) {
+			t.Error("Close removed a pre-existing object", h)
+		}
+	}
+	for _, h := range created {
+		if exists(h) {
+			t.Error("Close left a created object", h)
+		}
+	}
+}
+
+func TestScopePanic(t *testing.T) {
+	var handles []Handle
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected a panic")
+			}
+		}()
+
+		sc := NewScope(nil)
+		defer sc.Close()
+
+		handles = scopeObjects(t, sc)
+		panic("oops")
+	}()
+
+	if len(handles) != 3 {
+		t.Fatal("objects weren't created")
+	}
+	for _, h := range handles {
+		if exists(h) {
+			t.Error("object left behind after panic", h)
+			h.Remove()
+		}
+	}
+}
+
+func TestScopeClosed(t *testing.T) {
+	sc := NewScope(nil)
+	sc.Close()
+
+	mq, err := sc.GetMsgQueue(0, &MQFlags{Create: true, Perms: 0600})
+	if err != ErrScopeClosed {
+		t.Error("creating through a closed scope should fail", err)
+	}
+	if exists(mq.Handle()) {
+		t.Error("object created through a closed scope was left behind")
+		mq.Remove()
+	}
+}
+
+// TestScopeHelperProcess isn't a real test; TestScopeSignal runs it in a
+// child process to be killed while holding objects.
+func TestScopeHelperProcess(t *testing.T) {
+	if os.Getenv("SYSVIPC_SCOPE_HELPER") != "1" {
+		t.Skip("only run as a helper process")
+	}
+	sc := NewScope(&ScopeFlags{CatchSignals: true})
+	for _, h := range scopeObjects(t, sc) {
+		fmt.Println(h)
+	}
+	time.Sleep(time.Minute)
+	t.Fatal("wasn't killed")
+}
+
+func TestScopeSignal(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestScopeHelperProcess$")
+	cmd.Env = append(os.Environ(), "SYSVIPC_SCOPE_HELPER=1")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var handles []Handle
+	br := bufio.NewReader(out)
+	for i := 0; i < 3; i++ {
+		h, err := ReadHandle(br)
+		if err != nil {
+			cmd.Process.Kill()
+			t.Fatal(err)
+		}
+		handles = append(handles, h)
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	err = cmd.Wait()
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); !ok ||
+		!status.Signaled() || status.Signal() != syscall.SIGTERM {
+		t.Error("helper should have died of SIGTERM", err)
+	}
+
+	for _, h := range handles {
+		if exists(h) {
+			t.Error("object left behind after SIGTERM", h)
+			h.Remove()
+		}
+	}
+}
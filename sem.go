@@ -45,13 +45,33 @@ type SemaphoreSet struct {
 
 // GetSemSet creates or retrieves the semaphore set for a given IPC key.
 func GetSemSet(key, count int64, flags *SemSetFlags) (*SemaphoreSet, error) {
+	ob := observe()
 	rc, err := C.semget(C.key_t(key), C.int(count), C.int(flags.flags()))
+	ob.done(OpSemGet, int64(rc), 0, rc == -1, err)
 	if rc == -1 {
 		return nil, err
 	}
 	return &SemaphoreSet{int64(rc), uint(count)}, nil
 }
 
+// OpenSemSetByID returns the semaphore set with a kernel id, such as one
+// passed down from a parent process or listed by ipcs. It fails if there is
+// no such set or the caller isn't allowed to read it.
+func OpenSemSetByID(id int64) (*SemaphoreSet, error) {
+	ss := &SemaphoreSet{id: id}
+	info, err := ss.Stat()
+	if err != nil {
+		return nil, err
+	}
+	ss.count = info.Count
+	return ss, nil
+}
+
+// ID returns the kernel's id for the semaphore set.
+func (ss *SemaphoreSet) ID() int64 {
+	return ss.id
+}
+
 // Run applies a group of SemOps atomically.
 func (ss *SemaphoreSet) Run(ops *SemOps, timeout time.Duration) error {
 	var cto *C.struct_timespec
@@ -67,7 +87,9 @@ func (ss *SemaphoreSet) Run(ops *SemOps, timeout time.Duration) error {
 		opptr = &(*ops)[0]
 	}
 
+	ob := observe()
 	rc, err := C.semtimedop(C.int(ss.id), opptr, C.size_t(len(*ops)), cto)
+	ob.done(OpSemRun, ss.id, 0, rc == -1, err)
 	if rc == -1 {
 		return err
 	}
@@ -76,7 +98,9 @@ func (ss *SemaphoreSet) Run(ops *SemOps, timeout time.Duration) error {
 
 // Getval retrieves the value of a single semaphore in the set
 func (ss *SemaphoreSet) Getval(num uint16) (int, error) {
+	ob := observe()
 	val, err := C.semctl_noarg(C.int(ss.id), C.int(num), C.GETVAL)
+	ob.done(OpSemGetval, ss.id, 0, val == -1, err)
 	if val == -1 {
 		return -1, err
 	}
@@ -85,7 +109,9 @@ func (ss *SemaphoreSet) Getval(num uint16) (int, error) {
 
 // Setval sets the value of a single semaphore in the set
 func (ss *SemaphoreSet) Setval(num uint16, value int) error {
+	ob := observe()
 	val, err := C.semctl_val(C.int(ss.id), C.int(num), C.SETVAL, C.int(value))
+	ob.done(OpSemSetval, ss.id, 0, val == -1, err)
 	if val == -1 {
 		return err
 	}
@@ -96,7 +122,9 @@ func (ss *SemaphoreSet) Setval(num uint16, value int) error {
 func (ss *SemaphoreSet) Getall() ([]uint16, error) {
 	carr := make([]C.ushort, ss.count)
 
+	ob := observe()
 	rc, err := C.semctl_arr(C.int(ss.id), C.GETALL, &carr[0])
+	ob.done(OpSemGetall, ss.id, 0, rc == -1, err)
 	if rc == -1 {
 		return nil, err
 	}
@@ -119,7 +147,9 @@ func (ss *SemaphoreSet) Setall(values []uint16) error {
 		carr[i] = C.ushort(val)
 	}
 
+	ob := observe()
 	rc, err := C.semctl_arr(C.int(ss.id), C.SETALL, &carr[0])
+	ob.done(OpSemSetall, ss.id, 0, rc == -1, err)
 	if rc == -1 {
 		return err
 	}
@@ -128,7 +158,9 @@ func (ss *SemaphoreSet) Setall(values []uint16) error {
 
 // Getpid returns the last process id to operate on the num-th semaphore
 func (ss *SemaphoreSet) Getpid(num uint16) (int, error) {
+	ob := observe()
 	rc, err := C.semctl_noarg(C.int(ss.id), C.int(num), C.GETPID)
+	ob.done(OpSemGetpid, ss.id, 0, rc == -1, err)
 	if rc == -1 {
 		return 0, err
 	}
@@ -137,7 +169,9 @@ func (ss *SemaphoreSet) Getpid(num uint16) (int, error) {
 
 // GetNCnt returns the # of those blocked Decrementing the num-th semaphore
 func (ss *SemaphoreSet) GetNCnt(num uint16) (int, error) {
+	ob := observe()
 	rc, err := C.semctl_noarg(C.int(ss.id), C.int(num), C.GETNCNT)
+	ob.done(OpSemGetNCnt, ss.id, 0, rc == -1, err)
 	if rc == -1 {
 		return 0, err
 	}
@@ -146,7 +180,9 @@ func (ss *SemaphoreSet) GetNCnt(num uint16) (int, error) {
 
 // GetZCnt returns the # of those blocked on WaitZero on the num-th semaphore
 func (ss *SemaphoreSet) GetZCnt(num uint16) (int, error) {
+	ob := observe()
 	rc, err := C.semctl_noarg(C.int(ss.id), C.int(num), C.GETZCNT)
+	ob.done(OpSemGetZCnt, ss.id, 0, rc == -1, err)
 	if rc == -1 {
 		return 0, err
 	}
@@ -157,27 +193,24 @@ func (ss *SemaphoreSet) GetZCnt(num uint16) (int, error) {
 func (ss *SemaphoreSet) Stat() (*SemSetInfo, error) {
 	sds := C.struct_semid_ds{}
 
+	ob := observe()
 	rc, err := C.semctl_buf(C.int(ss.id), C.IPC_STAT, &sds)
+	ob.done(OpSemStat, ss.id, 0, rc == -1, err)
 	if rc == -1 {
 		return nil, err
 	}
 
 	ssinf := SemSetInfo{
-		Perms: IpcPerms{
-			OwnerUID:   int(sds.sem_perm.uid),
-			OwnerGID:   int(sds.sem_perm.gid),
-			CreatorUID: int(sds.sem_perm.cuid),
-			CreatorGID: int(sds.sem_perm.cgid),
-			Mode:       uint16(sds.sem_perm.mode),
-		},
-		LastOp:     time.Unix(int64(sds.sem_otime), 0),
-		LastChange: time.Unix(int64(sds.sem_ctime), 0),
+		Perms:      ipcPerms(&sds.sem_perm),
+		LastOp:     ipcTime(int64(sds.sem_otime)),
+		LastChange: ipcTime(int64(sds.sem_ctime)),
 		Count:      uint(sds.sem_nsems),
 	}
 	return &ssinf, nil
 }
 
-// Set updates parameters of the semaphore set.
+// Set updates parameters of the semaphore set. Owner and mode are both
+// written, so start from Stat or use Update to change only one.
 func (ss *SemaphoreSet) Set(ssi *SemSetInfo) error {
 	sds := &C.struct_semid_ds{
 		sem_perm: C.struct_ipc_perm{
@@ -187,17 +220,44 @@ func (ss *SemaphoreSet) Set(ssi *SemSetInfo) error {
 		},
 	}
 
+	ob := observe()
 	rc, err := C.semctl_buf(C.int(ss.id), C.IPC_SET, sds)
+	ob.done(OpSemSet, ss.id, 0, rc == -1, err)
 	if rc == -1 {
 		return err
 	}
 	return nil
 }
 
+// Update reads the semaphore set's parameters, passes them to fn for
+// changes, and writes them back. Fields fn leaves alone keep their current
+// values.
+func (ss *SemaphoreSet) Update(fn func(*SemSetInfo)) error {
+	ssi, err := ss.Stat()
+	if err != nil {
+		return err
+	}
+	fn(ssi)
+	return ss.Set(ssi)
+}
+
+// Chmod changes the permission bits (rwxrwxrwx) of the semaphore set.
+func (ss *SemaphoreSet) Chmod(perms int) error {
+	return ss.Update(func(ssi *SemSetInfo) { ssi.Perms.Mode = uint16(perms) })
+}
+
+// Chown changes the owner of the semaphore set. A uid or gid of -1 leaves
+// that value unchanged.
+func (ss *SemaphoreSet) Chown(uid, gid int) error {
+	return ss.Update(func(ssi *SemSetInfo) { chown(&ssi.Perms, uid, gid) })
+}
+
 // Remove deletes the semaphore set.
 // This will also awake anyone blocked on the set with EIDRM.
 func (ss *SemaphoreSet) Remove() error {
+	ob := observe()
 	rc, err := C.semctl_noarg(C.int(ss.id), 0, C.IPC_RMID)
+	ob.done(OpSemRemove, ss.id, 0, rc == -1, err)
 	if rc == -1 {
 		return err
 	}
@@ -252,7 +312,27 @@ func (so *SemOps) Decrement(num uint16, by int16, flags *SemOpFlags) error {
 	return nil
 }
 
+// semOp is a decoded operation from SemOps.
+type semOp struct {
+	num      uint16
+	op       int16
+	dontWait bool
+}
+
+func (so *SemOps) list() []semOp {
+	ops := make([]semOp, len(*so))
+	for i, sb := range *so {
+		ops[i] = semOp{
+			num:      uint16(sb.sem_num),
+			op:       int16(sb.sem_op),
+			dontWait: sb.sem_flg&C.IPC_NOWAIT != 0,
+		}
+	}
+	return ops
+}
+
 // SemSetInfo holds meta information about a semaphore set.
+// Times are the zero time.Time if the event hasn't happened yet.
 type SemSetInfo struct {
 	Perms      IpcPerms
 	LastOp     time.Time
@@ -295,6 +375,10 @@ type SemOpFlags struct {
 	// DontWait causes calls that would otherwise block
 	// to instead fail with syscall.EAGAIN
 	DontWait bool
+
+	// Undo has the kernel reverse the operation when the process exits,
+	// so a semaphore held by a process that dies is released.
+	Undo bool
 }
 
 func (so *SemOpFlags) flags() int64 {
@@ -306,6 +390,9 @@ func (so *SemOpFlags) flags() int64 {
 	if so.DontWait {
 		f |= int64(C.IPC_NOWAIT)
 	}
+	if so.Undo {
+		f |= int64(C.SEM_UNDO)
+	}
 
 	return f
 }
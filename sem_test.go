@@ -375,6 +375,29 @@ func TestSemSetSet(t *testing.T) {
 	}
 }
 
+func TestSemSetChmod(t *testing.T) {
+	semSetup(t)
+	defer semTeardown(t)
+
+	if err := ss.Chmod(0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Chown(-1, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := ss.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Perms.Mode&0777 != 0640 {
+		t.Errorf("wrong mode: %o", info.Perms.Mode)
+	}
+	if info.Perms.OwnerUID != os.Getuid() || info.Perms.OwnerGID != os.Getgid() {
+		t.Error("owner changed:", info.Perms.OwnerUID, info.Perms.OwnerGID)
+	}
+}
+
 func TestSemGetpid(t *testing.T) {
 	semSetup(t)
 	defer semTeardown(t)
@@ -516,3 +539,88 @@ func semTeardown(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func benchSemSet(b *testing.B, ns Namespace, count int64) SemSet {
+	ss, err := ns.GetSemSet(0, count, &SemSetFlags{Create: true, Perms: 0600})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { ss.Remove() })
+	return ss
+}
+
+// BenchmarkSemRun measures an uncontended Run, alternately incrementing and
+// decrementing a semaphore.
+func BenchmarkSemRun(b *testing.B) {
+	backends(b, func(b *testing.B, ns Namespace) {
+		ss := benchSemSet(b, ns, 1)
+		inc, dec := NewSemOps(), NewSemOps()
+		inc.Increment(0, 1, nil)
+		dec.Decrement(0, 1, nil)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			ops := inc
+			if i%2 == 1 {
+				ops = dec
+			}
+			if err := ss.Run(ops, -1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkSemGetval measures a call that only reads a value.
+func BenchmarkSemGetval(b *testing.B) {
+	backends(b, func(b *testing.B, ns Namespace) {
+		ss := benchSemSet(b, ns, 1)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			if _, err := ss.Getval(0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkSemPingPong measures a round trip between two goroutines, each
+// waking the other through a semaphore. BenchmarkCrossSemPingPong does the
+// same between processes.
+func BenchmarkSemPingPong(b *testing.B) {
+	backends(b, func(b *testing.B, ns Namespace) {
+		ss := benchSemSet(b, ns, 2)
+
+		// ping posts semaphore 0 then waits on 1, pong does the reverse
+		post, wait, pong := NewSemOps(), NewSemOps(), NewSemOps()
+		post.Increment(0, 1, nil)
+		wait.Decrement(1, 1, nil)
+		pong.Decrement(0, 1, nil)
+		pong.Increment(1, 1, nil)
+
+		errs := make(chan error, 1)
+		go func() {
+			for i := 0; i < b.N; i++ {
+				if err := ss.Run(pong, -1); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			if err := ss.Run(post, -1); err != nil {
+				b.Fatal(err)
+			}
+			if err := ss.Run(wait, -1); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := <-errs; err != nil {
+			b.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,213 @@
+package sysvipc
+
+import (
+	"errors"
+	"reflect"
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+)
+
+// SeqlockHeaderSize is the number of bytes a Seqlock keeps in front of its
+// payload for the sequence counter.
+const SeqlockHeaderSize = 8
+
+// Seqlock guards a payload region in shared memory for read-mostly data.
+//
+// Writers make the sequence counter odd, copy in the new payload, then make
+// it even again. Readers copy the payload out and retry if the counter was
+// odd or changed in the meantime, so they never block writers (or each
+// other) and need only a read-only attachment. Concurrent writers are
+// serialized by spinning on the counter; a writer that dies mid-update will
+// leave readers spinning forever.
+type Seqlock struct {
+	seq  *uint32
+	data unsafe.Pointer
+	size uint
+
+	readonly bool
+}
+
+// NewSeqlock creates a Seqlock at offset in an attached shared memory segment,
+// guarding the size bytes that follow its header. The offset must be 8-byte
+// aligned. A zero-filled region is a valid Seqlock with an all-zero payload.
+func NewSeqlock(mnt *SharedMemMount, offset, size uint) (*Seqlock, error) {
+	if offset%8 != 0 {
+		return nil, errors.New("sysvipc: seqlock offset must be 8-byte aligned")
+	}
+	if offset > mnt.length || mnt.length-offset < SeqlockHeaderSize+size {
+		return nil, errors.New("sysvipc: seqlock offset out of range")
+	}
+
+	base := unsafe.Pointer(uintptr(mnt.ptr) + uintptr(offset))
+	return &Seqlock{
+		seq:      (*uint32)(base),
+		data:     unsafe.Pointer(uintptr(base) + SeqlockHeaderSize),
+		size:     size,
+		readonly: mnt.readonly,
+	}, nil
+}
+
+// Size returns the length of the payload region.
+func (sl *Seqlock) Size() uint {
+	return sl.size
+}
+
+// Write replaces the payload with p, which must be exactly Size() bytes.
+func (sl *Seqlock) Write(p []byte) error {
+	if sl.readonly {
+		return ErrReadOnlyShm
+	}
+	if uint(len(p)) != sl.size {
+		return errors.New("sysvipc: seqlock write of the wrong size")
+	}
+	if len(p) == 0 {
+		return nil
+	}
+
+	sl.writeFrom(unsafe.Pointer(&p[0]))
+	return nil
+}
+
+// Read copies a consistent snapshot of the payload into p, which must be
+// exactly Size() bytes. It returns the (even) sequence number of the
+// snapshot, which only ever grows with each Write.
+func (sl *Seqlock) Read(p []byte) (uint32, error) {
+	if uint(len(p)) != sl.size {
+		return 0, errors.New("sysvipc: seqlock read of the wrong size")
+	}
+	if len(p) == 0 {
+		return atomic.LoadUint32(sl.seq), nil
+	}
+
+	return sl.readInto(unsafe.Pointer(&p[0])), nil
+}
+
+// Sequence returns the current sequence number without reading the payload.
+// It is odd while a write is in progress.
+func (sl *Seqlock) Sequence() uint32 {
+	return atomic.LoadUint32(sl.seq)
+}
+
+func (sl *Seqlock) writeFrom(src unsafe.Pointer) {
+	for i := 0; ; i++ {
+		s := atomic.LoadUint32(sl.seq)
+		if s&1 == 0 && atomic.CompareAndSwapUint32(sl.seq, s, s+1) {
+			break
+		}
+		backoff(i)
+	}
+
+	// the payload stores mustn't be seen before the odd counter
+	fence()
+	memmove(sl.data, src, uintptr(sl.size))
+	atomic.AddUint32(sl.seq, 1)
+}
+
+func (sl *Seqlock) readInto(dest unsafe.Pointer) uint32 {
+	for i := 0; ; i++ {
+		s := atomic.LoadUint32(sl.seq)
+		if s&1 == 0 {
+			memmove(dest, sl.data, uintptr(sl.size))
+			// An acquire load of the counter only holds back what comes
+			// after it, so without this the payload loads could still be
+			// in flight (on arm64, say) when it's checked.
+			fence()
+			if atomic.LoadUint32(sl.seq) == s {
+				return s
+			}
+		}
+		backoff(i)
+	}
+}
+
+// fence is a full memory barrier for the plain loads and stores of a
+// payload copy. Go's atomic read-modify-writes are sequentially consistent
+// (LOCK XADD on amd64, LDADDAL or an LDAXR/STLXR loop on arm64), so nothing
+// is reordered across one. It works on a private word since readers may only
+// have a read-only attachment.
+func fence() {
+	var w uint32
+	atomic.AddUint32(&w, 0)
+}
+
+// backoff yields the processor once a spin loop has gone on for a while.
+func backoff(attempt int) {
+	if attempt > 16 {
+		runtime.Gosched()
+	}
+}
+
+// TypedSeqlock is a Seqlock whose payload is a single value of type T.
+//
+// T is copied bytewise in and out of shared memory, so it may not contain
+// pointers, slices, strings, maps, channels, funcs or interfaces.
+type TypedSeqlock[T any] struct {
+	sl *Seqlock
+}
+
+// NewTypedSeqlock creates a TypedSeqlock at offset in an attached shared
+// memory segment. The offset must be 8-byte aligned.
+func NewTypedSeqlock[T any](mnt *SharedMemMount, offset uint) (*TypedSeqlock[T], error) {
+	var zero T
+	if !pointerFree(reflect.TypeOf(&zero).Elem()) {
+		return nil, errors.New("sysvipc: seqlock type must not contain pointers")
+	}
+
+	sl, err := NewSeqlock(mnt, offset, uint(unsafe.Sizeof(zero)))
+	if err != nil {
+		return nil, err
+	}
+	return &TypedSeqlock[T]{sl}, nil
+}
+
+// Store replaces the value.
+func (ts *TypedSeqlock[T]) Store(v T) error {
+	if ts.sl.readonly {
+		return ErrReadOnlyShm
+	}
+	if ts.sl.size == 0 {
+		return nil
+	}
+
+	ts.sl.writeFrom(unsafe.Pointer(&v))
+	return nil
+}
+
+// Load returns a consistent snapshot of the value and its sequence number.
+func (ts *TypedSeqlock[T]) Load() (T, uint32) {
+	var v T
+	if ts.sl.size == 0 {
+		return v, ts.sl.Sequence()
+	}
+
+	seq := ts.sl.readInto(unsafe.Pointer(&v))
+	return v, seq
+}
+
+// Seqlock returns the underlying untyped Seqlock.
+func (ts *TypedSeqlock[T]) Seqlock() *Seqlock {
+	return ts.sl
+}
+
+// pointerFree reports whether values of typ can be safely copied to and from
+// shared memory as raw bytes.
+func pointerFree(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return true
+	case reflect.Array:
+		return pointerFree(typ.Elem())
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			if !pointerFree(typ.Field(i).Type) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
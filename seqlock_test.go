@@ -0,0 +1,170 @@
+package sysvipc
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSeqlockErrors(t *testing.T) {
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	if _, err := NewSeqlock(mount, 4, 16); err == nil {
+		t.Error("misaligned offset should fail")
+	}
+
+	if _, err := NewSeqlock(mount, 4088, 16); err == nil {
+		t.Error("payload past the end should fail")
+	}
+
+	sl, err := NewSeqlock(mount, 0, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sl.Write(make([]byte, 15)); err == nil {
+		t.Error("short write should fail")
+	}
+	if _, err := sl.Read(make([]byte, 17)); err == nil {
+		t.Error("long read should fail")
+	}
+
+	roat, err := shm.Attach(&SHMAttachFlags{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer roat.Close()
+
+	rosl, err := NewSeqlock(roat, 0, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rosl.Write(make([]byte, 16)); err != ErrReadOnlyShm {
+		t.Error("write through a read-only mount should fail", err)
+	}
+	if _, err := rosl.Read(make([]byte, 16)); err != nil {
+		t.Error("read through a read-only mount should work", err)
+	}
+
+	if _, err := NewTypedSeqlock[struct{ s string }](mount, 0); err == nil {
+		t.Error("types with pointers should be rejected")
+	}
+	if _, err := NewTypedSeqlock[[]int](mount, 0); err == nil {
+		t.Error("slices should be rejected")
+	}
+}
+
+func TestSeqlockReadWrite(t *testing.T) {
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	sl, err := NewSeqlock(mount, 64, 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 11)
+	seq, err := sl.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 0 || !bytes.Equal(b, make([]byte, 11)) {
+		t.Error("fresh seqlock should be zeroed", seq, b)
+	}
+
+	if err := sl.Write([]byte("test string")); err != nil {
+		t.Fatal(err)
+	}
+	seq, err = sl.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 2 || string(b) != "test string" {
+		t.Errorf("got %q at sequence %d", b, seq)
+	}
+}
+
+type seqRecord struct {
+	Version uint64
+	Fields  [15]uint64
+}
+
+func TestTypedSeqlockContention(t *testing.T) {
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	const writers, readers, writes = 4, 8, 5000
+
+	var stop int32
+	wg := &sync.WaitGroup{}
+
+	for w := 0; w < writers; w++ {
+		mnt, err := shm.Attach(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mnt.Close()
+		tsl, err := NewTypedSeqlock[seqRecord](mnt, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				rec := seqRecord{Version: uint64(w*writes + i)}
+				for j := range rec.Fields {
+					rec.Fields[j] = rec.Version
+				}
+				tsl.Store(rec)
+			}
+		}(w)
+	}
+
+	rwg := &sync.WaitGroup{}
+	for r := 0; r < readers; r++ {
+		mnt, err := shm.Attach(&SHMAttachFlags{ReadOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mnt.Close()
+		tsl, err := NewTypedSeqlock[seqRecord](mnt, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rwg.Add(1)
+		go func() {
+			defer rwg.Done()
+			var last uint32
+			for atomic.LoadInt32(&stop) == 0 {
+				rec, seq := tsl.Load()
+				if seq&1 != 0 || seq < last {
+					t.Errorf("bad sequence %d after %d", seq, last)
+					return
+				}
+				last = seq
+				for _, f := range rec.Fields {
+					if f != rec.Version {
+						t.Errorf("torn read: %+v", rec)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	atomic.StoreInt32(&stop, 1)
+	rwg.Wait()
+
+	tsl, err := NewTypedSeqlock[seqRecord](mount, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, seq := tsl.Load(); seq != 2*writers*writes {
+		t.Errorf("expected %d writes, sequence is %d", writers*writes, seq/2)
+	}
+}
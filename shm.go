@@ -1,25 +1,55 @@
 package sysvipc
 
 /*
+#include <stdint.h>
 #include <string.h>
 #include <sys/ipc.h>
 #include <sys/shm.h>
 int shmget(key_t key, size_t size, int shmflg);
 void *shmat(int shmid, const void *shmaddr, int shmflg);
+void *shmat_addr(int shmid, uintptr_t shmaddr, int shmflg) {
+	return shmat(shmid, (const void *)shmaddr, shmflg);
+};
 int shmdt(const void *shmaddr);
 int shmctl(int shmid, int cmd, struct shmid_ds *buf);
+uintptr_t shmlba() {
+	return SHMLBA;
+};
 */
 import "C"
 import (
+	"bufio"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 )
 
 var (
 	ErrReadOnlyShm = errors.New("Read-Only shared mem attachment")
+
+	// ErrShmLockPerm matches (with errors.Is) the *ShmLockError from
+	// SharedMem.Lock and Unlock when the caller neither owns the segment nor
+	// has CAP_IPC_LOCK, or has an RLIMIT_MEMLOCK of 0.
+	ErrShmLockPerm = errors.New("sysvipc: locking shared mem requires ownership or CAP_IPC_LOCK")
+
+	// ErrShmLockLimit matches the *ShmLockError from SharedMem.Lock when
+	// pinning the segment would exceed the caller's RLIMIT_MEMLOCK.
+	ErrShmLockLimit = errors.New("sysvipc: locking shared mem would exceed RLIMIT_MEMLOCK")
+
+	// ErrTableSetup is returned when opening a WorkQueue or Metrics table
+	// whose setup another process started but never finished, most likely
+	// because it died partway through. The table can't be used, and has to
+	// be replaced with a new segment.
+	ErrTableSetup = errors.New("sysvipc: shared table setup was never finished")
 )
 
 // SharedMem is an allocated block of memory sharable with multiple processes.
@@ -30,53 +60,116 @@ type SharedMem struct {
 
 // GetSharedMem creates or retrieves the shared memory segment for an IPC key
 func GetSharedMem(key int64, size uint64, flags *SHMFlags) (*SharedMem, error) {
+	if err := flags.validate(); err != nil {
+		return nil, err
+	}
+
+	ob := observe()
 	rc, err := C.shmget(C.key_t(key), C.size_t(size), C.int(flags.flags()))
+	ob.done(OpShmGet, int64(rc), 0, rc == -1, err)
+	if rc == -1 && flags.fallback() && hugeUnavailable(err, flags.HugePageSize) {
+		nohuge := *flags
+		nohuge.HugeTLB = false
+		nohuge.HugePageSize = 0
+		ob = observe()
+		rc, err = C.shmget(C.key_t(key), C.size_t(size), C.int(nohuge.flags()))
+		ob.done(OpShmGet, int64(rc), 0, rc == -1, err)
+	}
 	if rc == -1 {
 		return nil, err
 	}
 	return &SharedMem{int64(rc), uint(size)}, nil
 }
 
+// OpenSharedMemByID returns the shared memory segment with a kernel id, such
+// as one passed down from a parent process or listed by ipcs. It fails if
+// there is no such segment or the caller isn't allowed to read it.
+func OpenSharedMemByID(id int64) (*SharedMem, error) {
+	shm := &SharedMem{id: id}
+	info, err := shm.Stat()
+	if err != nil {
+		return nil, err
+	}
+	shm.length = info.SegmentSize
+	return shm, nil
+}
+
+// ID returns the kernel's id for the segment.
+func (shm *SharedMem) ID() int64 {
+	return shm.id
+}
+
+// hugeUnavailable reports whether a failed shmget(SHM_HUGETLB) looks like
+// the system just can't provide huge pages, as opposed to some other error.
+// shmget also fails with EINVAL for a bad size or one that doesn't match an
+// existing segment, so that only counts if the page size isn't offered.
+func hugeUnavailable(err error, pageSize uint64) bool {
+	switch err {
+	case syscall.ENOMEM, syscall.EPERM:
+		return true
+	case syscall.EINVAL:
+		return !hugePageSizeOffered(pageSize)
+	}
+	return false
+}
+
+// hugePageSizeOffered reports whether the kernel has a huge page pool of a
+// size, or any pool at all for size 0 (the default).
+func hugePageSizeOffered(size uint64) bool {
+	const dir = "/sys/kernel/mm/hugepages"
+	if size == 0 {
+		pools, _ := os.ReadDir(dir)
+		return len(pools) > 0
+	}
+	_, err := os.Stat(dir + "/hugepages-" + strconv.FormatUint(size>>10, 10) + "kB")
+	return err == nil
+}
+
 // Attach brings a shared memory segment into the current process's memory space.
 func (shm *SharedMem) Attach(flags *SHMAttachFlags) (*SharedMemMount, error) {
-	ptr, err := C.shmat(C.int(shm.id), nil, C.int(flags.flags()))
+	if err := flags.validate(); err != nil {
+		return nil, err
+	}
+
+	ob := observe()
+	ptr, err := C.shmat_addr(C.int(shm.id), C.uintptr_t(flags.addr()), C.int(flags.flags()))
+	ob.done(OpShmAttach, shm.id, int(shm.length), err != nil, err)
 	if err != nil {
 		return nil, err
 	}
 
-	return &SharedMemMount{ptr, 0, shm.length, flags.ro()}, nil
+	return &SharedMemMount{ptr: ptr, length: shm.length, readonly: flags.ro(), id: shm.id}, nil
 }
 
 // Stat produces meta information about the shared memory segment.
 func (shm *SharedMem) Stat() (*SHMInfo, error) {
 	shmds := C.struct_shmid_ds{}
 
+	ob := observe()
 	rc, err := C.shmctl(C.int(shm.id), C.IPC_STAT, &shmds)
+	ob.done(OpShmStat, shm.id, 0, rc == -1, err)
 	if rc == -1 {
 		return nil, err
 	}
 
 	shminf := SHMInfo{
-		Perms: IpcPerms{
-			OwnerUID:   int(shmds.shm_perm.uid),
-			OwnerGID:   int(shmds.shm_perm.gid),
-			CreatorUID: int(shmds.shm_perm.cuid),
-			CreatorGID: int(shmds.shm_perm.cgid),
-			Mode:       uint16(shmds.shm_perm.mode),
-		},
+		Perms:           ipcPerms(&shmds.shm_perm),
 		SegmentSize:     uint(shmds.shm_segsz),
-		LastAttach:      time.Unix(int64(shmds.shm_atime), 0),
-		LastDetach:      time.Unix(int64(shmds.shm_dtime), 0),
-		LastChange:      time.Unix(int64(shmds.shm_ctime), 0),
+		LastAttach:      ipcTime(int64(shmds.shm_atime)),
+		LastDetach:      ipcTime(int64(shmds.shm_dtime)),
+		LastChange:      ipcTime(int64(shmds.shm_ctime)),
 		CreatorPID:      int(shmds.shm_cpid),
 		LastUserPID:     int(shmds.shm_lpid),
 		CurrentAttaches: uint(shmds.shm_nattch),
+		Locked:          shmds.shm_perm.mode&C.SHM_LOCKED != 0,
+		Destroying:      shmds.shm_perm.mode&C.SHM_DEST != 0,
 	}
 
 	return &shminf, nil
 }
 
-// Set updates parameters of the shared memory segment.
+// Set updates parameters of the shared memory segment. Owner and mode are
+// both written, so start from Stat or use Update to change only one.
 func (shm *SharedMem) Set(info *SHMInfo) error {
 	shmds := &C.struct_shmid_ds{
 		shm_perm: C.struct_ipc_perm{
@@ -86,17 +179,92 @@ func (shm *SharedMem) Set(info *SHMInfo) error {
 		},
 	}
 
+	ob := observe()
 	rc, err := C.shmctl(C.int(shm.id), C.IPC_SET, shmds)
+	ob.done(OpShmSet, shm.id, 0, rc == -1, err)
+	if rc == -1 {
+		return err
+	}
+	return nil
+}
+
+// Update reads the segment's parameters, passes them to fn for changes, and
+// writes them back. Fields fn leaves alone keep their current values.
+func (shm *SharedMem) Update(fn func(*SHMInfo)) error {
+	info, err := shm.Stat()
+	if err != nil {
+		return err
+	}
+	fn(info)
+	return shm.Set(info)
+}
+
+// Chmod changes the permission bits (rwxrwxrwx) of the segment.
+func (shm *SharedMem) Chmod(perms int) error {
+	return shm.Update(func(info *SHMInfo) { info.Perms.Mode = uint16(perms) })
+}
+
+// Chown changes the owner of the segment. A uid or gid of -1 leaves that
+// value unchanged.
+func (shm *SharedMem) Chown(uid, gid int) error {
+	return shm.Update(func(info *SHMInfo) { chown(&info.Perms, uid, gid) })
+}
+
+// Lock pins the shared memory segment in RAM so it is never swapped out.
+func (shm *SharedMem) Lock() error {
+	return shm.lockctl(C.SHM_LOCK, OpShmLock)
+}
+
+// Unlock allows the shared memory segment to be swapped out again.
+func (shm *SharedMem) Unlock() error {
+	return shm.lockctl(C.SHM_UNLOCK, OpShmUnlock)
+}
+
+func (shm *SharedMem) lockctl(cmd C.int, op Op) error {
+	ob := observe()
+	rc, err := C.shmctl(C.int(shm.id), cmd, nil)
+	ob.done(op, shm.id, 0, rc == -1, err)
 	if rc == -1 {
+		if errno, ok := err.(syscall.Errno); ok && (errno == syscall.EPERM || errno == syscall.ENOMEM) {
+			return &ShmLockError{errno}
+		}
 		return err
 	}
 	return nil
 }
 
+// ShmLockError is returned by SharedMem.Lock and Unlock for EPERM and
+// ENOMEM. It matches both the errno and ErrShmLockPerm or ErrShmLockLimit
+// with errors.Is.
+type ShmLockError struct {
+	Errno syscall.Errno
+}
+
+func (e *ShmLockError) Error() string {
+	return e.sentinel().Error()
+}
+
+func (e *ShmLockError) Unwrap() error {
+	return e.Errno
+}
+
+func (e *ShmLockError) Is(target error) bool {
+	return target == e.sentinel()
+}
+
+func (e *ShmLockError) sentinel() error {
+	if e.Errno == syscall.ENOMEM {
+		return ErrShmLockLimit
+	}
+	return ErrShmLockPerm
+}
+
 // Remove marks the shared memory segment for removal.
 // It will be removed when all attachments have been closed.
 func (shm *SharedMem) Remove() error {
+	ob := observe()
 	rc, err := C.shmctl(C.int(shm.id), C.IPC_RMID, nil)
+	ob.done(OpShmRemove, shm.id, 0, rc == -1, err)
 	if rc == -1 {
 		return err
 	}
@@ -111,6 +279,12 @@ type SharedMemMount struct {
 	// We have to store readonly here to prevent Write and WriteByte.
 	// I'd be happy to let it panic, but C segfault panics can't recover.
 	readonly bool
+
+	// fake is set for mounts of a Fake's segment, which aren't shmdt'ed.
+	fake *fakeSegment
+
+	// id is the segment's, for Observers.
+	id int64
 }
 
 // Read pulls bytes out of the shared memory segment.
@@ -226,23 +400,28 @@ func (shma *SharedMemMount) WriteByte(c byte) error {
 // - 1 makes it relative to the current position
 // - 2 makes it relative to the end of the segment
 func (shma *SharedMemMount) Seek(offset int64, whence int) (int64, error) {
-	var endpos int64
+	var base int64
 	switch whence {
 	case 0:
-		endpos = offset
 	case 1:
-		endpos = int64(shma.offset) + offset
+		base = int64(shma.offset)
 	case 2:
-		endpos = int64(shma.length) + offset
+		base = int64(shma.length)
 	default:
 		return 0, errors.New("sysvipc: bad 'whence' value")
 	}
 
+	endpos := base + offset
+	if offset > 0 && endpos < base {
+		// overflowed, but it's past the end either way
+		endpos = math.MaxInt64
+	}
+
 	if endpos < 0 {
 		return int64(shma.offset), errors.New("sysvipc: negative offset")
 	}
 
-	if uint(endpos) > shma.length {
+	if endpos > int64(shma.length) {
 		shma.offset = shma.length
 	} else {
 		shma.offset = uint(endpos)
@@ -251,9 +430,59 @@ func (shma *SharedMemMount) Seek(offset int64, whence int) (int64, error) {
 	return int64(shma.offset), nil
 }
 
+// Addr returns the address at which the segment is attached in this process.
+// It can be handed to SHMAttachFlags.Address to attach elsewhere at the
+// same location.
+func (shma *SharedMemMount) Addr() uintptr {
+	return uintptr(shma.ptr)
+}
+
+// PageSize returns the size of the pages backing the mount, which is larger
+// than os.Getpagesize() for a segment allocated from huge pages. It is read
+// from /proc/self/smaps.
+func (shma *SharedMemMount) PageSize() (uint64, error) {
+	if shma.fake != nil {
+		return uint64(os.Getpagesize()), nil
+	}
+
+	f, err := os.Open("/proc/self/smaps")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	start := fmt.Sprintf("%x-", uintptr(shma.ptr))
+	found := false
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if !found {
+			found = strings.HasPrefix(line, start)
+			continue
+		}
+		if kb, ok := strings.CutPrefix(line, "KernelPageSize:"); ok {
+			n, err := strconv.ParseUint(strings.TrimSpace(strings.TrimSuffix(kb, "kB")), 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return n << 10, nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("sysvipc: mount not found in /proc/self/smaps")
+}
+
 // Close detaches the shared memory segment pointer.
 func (shma *SharedMemMount) Close() error {
+	if seg := shma.fake; seg != nil {
+		shma.fake = nil
+		return seg.detach()
+	}
+	ob := observe()
 	rc, err := C.shmdt(shma.ptr)
+	ob.done(OpShmDetach, shma.id, 0, rc == -1, err)
 	if rc == -1 {
 		return err
 	}
@@ -261,6 +490,10 @@ func (shma *SharedMemMount) Close() error {
 }
 
 // SHMInfo holds meta information about a shared memory segment.
+// Times are the zero time.Time if the event hasn't happened yet.
+//
+// IPC_STAT doesn't say whether a segment was allocated from huge pages, so
+// that isn't here; SharedMemMount.PageSize tells for an attached segment.
 type SHMInfo struct {
 	Perms       IpcPerms
 	SegmentSize uint
@@ -273,6 +506,13 @@ type SHMInfo struct {
 	LastUserPID int
 
 	CurrentAttaches uint
+
+	// Locked is set while the segment is pinned in RAM (see SharedMem.Lock).
+	Locked bool
+
+	// Destroying is set once the segment has been marked for removal, and it
+	// is only waiting for the last detach.
+	Destroying bool
 }
 
 // SHMFlags holds the options for GetSharedMem
@@ -288,8 +528,31 @@ type SHMFlags struct {
 	// Perms is the file-style (rwxrwxrwx) permissions with which to create the
 	// shared memory segment (also only useful with Create).
 	Perms int
+
+	// HugeTLB allocates the segment from the huge page pool (only useful
+	// with Create). The size should then be a multiple of the huge page size.
+	// With HugeTLBFallback it may not have been; SharedMemMount.PageSize
+	// tells which.
+	HugeTLB bool
+
+	// HugePageSize selects a huge page size other than the system default,
+	// in bytes (e.g. 2MB or 1GB). It must be a power of two, and is only
+	// useful with HugeTLB.
+	HugePageSize uint64
+
+	// HugeTLBFallback causes GetSharedMem to retry with normal pages if the
+	// system can't supply huge pages (only useful with HugeTLB).
+	HugeTLBFallback bool
+
+	// NoReserve skips reserving swap space for the segment, so writes may
+	// fail with SIGSEGV if memory runs out (only useful with Create).
+	NoReserve bool
 }
 
+// shmHugeShift is SHM_HUGE_SHIFT from <linux/shm.h>, which glibc's headers
+// don't provide. The log2 of the huge page size is stored above it.
+const shmHugeShift = 26
+
 func (sf *SHMFlags) flags() int64 {
 	if sf == nil {
 		return 0
@@ -302,14 +565,66 @@ func (sf *SHMFlags) flags() int64 {
 	if sf.Exclusive {
 		f |= int64(C.IPC_EXCL)
 	}
+	if sf.HugeTLB {
+		f |= int64(C.SHM_HUGETLB)
+		if sf.HugePageSize != 0 {
+			f |= int64(bits.TrailingZeros64(sf.HugePageSize)) << shmHugeShift
+		}
+	}
+	if sf.NoReserve {
+		f |= int64(C.SHM_NORESERVE)
+	}
 
 	return f
 }
 
+func (sf *SHMFlags) validate() error {
+	if sf == nil {
+		return nil
+	}
+
+	if sf.HugePageSize != 0 {
+		if !sf.HugeTLB {
+			return errors.New("sysvipc: HugePageSize requires HugeTLB")
+		}
+		if sf.HugePageSize&(sf.HugePageSize-1) != 0 {
+			return errors.New("sysvipc: HugePageSize must be a power of two")
+		}
+	}
+	if sf.HugeTLBFallback && !sf.HugeTLB {
+		return errors.New("sysvipc: HugeTLBFallback requires HugeTLB")
+	}
+
+	return nil
+}
+
+func (sf *SHMFlags) fallback() bool {
+	if sf == nil {
+		return false
+	}
+	return sf.HugeTLB && sf.HugeTLBFallback
+}
+
 // SHMAttachFlags holds the options for SharedMem.Attach
 type SHMAttachFlags struct {
 	// ReadOnly causes the new SharedMemMount to be readable but not writable
 	ReadOnly bool
+
+	// Address requests that the segment be attached at a specific address
+	// rather than one chosen by the kernel. It must be a multiple of SHMLBA
+	// unless Round is also set.
+	Address uintptr
+
+	// Round rounds Address down to a multiple of SHMLBA (only useful with
+	// Address).
+	Round bool
+
+	// Remap replaces any existing mapping in the range starting at Address
+	// instead of failing with syscall.EINVAL (only useful with Address).
+	Remap bool
+
+	// Exec allows the contents of the segment to be executed.
+	Exec bool
 }
 
 func (sf *SHMAttachFlags) flags() int64 {
@@ -321,13 +636,92 @@ func (sf *SHMAttachFlags) flags() int64 {
 	if sf.ReadOnly {
 		f |= int64(C.SHM_RDONLY)
 	}
+	if sf.Round {
+		f |= int64(C.SHM_RND)
+	}
+	if sf.Remap {
+		f |= int64(C.SHM_REMAP)
+	}
+	if sf.Exec {
+		f |= int64(C.SHM_EXEC)
+	}
 
 	return f
 }
 
+func (sf *SHMAttachFlags) addr() uintptr {
+	if sf == nil {
+		return 0
+	}
+	return sf.Address
+}
+
+func (sf *SHMAttachFlags) validate() error {
+	if sf == nil {
+		return nil
+	}
+
+	if sf.Address == 0 {
+		if sf.Round {
+			return errors.New("sysvipc: Round requires an Address")
+		}
+		if sf.Remap {
+			return errors.New("sysvipc: Remap requires an Address")
+		}
+		return nil
+	}
+
+	if !sf.Round && sf.Address%uintptr(C.shmlba()) != 0 {
+		return errors.New("sysvipc: Address must be a multiple of SHMLBA unless Round is set")
+	}
+
+	return nil
+}
+
 func (sf *SHMAttachFlags) ro() bool {
 	if sf == nil {
 		return false
 	}
 	return sf.ReadOnly
 }
+
+// headerField is a configuration value in the header of a shared table.
+type headerField struct {
+	p     *uint32
+	value uint32
+}
+
+// headerSetupTimeout is how long setupHeader waits for another process to
+// finish a header, which only takes it a few stores.
+const headerSetupTimeout = time.Second
+
+// setupHeader fills in a shared table's header on first use, or waits for
+// whoever got there first to finish and reports whether they used the same
+// values. The first field's value must be nonzero, since it is claimed with
+// a CAS from 0; the magic number is stored last to mark the header ready.
+// It fails with ErrTableSetup if the header isn't ready in
+// headerSetupTimeout.
+func setupHeader(magic *uint32, want uint32, fields ...headerField) (bool, error) {
+	if atomic.CompareAndSwapUint32(fields[0].p, 0, fields[0].value) {
+		for _, f := range fields[1:] {
+			atomic.StoreUint32(f.p, f.value)
+		}
+		atomic.StoreUint32(magic, want)
+		return true, nil
+	}
+
+	deadline := time.Now().Add(headerSetupTimeout)
+	for atomic.LoadUint32(magic) != want {
+		// someone else is partway through setting it up
+		if time.Now().After(deadline) {
+			return false, ErrTableSetup
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, f := range fields {
+		if atomic.LoadUint32(f.p) != f.value {
+			return false, nil
+		}
+	}
+	return true, nil
+}
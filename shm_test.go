@@ -1,7 +1,13 @@
 package sysvipc
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"os"
 	"syscall"
 	"testing"
@@ -303,6 +309,13 @@ func TestSHMStat(t *testing.T) {
 	if info.CurrentAttaches != 1 {
 		t.Error("wrong number of attaches:", info.CurrentAttaches)
 	}
+	// shmSetup already marked it for removal, which clears the key
+	if info.Perms.Key != 0 || !info.Destroying {
+		t.Errorf("removed segment still has key %x", info.Perms.Key)
+	}
+	if info.LastAttach.IsZero() || !info.LastDetach.IsZero() {
+		t.Error("wrong attach/detach times:", info.LastAttach, info.LastDetach)
+	}
 
 	mnt2, err := shm.Attach(nil)
 	if err != nil {
@@ -349,6 +362,289 @@ func TestSHMSet(t *testing.T) {
 	}
 }
 
+func TestSHMUpdate(t *testing.T) {
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	if err := shm.Chmod(0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := shm.Chown(-1, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	inf, err := shm.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inf.Perms.Mode&0777 != 0640 {
+		t.Errorf("wrong mode: %o", inf.Perms.Mode)
+	}
+	if inf.Perms.OwnerUID != os.Getuid() || inf.Perms.OwnerGID != os.Getgid() {
+		t.Error("owner changed:", inf.Perms.OwnerUID, inf.Perms.OwnerGID)
+	}
+}
+
+func TestSHMAttachFlagValidation(t *testing.T) {
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	if _, err := shm.Attach(&SHMAttachFlags{Round: true}); err == nil {
+		t.Error("Round without an Address should fail")
+	}
+
+	if _, err := shm.Attach(&SHMAttachFlags{Remap: true}); err == nil {
+		t.Error("Remap without an Address should fail")
+	}
+
+	misaligned := mount.Addr() + 1
+	if _, err := shm.Attach(&SHMAttachFlags{Address: misaligned}); err == nil {
+		t.Error("an unaligned Address without Round should fail")
+	}
+
+	if _, err := shm.Attach(&SHMAttachFlags{Address: mount.Addr()}); err != syscall.EINVAL {
+		t.Error("attaching over an existing mapping without Remap should EINVAL", err)
+	}
+}
+
+func TestSHMFixedAddress(t *testing.T) {
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	// find an address that is free by attaching once and letting it go
+	probe, err := shm.Attach(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := probe.Addr()
+	if err := probe.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := shm.Attach(&SHMAttachFlags{Address: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Addr() != addr {
+		t.Fatalf("attached at %x, wanted %x", first.Addr(), addr)
+	}
+
+	// store a raw pointer into the segment, pointing back inside it
+	ptr := uint64(first.Addr() + 64)
+	b := make([]byte, 8)
+	binary.NativeEndian.PutUint64(b, ptr)
+	if _, err := first.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Seek(64, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Write([]byte("pointee")); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := shm.Attach(&SHMAttachFlags{Address: addr, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if second.Addr() != addr {
+		t.Fatalf("attached at %x, wanted %x", second.Addr(), addr)
+	}
+
+	if _, err := second.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.NativeEndian.Uint64(b); got != ptr {
+		t.Fatalf("stored pointer %x, wanted %x", got, ptr)
+	}
+	if _, err := second.Seek(int64(uintptr(ptr)-second.Addr()), 0); err != nil {
+		t.Fatal(err)
+	}
+	holder := make([]byte, 7)
+	if _, err := second.Read(holder); err != nil {
+		t.Fatal(err)
+	}
+	if string(holder) != "pointee" {
+		t.Errorf("pointer led to %q", holder)
+	}
+
+	// each Remap replaces the attachment at addr, so the deferred Close
+	// above ends up detaching the last of them
+	remapped, err := shm.Attach(&SHMAttachFlags{Address: addr, Remap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remapped.Addr() != addr {
+		t.Errorf("remapped at %x, wanted %x", remapped.Addr(), addr)
+	}
+
+	rounded, err := shm.Attach(&SHMAttachFlags{Address: addr + 1, Round: true, Remap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rounded.Addr() != addr {
+		t.Errorf("rounded to %x, wanted %x", rounded.Addr(), addr)
+	}
+}
+
+func TestSHMFlagValidation(t *testing.T) {
+	for _, flags := range []*SHMFlags{
+		{Create: true, HugePageSize: 2 << 20},
+		{Create: true, HugeTLB: true, HugePageSize: 3 << 20},
+		{Create: true, HugeTLBFallback: true},
+	} {
+		if sm, err := GetSharedMem(0xDA7ABA5E, 4096, flags); err == nil {
+			sm.Remove()
+			t.Errorf("%+v should have been rejected", *flags)
+		}
+	}
+
+	flags := &SHMFlags{HugeTLB: true, HugePageSize: 2 << 20, NoReserve: true}
+	want := int64(04000|010000) | 21<<shmHugeShift // SHM_HUGETLB|SHM_NORESERVE, 2MB
+	if f := flags.flags(); f != want {
+		t.Errorf("got flags %o, wanted %o", f, want)
+	}
+}
+
+func TestSHMHugeTLB(t *testing.T) {
+	size := uint64(2 << 20)
+	flags := &SHMFlags{
+		Create:    true,
+		Exclusive: true,
+		Perms:     0600,
+		HugeTLB:   true,
+		NoReserve: true,
+	}
+
+	huge := false
+	sm, err := GetSharedMem(0xDA7ABA5E, size, flags)
+	switch {
+	case err == nil:
+		huge = true
+		sm.Remove()
+	case hugeUnavailable(err, 0):
+		t.Log("no huge pages available:", err)
+	default:
+		t.Fatal(err)
+	}
+
+	flags.HugeTLBFallback = true
+	sm, err = GetSharedMem(0xDA7ABA5E, size, flags)
+	if err != nil {
+		t.Fatal("fallback should have produced a segment", err)
+	}
+	defer sm.Remove()
+
+	info, err := sm.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.SegmentSize != uint(size) {
+		t.Error("wrong size:", info.SegmentSize)
+	}
+
+	mnt, err := sm.Attach(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.Close()
+	pageSize, err := mnt.PageSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotHuge := pageSize > uint64(os.Getpagesize()); gotHuge != huge {
+		t.Errorf("%d-byte pages, but huge pages available: %v", pageSize, huge)
+	}
+}
+
+func TestSHMHugeTLBFallbackErrors(t *testing.T) {
+	existing, err := GetSharedMem(0xDA7ABA5E, 4096, &SHMFlags{Create: true, Exclusive: true, Perms: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer existing.Remove()
+
+	// too big for the existing segment: EINVAL, but not for want of huge pages
+	rec := new(recorder)
+	observeWith(t, rec)
+	flags := &SHMFlags{Create: true, Perms: 0600, HugeTLB: true, HugeTLBFallback: true}
+	if _, err := GetSharedMem(0xDA7ABA5E, 8192, flags); err != syscall.EINVAL {
+		t.Fatal("expected EINVAL, got", err)
+	}
+	if hugePageSizeOffered(0) && len(rec.calls) != 1 {
+		t.Errorf("fell back after an unrelated EINVAL: %v", rec.calls)
+	}
+
+	if !hugeUnavailable(syscall.EINVAL, 1<<50) {
+		t.Error("EINVAL for an unsupported page size should count as unavailable")
+	}
+	if hugeUnavailable(syscall.EEXIST, 0) {
+		t.Error("EEXIST isn't about huge pages")
+	}
+}
+
+func TestShmLockError(t *testing.T) {
+	perm := error(&ShmLockError{syscall.EPERM})
+	if !errors.Is(perm, syscall.EPERM) || !errors.Is(perm, ErrShmLockPerm) || errors.Is(perm, ErrShmLockLimit) {
+		t.Error("EPERM should match syscall.EPERM and ErrShmLockPerm only")
+	}
+	limit := error(&ShmLockError{syscall.ENOMEM})
+	if !errors.Is(limit, syscall.ENOMEM) || !errors.Is(limit, ErrShmLockLimit) || errors.Is(limit, ErrShmLockPerm) {
+		t.Error("ENOMEM should match syscall.ENOMEM and ErrShmLockLimit only")
+	}
+	if limit.Error() != ErrShmLockLimit.Error() {
+		t.Error("wrong message", limit)
+	}
+}
+
+func TestSHMLock(t *testing.T) {
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	info, err := shm.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Locked {
+		t.Error("new segment shouldn't be locked")
+	}
+	if !info.Destroying {
+		t.Error("removed segment with an attachment should be marked for destruction")
+	}
+
+	switch err := shm.Lock(); {
+	case err == nil:
+	case errors.Is(err, ErrShmLockPerm), errors.Is(err, ErrShmLockLimit):
+		t.Skip("not allowed to lock shared mem here:", err)
+	default:
+		t.Fatal(err)
+	}
+
+	info, err = shm.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Locked {
+		t.Error("Lock didn't take")
+	}
+
+	if err := shm.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err = shm.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Locked {
+		t.Error("Unlock didn't take")
+	}
+}
+
 var (
 	shm   *SharedMem
 	mount *SharedMemMount
@@ -380,3 +676,321 @@ func shmSetup(t *testing.T) {
 func shmTeardown(t *testing.T) {
 	mount.Close()
 }
+
+// benchMount attaches a new 1MB segment, already marked for removal.
+func benchMount(b *testing.B, ns Namespace) *SharedMemMount {
+	seg, err := ns.GetSharedMem(0, 1<<20, &SHMFlags{Create: true, Perms: 0600})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer seg.Remove()
+	mnt, err := seg.Attach(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { mnt.Close() })
+	return mnt
+}
+
+var benchSHMSizes = []int{8, 512, 64 << 10, 1 << 20}
+
+// BenchmarkSHMWrite measures copying buffers into a segment.
+func BenchmarkSHMWrite(b *testing.B) {
+	backends(b, func(b *testing.B, ns Namespace) {
+		for _, size := range benchSHMSizes {
+			b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+				mnt := benchMount(b, ns)
+				buf := make([]byte, size)
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					if _, err := mnt.Seek(0, io.SeekStart); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := mnt.Write(buf); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	})
+}
+
+// BenchmarkSHMRead measures copying buffers out of a segment.
+func BenchmarkSHMRead(b *testing.B) {
+	backends(b, func(b *testing.B, ns Namespace) {
+		for _, size := range benchSHMSizes {
+			b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+				mnt := benchMount(b, ns)
+				buf := make([]byte, size)
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					if _, err := mnt.Seek(0, io.SeekStart); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := mnt.Read(buf); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	})
+}
+
+// benchAtomicWords is how many uint32s fit in a benchMount.
+const benchAtomicWords = 1 << 18
+
+// BenchmarkSHMAtomic measures the atomic word accessors.
+func BenchmarkSHMAtomic(b *testing.B) {
+	backends(b, func(b *testing.B, ns Namespace) {
+		b.Run("op=write", func(b *testing.B) {
+			mnt := benchMount(b, ns)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if i%benchAtomicWords == 0 {
+					mnt.Seek(0, io.SeekStart)
+				}
+				if err := mnt.AtomicWriteUint32(uint32(i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run("op=read", func(b *testing.B) {
+			mnt := benchMount(b, ns)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if i%benchAtomicWords == 0 {
+					mnt.Seek(0, io.SeekStart)
+				}
+				if _, err := mnt.AtomicReadUint32(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+}
+
+// fuzzSHMSize isn't a multiple of 4, so the atomic accessors can run off
+// the end.
+const fuzzSHMSize = 61
+
+// shmModel is a reference SharedMemMount over a byte slice.
+type shmModel struct {
+	data []byte
+	off  int
+}
+
+// errModelAny stands for the errors made with errors.New, which are only
+// compared for being non-nil.
+var errModelAny = errors.New("some error")
+
+func (m *shmModel) read(p []byte) (int, error) {
+	var err error
+	if len(p) > len(m.data)-m.off {
+		p, err = p[:len(m.data)-m.off], io.EOF
+	}
+	n := copy(p, m.data[m.off:])
+	m.off += n
+	return n, err
+}
+
+func (m *shmModel) write(p []byte) (int, error) {
+	var err error
+	if len(p) > len(m.data)-m.off {
+		p, err = p[:len(m.data)-m.off], io.ErrShortWrite
+	}
+	n := copy(m.data[m.off:], p)
+	m.off += n
+	return n, err
+}
+
+func (m *shmModel) seek(offset int64, whence int) (int64, error) {
+	var base int64
+	switch whence {
+	case 0:
+	case 1:
+		base = int64(m.off)
+	case 2:
+		base = int64(len(m.data))
+	default:
+		return 0, errModelAny
+	}
+
+	// without overflow
+	pos := new(big.Int).Add(big.NewInt(base), big.NewInt(offset))
+	switch {
+	case pos.Sign() < 0:
+		return int64(m.off), errModelAny
+	case pos.Cmp(big.NewInt(int64(len(m.data)))) > 0:
+		m.off = len(m.data)
+	default:
+		m.off = int(pos.Int64())
+	}
+	return int64(m.off), nil
+}
+
+// fuzzMounts attaches segments from the kernel and a Fake.
+func fuzzMounts(f *testing.F) []*SharedMemMount {
+	var mounts []*SharedMemMount
+	for _, ns := range []Namespace{Kernel, NewFake()} {
+		seg, err := ns.GetSharedMem(0, fuzzSHMSize, &SHMFlags{Create: true, Perms: 0600})
+		if err != nil {
+			f.Fatal(err)
+		}
+		mnt, err := seg.Attach(nil)
+		seg.Remove()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Cleanup(func() { mnt.Close() })
+		mounts = append(mounts, mnt)
+	}
+	return mounts
+}
+
+// FuzzSHMMount runs a sequence of operations encoded in the input against
+// real mounts and a shmModel, checking they agree at every step.
+func FuzzSHMMount(f *testing.F) {
+	seek := func(offset int64, whence byte) []byte {
+		return append(binary.LittleEndian.AppendUint64([]byte{2}, uint64(offset)), whence)
+	}
+	f.Add([]byte{1, 10, 0, 20, 3, 4, 4, 3, 5, 'x', 7, 6, 1, 2, 3, 4})
+	f.Add(append(seek(-5, 2), 0, 8, 1, 8))
+	f.Add(append(seek(math.MaxInt64, 1), 3, 4, 4, 5, 'y'))
+	f.Add(append(append(seek(40, 0), seek(math.MaxInt64-20, 1)...), seek(math.MinInt64, 2)...))
+	f.Add(append(seek(1<<32+3, 0), 4, 0, 255))
+	f.Add(seek(0, 3))
+
+	mounts := fuzzMounts(f)
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		for _, mnt := range mounts {
+			mnt.Seek(0, io.SeekStart)
+			mnt.Write(make([]byte, fuzzSHMSize))
+			mnt.Seek(0, io.SeekStart)
+			runSHMOps(t, mnt, &shmModel{data: make([]byte, fuzzSHMSize)}, ops)
+		}
+	})
+}
+
+func runSHMOps(t *testing.T, mnt *SharedMemMount, model *shmModel, ops []byte) {
+	next := func(n int) []byte {
+		b := make([]byte, n)
+		ops = ops[copy(b, ops):]
+		return b
+	}
+	sameErr := func(step int, got, want error) {
+		if want == errModelAny && got != nil {
+			return
+		}
+		if got != want {
+			t.Fatalf("op %d: error %v, want %v", step, got, want)
+		}
+	}
+
+	for step := 0; len(ops) > 0; step++ {
+		op := next(1)[0] % 8
+		switch op {
+		case 0:
+			n := int(next(1)[0])
+			got, want := make([]byte, n), make([]byte, n)
+			gn, gerr := mnt.Read(got)
+			wn, werr := model.read(want)
+			sameErr(step, gerr, werr)
+			if gn != wn || !bytes.Equal(got[:gn], want[:wn]) {
+				t.Fatalf("op %d: Read %d bytes %x, want %d bytes %x", step, gn, got[:gn], wn, want[:wn])
+			}
+		case 1:
+			p := bytes.Repeat([]byte{byte(step)}, int(next(1)[0]))
+			gn, gerr := mnt.Write(p)
+			wn, werr := model.write(p)
+			sameErr(step, gerr, werr)
+			if gn != wn {
+				t.Fatalf("op %d: Write %d bytes, want %d", step, gn, wn)
+			}
+		case 2:
+			offset := int64(binary.LittleEndian.Uint64(next(8)))
+			whence := int(next(1)[0] % 4)
+			got, gerr := mnt.Seek(offset, whence)
+			want, werr := model.seek(offset, whence)
+			sameErr(step, gerr, werr)
+			if got != want {
+				t.Fatalf("op %d: Seek(%d, %d) = %d, want %d", step, offset, whence, got, want)
+			}
+		case 3:
+			got, gerr := mnt.ReadByte()
+			var want byte
+			var werr error
+			if model.off == len(model.data) {
+				werr = io.EOF
+			} else {
+				want = model.data[model.off]
+				model.off++
+			}
+			sameErr(step, gerr, werr)
+			if got != want {
+				t.Fatalf("op %d: ReadByte %x, want %x", step, got, want)
+			}
+		case 4:
+			var werr error
+			if model.off == 0 {
+				werr = errModelAny
+			} else {
+				model.off--
+			}
+			sameErr(step, mnt.UnreadByte(), werr)
+		case 5:
+			c := next(1)[0]
+			var werr error
+			if model.off == len(model.data) {
+				werr = io.ErrShortWrite
+			} else {
+				model.data[model.off] = c
+				model.off++
+			}
+			sameErr(step, mnt.WriteByte(c), werr)
+		case 6, 7:
+			// unaligned atomics fault on some architectures
+			if model.off%4 != 0 {
+				continue
+			}
+			fits := len(model.data)-model.off >= 4
+			if op == 6 {
+				v := binary.LittleEndian.Uint32(next(4))
+				werr := io.ErrShortWrite
+				if fits {
+					binary.NativeEndian.PutUint32(model.data[model.off:], v)
+					model.off += 4
+					werr = nil
+				}
+				sameErr(step, mnt.AtomicWriteUint32(v), werr)
+			} else {
+				got, gerr := mnt.AtomicReadUint32()
+				var want uint32
+				werr := io.EOF
+				if fits {
+					want = binary.NativeEndian.Uint32(model.data[model.off:])
+					model.off += 4
+					werr = nil
+				}
+				sameErr(step, gerr, werr)
+				if got != want {
+					t.Fatalf("op %d: AtomicReadUint32 %x, want %x", step, got, want)
+				}
+			}
+		}
+
+		if off, _ := mnt.Seek(0, io.SeekCurrent); off != int64(model.off) {
+			t.Fatalf("op %d (%d): offset %d, want %d", step, op, off, model.off)
+		}
+	}
+
+	got := make([]byte, fuzzSHMSize)
+	mnt.Seek(0, io.SeekStart)
+	mnt.Read(got)
+	if !bytes.Equal(got, model.data) {
+		t.Fatalf("contents %x, want %x", got, model.data)
+	}
+}
@@ -0,0 +1,451 @@
+package sysvipc
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	// ErrTableFull is returned by WorkQueue.Lease when every slot of the
+	// in-flight table is taken, even after recovering expired leases.
+	ErrTableFull = errors.New("sysvipc: work queue in-flight table is full")
+
+	// ErrLeaseLost is returned by WorkQueue.Ack and Fail when the job's
+	// lease expired and it was already handed back to the queue.
+	ErrLeaseLost = errors.New("sysvipc: job lease was lost")
+)
+
+// WorkQueueConfig holds the options for NewWorkQueue. Every process using
+// the same work queue must use the same Slots and MaxJobSize.
+type WorkQueueConfig struct {
+	// Slots is the number of jobs that can be leased at once (default 64).
+	Slots int
+
+	// MaxJobSize is the largest job body accepted (default 4096).
+	MaxJobSize uint
+
+	// LeaseTimeout is how long a worker has to Ack a job before it is
+	// handed to someone else (default 30s).
+	LeaseTimeout time.Duration
+
+	// MaxAttempts is how many times a job may be leased without being
+	// acked before it goes to the dead-letter type instead (default 5).
+	MaxAttempts int
+
+	// JobType and DeadLetterType are the mtypes used on the queue for
+	// pending and dead jobs (defaults 1 and 2).
+	JobType        int64
+	DeadLetterType int64
+}
+
+func (c *WorkQueueConfig) withDefaults() WorkQueueConfig {
+	var cfg WorkQueueConfig
+	if c != nil {
+		cfg = *c
+	}
+	if cfg.Slots == 0 {
+		cfg.Slots = 64
+	}
+	if cfg.MaxJobSize == 0 {
+		cfg.MaxJobSize = 4096
+	}
+	if cfg.LeaseTimeout == 0 {
+		cfg.LeaseTimeout = 30 * time.Second
+	}
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.JobType == 0 {
+		cfg.JobType = 1
+	}
+	if cfg.DeadLetterType == 0 {
+		cfg.DeadLetterType = 2
+	}
+	return cfg
+}
+
+/*
+The in-flight table is a header followed by fixed-size slots:
+
+header: magic uint32 | slots uint32 | maxJobSize uint32 | unused uint32
+
+slot:   generation<<2 | state uint64 | holder pid uint32 | unused uint32 |
+        deadline int64 (unix ns) | job id uint64 |
+        attempts uint32 | length uint32 | body [maxJobSize, padded to 8]
+
+Slots move free -> reserved (by a worker about to receive) -> leased, and
+from leased to busy while the holder acks it or someone recovers it. Only
+the process that moved a slot out of free or into busy writes its fields.
+Reserving a slot bumps its generation, and every transition is a CAS of
+generation and state together, so a stale view of a slot that has since
+been freed and leased again can never act on the new lease.
+
+Jobs on the queue are: job id uint64 | attempts uint32 | unused uint32 | body
+*/
+
+const (
+	wqMagic      = 0x57514a42
+	wqHeaderSize = 16
+	wqSlotHeader = 40
+	wqJobHeader  = 16
+
+	slotFree     = 0
+	slotReserved = 1
+	slotLeased   = 2
+	slotBusy     = 3
+)
+
+// WorkQueueTableSize returns the number of bytes of shared memory the
+// in-flight table needs for a configuration.
+func WorkQueueTableSize(cfg *WorkQueueConfig) uint {
+	c := cfg.withDefaults()
+	return wqHeaderSize + uint(c.Slots)*slotSize(c.MaxJobSize)
+}
+
+func slotSize(maxJobSize uint) uint {
+	return wqSlotHeader + (maxJobSize+7)&^7
+}
+
+// WorkQueue hands out jobs from a MessageQueue with leases recorded in a
+// shared memory table, so that a job isn't lost if its worker dies. Jobs
+// that aren't acked before the lease times out, or whose holder exits, are
+// put back on the queue; those that keep failing go to a dead-letter mtype.
+//
+// Delivery is at-least-once: a job can run again if its worker was only
+// slow. A worker dying in the instant between taking a job off the queue
+// and recording it in the table can still lose it.
+type WorkQueue struct {
+	mq    MessageQueue
+	table *SharedMemMount
+	cfg   WorkQueueConfig
+
+	counter uint32
+}
+
+// Job is a unit of work leased from a WorkQueue.
+type Job struct {
+	ID uint64
+
+	// Attempts is the number of times the job has been leased, including
+	// this one.
+	Attempts int
+
+	Body []byte
+
+	slot int
+	gen  uint64
+}
+
+// NewWorkQueue creates a WorkQueue over mq, keeping its in-flight table at
+// the start of table, which must be at least WorkQueueTableSize bytes and
+// zero-filled (as a new segment is) or already set up by another process.
+func NewWorkQueue(mq MessageQueue, table *SharedMemMount, cfg *WorkQueueConfig) (*WorkQueue, error) {
+	c := cfg.withDefaults()
+	if c.JobType < 1 || c.DeadLetterType < 1 || c.JobType == c.DeadLetterType {
+		return nil, errors.New("sysvipc: job and dead-letter types must be distinct and positive")
+	}
+	if table.readonly {
+		return nil, ErrReadOnlyShm
+	}
+	if table.length < WorkQueueTableSize(&c) {
+		return nil, errors.New("sysvipc: shared memory too small for work queue table")
+	}
+
+	wq := &WorkQueue{mq: mq, table: table, cfg: c}
+
+	hdr := (*[4]uint32)(table.ptr)
+	ok, err := setupHeader(&hdr[0], wqMagic,
+		headerField{&hdr[1], uint32(c.Slots)},
+		headerField{&hdr[2], uint32(c.MaxJobSize)},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("sysvipc: work queue table was set up with a different configuration")
+	}
+
+	return wq, nil
+}
+
+// Put adds a job to the queue.
+func (wq *WorkQueue) Put(body []byte, flags *MQSendFlags) error {
+	if uint(len(body)) > wq.cfg.MaxJobSize {
+		return errors.New("sysvipc: job larger than MaxJobSize")
+	}
+	id := uint64(os.Getpid())<<32 | uint64(atomic.AddUint32(&wq.counter, 1))
+	return wq.mq.Send(wq.cfg.JobType, encodeJob(id, 0, body), flags)
+}
+
+// Lease takes the next job off the queue and records it as in-flight under
+// this process. It must be finished with Ack or Fail before LeaseTimeout.
+// Expired leases are recovered first; with DontWait, any that don't fit on
+// a full queue are left for a later Recover.
+func (wq *WorkQueue) Lease(flags *MQRecvFlags) (*Job, error) {
+	sendFlags := &MQSendFlags{}
+	if flags != nil {
+		sendFlags.DontWait = flags.DontWait
+	}
+	if _, _, err := wq.recover(sendFlags); err != nil {
+		return nil, err
+	}
+
+	slot, gen := wq.reserve()
+	if slot < 0 {
+		return nil, ErrTableFull
+	}
+	s := wq.slot(slot)
+
+	recvFlags := &MQRecvFlags{}
+	if flags != nil {
+		recvFlags.DontWait = flags.DontWait
+	}
+	msg, _, err := wq.mq.Receive(wqJobHeader+wq.cfg.MaxJobSize, wq.cfg.JobType, recvFlags)
+	if err != nil {
+		s.free(gen)
+		return nil, err
+	}
+	id, attempts, body, err := decodeJob(msg)
+	if err != nil {
+		s.free(gen)
+		return nil, err
+	}
+	attempts++
+
+	*s.deadline() = time.Now().Add(wq.cfg.LeaseTimeout).UnixNano()
+	*s.jobID() = id
+	*s.attempts() = uint32(attempts)
+	*s.length() = uint32(len(body))
+	copy(s.body(len(body)), body)
+	s.set(gen, slotLeased)
+
+	return &Job{ID: id, Attempts: attempts, Body: body, slot: slot, gen: gen}, nil
+}
+
+// Ack marks a job as done and releases its lease.
+func (wq *WorkQueue) Ack(job *Job) error {
+	s, err := wq.take(job)
+	if err != nil {
+		return err
+	}
+	s.free(job.gen)
+	return nil
+}
+
+// Fail releases a job's lease and puts it back on the queue, or on the
+// dead-letter type if it has used up its attempts.
+func (wq *WorkQueue) Fail(job *Job) error {
+	s, err := wq.take(job)
+	if err != nil {
+		return err
+	}
+	return wq.requeue(s, job.gen, nil)
+}
+
+// Recover puts back on the queue every leased job whose lease has expired
+// or whose holder has exited, and reports how many were requeued and how
+// many were sent to the dead-letter type instead.
+func (wq *WorkQueue) Recover() (requeued, deadLettered int, err error) {
+	return wq.recover(nil)
+}
+
+// recover is Recover, sending with flags. A job that can't be sent without
+// waiting is skipped, and left expired for the next try.
+func (wq *WorkQueue) recover(flags *MQSendFlags) (requeued, deadLettered int, err error) {
+	me := uint32(os.Getpid())
+	now := time.Now().UnixNano()
+
+	for i := 0; i < wq.cfg.Slots; i++ {
+		s := wq.slot(i)
+		gen, state := s.load()
+		switch state {
+		case slotReserved:
+			// a worker waiting in msgrcv; only clean up if it's gone (a 0
+			// holder means it hasn't recorded itself yet)
+			holder := atomic.LoadUint32(s.holder())
+			if holder != 0 && !processAlive(int(holder)) && s.cas(gen, slotReserved, slotBusy) {
+				s.free(gen)
+			}
+			continue
+		case slotLeased:
+			holder := atomic.LoadUint32(s.holder())
+			if *s.deadline() >= now && processAlive(int(holder)) {
+				continue
+			}
+			// fails if the lease we looked at has been acked or recovered,
+			// even if the slot has been leased again since
+			if !s.cas(gen, slotLeased, slotBusy) {
+				continue
+			}
+			// another Recover may see it busy under a dead holder, so
+			// whoever swaps in their own PID first does the requeue; if
+			// that's not us, they have it and we leave it to them
+			if !atomic.CompareAndSwapUint32(s.holder(), holder, me) {
+				continue
+			}
+		case slotBusy:
+			// died partway through acking or requeueing
+			holder := atomic.LoadUint32(s.holder())
+			if processAlive(int(holder)) || !atomic.CompareAndSwapUint32(s.holder(), holder, me) {
+				continue
+			}
+		default:
+			continue
+		}
+
+		dead := int(*s.attempts()) >= wq.cfg.MaxAttempts
+		err := wq.requeue(s, gen, flags)
+		if err == syscall.EAGAIN {
+			continue
+		}
+		if err != nil {
+			return requeued, deadLettered, err
+		}
+		if dead {
+			deadLettered++
+		} else {
+			requeued++
+		}
+	}
+	return requeued, deadLettered, nil
+}
+
+// ReceiveDeadLetter takes a job off the dead-letter type. It isn't leased,
+// so nothing needs to be done with it afterwards.
+func (wq *WorkQueue) ReceiveDeadLetter(flags *MQRecvFlags) (*Job, error) {
+	msg, _, err := wq.mq.Receive(wqJobHeader+wq.cfg.MaxJobSize, wq.cfg.DeadLetterType, flags)
+	if err != nil {
+		return nil, err
+	}
+	id, attempts, body, err := decodeJob(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &Job{ID: id, Attempts: attempts, Body: body, slot: -1}, nil
+}
+
+// reserve claims a free slot for this process, returning -1 if there are
+// none.
+func (wq *WorkQueue) reserve() (int, uint64) {
+	for i := 0; i < wq.cfg.Slots; i++ {
+		s := wq.slot(i)
+		gen, state := s.load()
+		if state == slotFree && atomic.CompareAndSwapUint64(s.word(), slotWord(gen, slotFree), slotWord(gen+1, slotReserved)) {
+			atomic.StoreUint32(s.holder(), uint32(os.Getpid()))
+			return i, gen + 1
+		}
+	}
+	return -1, 0
+}
+
+// take moves a job's slot from leased to busy, if it is still this lease.
+func (wq *WorkQueue) take(job *Job) (wqSlot, error) {
+	if job.slot < 0 || job.slot >= wq.cfg.Slots {
+		return wqSlot{}, ErrLeaseLost
+	}
+	s := wq.slot(job.slot)
+
+	// the generation in the CAS catches the slot having been recovered
+	// and leased out again
+	if !s.cas(job.gen, slotLeased, slotBusy) {
+		return wqSlot{}, ErrLeaseLost
+	}
+	return s, nil
+}
+
+// requeue sends a busy slot's job back to the queue (or the dead-letter
+// type) and frees the slot. If sending fails the slot is left leased and
+// expired, for Recover to try again.
+func (wq *WorkQueue) requeue(s wqSlot, gen uint64, flags *MQSendFlags) error {
+	attempts := int(*s.attempts())
+	mtyp := wq.cfg.JobType
+	if attempts >= wq.cfg.MaxAttempts {
+		mtyp = wq.cfg.DeadLetterType
+	}
+
+	body := s.body(int(*s.length()))
+	for {
+		err := wq.mq.Send(mtyp, encodeJob(*s.jobID(), attempts, body), flags)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			*s.deadline() = 0
+			s.set(gen, slotLeased)
+			return err
+		}
+		break
+	}
+
+	s.free(gen)
+	return nil
+}
+
+func (wq *WorkQueue) slot(i int) wqSlot {
+	offset := wqHeaderSize + uintptr(i)*uintptr(slotSize(wq.cfg.MaxJobSize))
+	return wqSlot{unsafe.Pointer(uintptr(wq.table.ptr) + offset)}
+}
+
+type wqSlot struct {
+	p unsafe.Pointer
+}
+
+func (s wqSlot) word() *uint64     { return (*uint64)(s.p) }
+func (s wqSlot) holder() *uint32   { return (*uint32)(unsafe.Add(s.p, 8)) }
+func (s wqSlot) deadline() *int64  { return (*int64)(unsafe.Add(s.p, 16)) }
+func (s wqSlot) jobID() *uint64    { return (*uint64)(unsafe.Add(s.p, 24)) }
+func (s wqSlot) attempts() *uint32 { return (*uint32)(unsafe.Add(s.p, 32)) }
+func (s wqSlot) length() *uint32   { return (*uint32)(unsafe.Add(s.p, 36)) }
+
+func slotWord(gen uint64, state uint32) uint64 {
+	return gen<<2 | uint64(state)
+}
+
+// load returns the slot's generation and state.
+func (s wqSlot) load() (uint64, uint32) {
+	w := atomic.LoadUint64(s.word())
+	return w >> 2, uint32(w & 3)
+}
+
+// cas moves the slot from one state to another, if it is still at gen.
+func (s wqSlot) cas(gen uint64, from, to uint32) bool {
+	return atomic.CompareAndSwapUint64(s.word(), slotWord(gen, from), slotWord(gen, to))
+}
+
+// set stores the state of a slot this process has exclusive use of.
+func (s wqSlot) set(gen uint64, state uint32) {
+	atomic.StoreUint64(s.word(), slotWord(gen, state))
+}
+
+// free releases the slot. The holder is cleared first, so a reserved slot
+// only ever shows its reserver or 0.
+func (s wqSlot) free(gen uint64) {
+	atomic.StoreUint32(s.holder(), 0)
+	s.set(gen, slotFree)
+}
+
+func (s wqSlot) body(n int) []byte {
+	return unsafe.Slice((*byte)(unsafe.Add(s.p, wqSlotHeader)), n)
+}
+
+func encodeJob(id uint64, attempts int, body []byte) []byte {
+	b := make([]byte, wqJobHeader+len(body))
+	binary.LittleEndian.PutUint64(b[0:], id)
+	binary.LittleEndian.PutUint32(b[8:], uint32(attempts))
+	copy(b[wqJobHeader:], body)
+	return b
+}
+
+func decodeJob(b []byte) (uint64, int, []byte, error) {
+	if len(b) < wqJobHeader {
+		return 0, 0, nil, errors.New("sysvipc: malformed work queue job")
+	}
+	id := binary.LittleEndian.Uint64(b[0:])
+	attempts := int(binary.LittleEndian.Uint32(b[8:]))
+	return id, attempts, b[wqJobHeader:], nil
+}
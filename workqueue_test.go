@@ -0,0 +1,280 @@
+package sysvipc
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWorkQueueAck(t *testing.T) {
+	wq := wqSetup(t, nil)
+	defer wqTeardown(t)
+
+	if err := wq.Put([]byte("job one"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := wq.Lease(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(job.Body) != "job one" || job.Attempts != 1 {
+		t.Errorf("got %q on attempt %d", job.Body, job.Attempts)
+	}
+
+	if err := wq.Ack(job); err != nil {
+		t.Fatal(err)
+	}
+	if err := wq.Ack(job); err != ErrLeaseLost {
+		t.Error("double Ack should fail", err)
+	}
+
+	if _, err := wq.Lease(&MQRecvFlags{DontWait: true}); err == nil {
+		t.Error("acked job shouldn't come back")
+	}
+}
+
+func TestWorkQueueFail(t *testing.T) {
+	wq := wqSetup(t, &WorkQueueConfig{MaxAttempts: 2})
+	defer wqTeardown(t)
+
+	if err := wq.Put([]byte("flaky"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		job, err := wq.Lease(&MQRecvFlags{DontWait: true})
+		if err != nil {
+			t.Fatal(attempt, err)
+		}
+		if job.Attempts != attempt {
+			t.Errorf("expected attempt %d, got %d", attempt, job.Attempts)
+		}
+		if err := wq.Fail(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := wq.Lease(&MQRecvFlags{DontWait: true}); err == nil {
+		t.Error("job should have gone to the dead letters")
+	}
+
+	dead, err := wq.ReceiveDeadLetter(&MQRecvFlags{DontWait: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dead.Body) != "flaky" || dead.Attempts != 2 {
+		t.Errorf("dead letter %q after %d attempts", dead.Body, dead.Attempts)
+	}
+}
+
+func TestWorkQueueLeaseTimeout(t *testing.T) {
+	wq := wqSetup(t, &WorkQueueConfig{LeaseTimeout: 10 * time.Millisecond})
+	defer wqTeardown(t)
+
+	if err := wq.Put([]byte("slow"), nil); err != nil {
+		t.Fatal(err)
+	}
+	job, err := wq.Lease(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if requeued, _, err := wq.Recover(); err != nil || requeued != 0 {
+		t.Error("live lease shouldn't be recovered", requeued, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	requeued, dead, err := wq.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeued != 1 || dead != 0 {
+		t.Error("expired lease should have been requeued", requeued, dead)
+	}
+
+	if err := wq.Ack(job); err != ErrLeaseLost {
+		t.Error("ack after the lease expired should fail", err)
+	}
+
+	again, err := wq.Lease(&MQRecvFlags{DontWait: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != job.ID || again.Attempts != 2 {
+		t.Errorf("redelivered %d on attempt %d", again.ID, again.Attempts)
+	}
+
+	// the stale Job mustn't be able to ack the new lease on the same slot
+	if err := wq.Ack(job); err != ErrLeaseLost {
+		t.Error("stale ack should fail", err)
+	}
+	if err := wq.Ack(again); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWorkQueueDeadHolder(t *testing.T) {
+	wq := wqSetup(t, nil)
+	defer wqTeardown(t)
+
+	if err := wq.Put([]byte("orphan"), nil); err != nil {
+		t.Fatal(err)
+	}
+	job, err := wq.Lease(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// hand the lease to a process that has since exited
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	*wq.slot(job.slot).holder() = uint32(cmd.Process.Pid)
+
+	again, err := wq.Lease(&MQRecvFlags{DontWait: true})
+	if err != nil {
+		t.Fatal("dead holder's job should have been recovered", err)
+	}
+	if again.ID != job.ID {
+		t.Error("wrong job redelivered")
+	}
+	wq.Ack(again)
+}
+
+func TestWorkQueueStaleLease(t *testing.T) {
+	wq := wqSetup(t, &WorkQueueConfig{Slots: 1})
+	defer wqTeardown(t)
+
+	wq.Put([]byte("first"), nil)
+	wq.Put([]byte("second"), nil)
+	first, err := wq.Lease(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first lease is lost and the slot leased again
+	*wq.slot(first.slot).deadline() = 0
+	second, err := wq.Lease(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.slot != first.slot || second.gen == first.gen {
+		t.Fatal("expected the same slot at a new generation")
+	}
+
+	if err := wq.Ack(first); err != ErrLeaseLost {
+		t.Error("acking the old lease should fail", err)
+	}
+	if gen, state := wq.slot(second.slot).load(); gen != second.gen || state != slotLeased {
+		t.Errorf("the new lease was disturbed: generation %d, state %d", gen, state)
+	}
+	if n, _, _ := wq.Recover(); n != 0 {
+		t.Error("a live, unexpired lease was recovered")
+	}
+	if err := wq.Ack(second); err != nil {
+		t.Error("the new lease should still ack", err)
+	}
+}
+
+func TestWorkQueueLeaseDontWaitFull(t *testing.T) {
+	wq := wqSetup(t, nil)
+	defer wqTeardown(t)
+
+	wq.Put([]byte("expired"), nil)
+	expired, err := wq.Lease(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*wq.slot(expired.slot).deadline() = 0
+
+	// fill the queue so the expired job can't go back on it
+	if err := q.SetMaxBytes(256); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if err := wq.Put([]byte("filler"), &MQSendFlags{DontWait: true}); err == syscall.EAGAIN {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		job, err := wq.Lease(&MQRecvFlags{DontWait: true})
+		if err == nil && string(job.Body) != "filler" {
+			err = fmt.Errorf("leased %q", job.Body)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Lease with DontWait blocked on a full queue")
+	}
+
+	// there's room now, so the expired job is still there to recover
+	if n, _, err := wq.Recover(); n != 1 || err != nil {
+		t.Errorf("recovered %d: %v", n, err)
+	}
+}
+
+func TestWorkQueueConfigMismatch(t *testing.T) {
+	wqSetup(t, &WorkQueueConfig{Slots: 4})
+	defer wqTeardown(t)
+
+	if _, err := NewWorkQueue(q, mount, &WorkQueueConfig{Slots: 8, MaxJobSize: 256}); err == nil {
+		t.Error("attaching with a different slot count should fail")
+	}
+
+	wq, err := NewWorkQueue(q, mount, &WorkQueueConfig{Slots: 4, MaxJobSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		wq.Put([]byte("job"), nil)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := wq.Lease(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := wq.Lease(nil); err != ErrTableFull {
+		t.Error("should have run out of slots", err)
+	}
+}
+
+func wqSetup(t *testing.T, cfg *WorkQueueConfig) *WorkQueue {
+	msgSetup(t)
+	shmSetup(t)
+
+	// small enough for shmSetup's 4096-byte segment
+	if cfg == nil {
+		cfg = &WorkQueueConfig{}
+	}
+	if cfg.Slots == 0 {
+		cfg.Slots = 8
+	}
+	cfg.MaxJobSize = 256
+
+	wq, err := NewWorkQueue(q, mount, cfg)
+	if err != nil {
+		wqTeardown(t)
+		t.Fatal(err)
+	}
+	return wq
+}
+
+func wqTeardown(t *testing.T) {
+	shmTeardown(t)
+	msgTeardown(t)
+}